@@ -0,0 +1,183 @@
+// Package audit records security relevant events to the append-only audit_events table,
+// so there's a trail of who did what from where when an account is compromised.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// Event types
+const (
+	EventRegister             = "register"
+	EventLogin                = "login"
+	EventMFAVerify            = "mfa_verify"
+	EventPasskeyLogin         = "passkey_login"
+	EventRefresh              = "refresh"
+	EventTokenReuse           = "token_reuse"
+	EventLogout               = "logout"
+	EventEmailVerified        = "email_verified"
+	EventPasswordResetRequest = "password_reset_request"
+	EventPasswordReset        = "password_reset"
+	EventPasswordChange       = "password_change"
+	EventTOTPEnroll           = "totp_enroll"
+	EventTOTPEnable           = "totp_enable"
+	EventTOTPDisable          = "totp_disable"
+	EventRecoveryCodes        = "recovery_codes_regenerate"
+	EventPasskeyAdd           = "passkey_add"
+	EventPasskeyRemove        = "passkey_remove"
+	EventSessionRevoke        = "session_revoke"
+	EventAdminRevokeSessions  = "admin_revoke_sessions"
+)
+
+// Outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeMFARequired is a correct password that still needs a second factor
+	OutcomeMFARequired = "mfa_required"
+)
+
+// Event is one audit log entry. ActorID is the user who acted, if known; Email is the
+// account an unauthenticated attempt was aimed at; Metadata holds event specific details
+// like the reason a login failed.
+type Event struct {
+	ID        int64
+	Type      string
+	Outcome   string
+	ActorID   *uuid.UUID
+	Email     string
+	IPAddress string
+	UserAgent string
+	RequestID string
+	Metadata  map[string]string
+	CreatedAt time.Time
+}
+
+// Store records and lists audit events. Logger keeps them in Postgres and MemoryStore in memory.
+type Store interface {
+	Record(ctx context.Context, e Event)
+	List(ctx context.Context, f Filter) ([]Event, error)
+}
+
+var _ Store = (*Logger)(nil)
+
+// Logger writes and reads audit events
+type Logger struct {
+	db       *pgxpool.Pool
+	timeouts db.Timeouts
+}
+
+// NewLogger creates an audit logger backed by the database
+func NewLogger(database *pgxpool.Pool, timeouts db.Timeouts) *Logger {
+	return &Logger{db: database, timeouts: timeouts}
+}
+
+// Record appends an event. A failure to write is logged rather than returned, an outage
+// of the audit table shouldn't stop people from logging in. The write outlives ctx being
+// cancelled, a client hanging up mid-request doesn't get to drop its audit trail.
+func (l *Logger) Record(ctx context.Context, e Event) {
+	ctx, cancel := l.timeouts.WriteContext(context.WithoutCancel(ctx))
+	defer cancel()
+
+	metadata := []byte("{}")
+	if len(e.Metadata) > 0 {
+		// a map of strings always encodes
+		metadata, _ = json.Marshal(e.Metadata)
+	}
+
+	query := `
+        INSERT INTO audit_events (event_type, outcome, actor_id, email, ip_address, user_agent, request_id, metadata, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    `
+	_, err := l.db.Exec(ctx, query, e.Type, e.Outcome, e.ActorID, strings.ToLower(strings.TrimSpace(e.Email)),
+		e.IPAddress, e.UserAgent, e.RequestID, metadata, time.Now())
+	if err != nil {
+		slog.Error("failed to record audit event", "type", e.Type, "request_id", e.RequestID, "err", err)
+	}
+}
+
+// Filter narrows down a listing, zero fields match everything
+type Filter struct {
+	Type    string
+	Outcome string
+	ActorID *uuid.UUID
+	Email   string
+	Since   time.Time
+	Until   time.Time
+	// Before is the ID cursor from the previous page, events older than it are returned
+	Before int64
+	Limit  int
+}
+
+// List returns the events matching the filter, newest first
+func (l *Logger) List(ctx context.Context, f Filter) ([]Event, error) {
+	ctx, cancel := l.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	var conditions []string
+	var args []any
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if f.Type != "" {
+		add("event_type = $%d", f.Type)
+	}
+	if f.Outcome != "" {
+		add("outcome = $%d", f.Outcome)
+	}
+	if f.ActorID != nil {
+		add("actor_id = $%d", *f.ActorID)
+	}
+	if f.Email != "" {
+		add("email = $%d", strings.ToLower(strings.TrimSpace(f.Email)))
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= $%d", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("created_at < $%d", f.Until)
+	}
+	if f.Before > 0 {
+		add("id < $%d", f.Before)
+	}
+
+	query := `
+        SELECT id, event_type, outcome, actor_id, email, ip_address, user_agent, request_id, metadata, created_at
+        FROM audit_events`
+	if len(conditions) > 0 {
+		query += "\n        WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf("\n        ORDER BY id DESC\n        LIMIT $%d", len(args))
+
+	rows, err := l.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		var metadata []byte
+		if err := rows.Scan(&e.ID, &e.Type, &e.Outcome, &e.ActorID, &e.Email, &e.IPAddress,
+			&e.UserAgent, &e.RequestID, &metadata, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
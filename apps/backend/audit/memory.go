@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ Store = (*MemoryStore)(nil)
+
+// MemoryStore keeps audit events in memory, for tests and trying things out without a database
+type MemoryStore struct {
+	mu     sync.Mutex
+	events []Event // oldest first, an event's ID is its position plus one
+}
+
+// NewMemoryStore creates an empty in-memory audit store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Record appends an event
+func (s *MemoryStore) Record(_ context.Context, e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.ID = int64(len(s.events) + 1)
+	e.Email = strings.ToLower(strings.TrimSpace(e.Email))
+	e.CreatedAt = time.Now()
+	s.events = append(s.events, e)
+}
+
+// List returns the events matching the filter, newest first
+func (s *MemoryStore) List(_ context.Context, f Filter) ([]Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	email := strings.ToLower(strings.TrimSpace(f.Email))
+	var events []Event
+	for i := len(s.events) - 1; i >= 0 && len(events) < f.Limit; i-- {
+		e := s.events[i]
+		switch {
+		case f.Type != "" && e.Type != f.Type,
+			f.Outcome != "" && e.Outcome != f.Outcome,
+			f.ActorID != nil && (e.ActorID == nil || *e.ActorID != *f.ActorID),
+			email != "" && e.Email != email,
+			!f.Since.IsZero() && e.CreatedAt.Before(f.Since),
+			!f.Until.IsZero() && !e.CreatedAt.Before(f.Until),
+			f.Before > 0 && e.ID >= f.Before:
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
@@ -0,0 +1,240 @@
+// Package authtest builds an AuthService on in-memory stores, for tests of the service and
+// of the handlers in front of it.
+package authtest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/mail"
+	"github.com/pjontop/placer/backend/models"
+	"github.com/pjontop/placer/backend/revocation"
+	"github.com/pjontop/placer/backend/webauthn"
+)
+
+// Password is what CreateUser gives every user
+const Password = "correct horse battery staple"
+
+// Env is an AuthService along with the stores behind it, so tests can look at or change
+// what it has saved
+type Env struct {
+	Service       *auth.AuthService
+	Config        auth.Config
+	Users         *models.MemoryUserStore
+	RefreshTokens *models.MemoryRefreshTokenStore
+	UserTokens    *models.MemoryUserTokenStore
+	MFA           *models.MemoryMFAStore
+	WebAuthn      *models.MemoryWebAuthnStore
+	LoginHistory  *models.MemoryLoginHistoryStore
+	Revoked       *revocation.MemoryStore
+	Mailbox       *Mailbox
+	Logger        *slog.Logger
+}
+
+// Config returns the settings New starts from
+func Config() auth.Config {
+	return auth.Config{
+		JWTSecret:            "test-secret",
+		AccessTokenTTL:       15 * time.Minute,
+		Issuer:               "placer-test",
+		Audience:             "http://localhost:3000",
+		Leeway:               time.Second,
+		AppURL:               "http://localhost:3000",
+		VerificationTokenTTL: time.Hour,
+		PasswordResetTTL:     time.Hour,
+		EmailCooldown:        0,
+		EmailMaxPerHour:      100,
+		MFAIssuer:            "Placer",
+		MFAEncryptionKey:     "test-mfa-key",
+		MFAChallengeTTL:      5 * time.Minute,
+		LockoutThreshold:     3,
+		LockoutBase:          time.Minute,
+		LockoutMax:           time.Hour,
+	}
+}
+
+// New creates an AuthService signing HS256 tokens on empty in-memory stores. configure, if
+// given, can change the settings first.
+func New(t testing.TB, configure ...func(cfg *auth.Config)) *Env {
+	t.Helper()
+
+	cfg := Config()
+	for _, fn := range configure {
+		fn(&cfg)
+	}
+
+	env := &Env{
+		Config:        cfg,
+		Users:         models.NewMemoryUserStore(),
+		RefreshTokens: models.NewMemoryRefreshTokenStore(),
+		UserTokens:    models.NewMemoryUserTokenStore(),
+		MFA:           models.NewMemoryMFAStore(),
+		WebAuthn:      models.NewMemoryWebAuthnStore(),
+		LoginHistory:  models.NewMemoryLoginHistoryStore(),
+		Revoked:       revocation.NewMemoryStore(1000),
+		Mailbox:       &Mailbox{},
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	keys, err := auth.LoadKeySet(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("load key set: %v", err)
+	}
+	keys.WithHS256(cfg.JWTSecret, time.Time{})
+
+	passkeys, err := webauthn.NewService(env.Users, env.WebAuthn, webauthn.Config{
+		RPID:          "localhost",
+		RPDisplayName: "Placer",
+		RPOrigins:     []string{"http://localhost:3000"},
+		SessionTTL:    5 * time.Minute,
+	}, env.Logger)
+	if err != nil {
+		t.Fatalf("create webauthn service: %v", err)
+	}
+
+	tx := models.NewMemoryTransactor(models.Stores{
+		Users:         env.Users,
+		RefreshTokens: env.RefreshTokens,
+		UserTokens:    env.UserTokens,
+		MFA:           env.MFA,
+		WebAuthn:      env.WebAuthn,
+		LoginHistory:  env.LoginHistory,
+	})
+	env.Service, err = auth.NewAuthService(env.Users, env.RefreshTokens, env.UserTokens, env.MFA, tx, passkeys, keys,
+		env.Revoked, env.Mailbox, cfg, env.Logger)
+	if err != nil {
+		t.Fatalf("create auth service: %v", err)
+	}
+	return env
+}
+
+// CreateUser registers a user with Password and a verified email
+func (e *Env) CreateUser(t testing.TB, email string) *models.User {
+	t.Helper()
+
+	ctx := context.Background()
+	user, err := e.Service.Register(ctx, email, "Test User", Password)
+	if err != nil {
+		t.Fatalf("register %s: %v", email, err)
+	}
+	if err := e.Users.MarkEmailVerified(ctx, user.ID); err != nil {
+		t.Fatalf("verify %s: %v", email, err)
+	}
+	return user
+}
+
+// Login logs a user in with Password, failing the test if that doesn't give a token pair
+func (e *Env) Login(t testing.TB, email string) *auth.LoginResult {
+	t.Helper()
+
+	result, err := e.Service.LoginWithRefresh(context.Background(), email, Password, time.Hour, models.ClientInfo{})
+	if err != nil {
+		t.Fatalf("login %s: %v", email, err)
+	}
+	if result.AccessToken == "" {
+		t.Fatalf("login %s: got an MFA challenge instead of tokens", email)
+	}
+	return result
+}
+
+// EnableTOTP enrolls and confirms TOTP for a user, returning the secret and recovery codes
+func (e *Env) EnableTOTP(t testing.TB, email string) (secret string, recoveryCodes []string) {
+	t.Helper()
+
+	ctx := context.Background()
+	user, err := e.Users.GetUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatalf("find %s: %v", email, err)
+	}
+	enrollment, err := e.Service.EnrollTOTP(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("enroll totp: %v", err)
+	}
+	recoveryCodes, err = e.Service.ConfirmTOTP(ctx, user.ID, TOTPCode(t, enrollment.Secret, time.Now()))
+	if err != nil {
+		t.Fatalf("confirm totp: %v", err)
+	}
+	return enrollment.Secret, recoveryCodes
+}
+
+// TOTPCode computes the code an authenticator app would show for secret at a time
+func TOTPCode(t testing.TB, secret string, at time.Time) string {
+	t.Helper()
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		t.Fatalf("decode totp secret: %v", err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// Mailbox is a mail.Sender that keeps what it was asked to send
+type Mailbox struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+// Send keeps the message
+func (m *Mailbox) Send(msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns everything sent to an address, oldest first
+func (m *Mailbox) Messages(to string) []mail.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var messages []mail.Message
+	for _, msg := range m.messages {
+		if msg.To == to {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// tokenLink finds the token in a link from an email body
+var tokenLink = regexp.MustCompile(`\?token=(\S+)`)
+
+// Token returns the token from the link in the latest email to an address
+func (m *Mailbox) Token(t testing.TB, to string) string {
+	t.Helper()
+
+	messages := m.Messages(to)
+	if len(messages) == 0 {
+		t.Fatalf("no email sent to %s", to)
+	}
+	match := tokenLink.FindStringSubmatch(messages[len(messages)-1].Body)
+	if match == nil {
+		t.Fatalf("no token link in the email to %s", to)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatalf("unescape token: %v", err)
+	}
+	return token
+}
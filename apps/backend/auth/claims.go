@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// AccessClaims are the claims carried by an access token
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	// SessionID is the refresh token family the token was issued from
+	SessionID string `json:"sid"`
+	Role      string `json:"role,omitempty"`
+}
+
+// Validate is called by the JWT parser after the registered claims are checked,
+// it rejects tokens missing the claims the rest of the service relies on
+func (c *AccessClaims) Validate() error {
+	if c.ID == "" {
+		return errors.New("token has no jti")
+	}
+	if _, err := uuid.Parse(c.Subject); err != nil {
+		return errors.New("token subject is not a user id")
+	}
+	if _, err := uuid.Parse(c.SessionID); err != nil {
+		return errors.New("token has no session id")
+	}
+	return nil
+}
+
+// UserID returns the subject as a user ID, Validate guarantees it parses
+func (c *AccessClaims) UserID() uuid.UUID {
+	id, _ := uuid.Parse(c.Subject)
+	return id
+}
+
+// Session returns the ID of the session the token belongs to
+func (c *AccessClaims) Session() uuid.UUID {
+	id, _ := uuid.Parse(c.SessionID)
+	return id
+}
@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is one key in the key set, retired keys only have the public half
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	private   crypto.Signer
+	public    crypto.PublicKey
+}
+
+// method returns the JWT signing method for the key's algorithm
+func (k *SigningKey) method() jwt.SigningMethod {
+	if k.Algorithm == jwt.SigningMethodEdDSA.Alg() {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// JWKSMaxAge is how long other services may cache our JWKS, and so how long a new key has to
+// be published before anything can rely on them knowing it
+const JWKSMaxAge = 5 * time.Minute
+
+// KeySet holds the keys access tokens are signed and verified with. The active key signs
+// new tokens while every key in the set, including retired ones, still verifies them,
+// so keys can be rotated without logging anyone out.
+type KeySet struct {
+	keys map[string]*SigningKey
+	// signers are the keys that can sign, by kid. Unless one was pinned, the last one signs
+	// once it has been published for publishDelay and the one before it until then.
+	signers      []*SigningKey
+	pinned       *SigningKey
+	loadedAt     time.Time
+	publishDelay time.Duration
+	// hmacSecret verifies legacy HS256 tokens until hmacUntil, or signs them if there's no active key
+	hmacSecret []byte
+	hmacUntil  time.Time
+}
+
+// LoadKeySet reads every <kid>.pem file in dir. Private keys (PKCS#8 RSA or Ed25519) can sign,
+// public keys (PKIX) of retired signing keys only verify. The key named activeKID signs new
+// tokens, or the private key with the greatest kid if it's empty, so date-prefixed kids rotate
+// by just dropping a new file in. Picked that way, the newest key is only published in the
+// JWKS for its first JWKSMaxAge and the previous key keeps signing, so services holding a
+// cached JWKS have fetched the new key before they see tokens signed with it.
+func LoadKeySet(dir, activeKID string) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{keys: map[string]*SigningKey{}, loadedAt: time.Now(), publishDelay: JWKSMaxAge}
+	for _, file := range files {
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+		key, err := loadSigningKey(kid, file)
+		if err != nil {
+			return nil, fmt.Errorf("load key %s: %w", file, err)
+		}
+		ks.keys[kid] = key
+		if key.private != nil {
+			ks.signers = append(ks.signers, key)
+		}
+	}
+	sort.Slice(ks.signers, func(i, j int) bool { return ks.signers[i].ID < ks.signers[j].ID })
+
+	if activeKID != "" {
+		key, ok := ks.keys[activeKID]
+		if !ok || key.private == nil {
+			return nil, fmt.Errorf("active signing key %q has no private key in %s", activeKID, dir)
+		}
+		ks.pinned = key
+	}
+	return ks, nil
+}
+
+// WithPublishDelay changes how long the newest key is only published before it starts
+// signing, JWKSMaxAge by default
+func (ks *KeySet) WithPublishDelay(delay time.Duration) *KeySet {
+	ks.publishDelay = delay
+	return ks
+}
+
+// loadSigningKey parses a PEM encoded private or public key
+func loadSigningKey(kid, file string) (*SigningKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	key := &SigningKey{ID: kid}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key type")
+		}
+		key.private = signer
+		key.public = signer.Public()
+	case "PUBLIC KEY":
+		key.public, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	switch pub := key.public.(type) {
+	case ed25519.PublicKey:
+		key.Algorithm = jwt.SigningMethodEdDSA.Alg()
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		key.Algorithm = jwt.SigningMethodRS256.Alg()
+	default:
+		return nil, errors.New("only RSA and Ed25519 keys are supported")
+	}
+	return key, nil
+}
+
+// WithHS256 lets the key set handle tokens signed with a shared secret. With an active
+// asymmetric key, HS256 tokens are only accepted until the given time (never if it's zero);
+// without one the secret also signs, which is how the service ran before key sets existed.
+func (ks *KeySet) WithHS256(secret string, acceptUntil time.Time) *KeySet {
+	ks.hmacSecret = []byte(secret)
+	ks.hmacUntil = acceptUntil
+	return ks
+}
+
+// Active returns the key that signs new tokens, or nil when signing falls back to HS256
+func (ks *KeySet) Active() *SigningKey {
+	return ks.activeAt(time.Now())
+}
+
+// activeAt picks the signing key at the given time. With a single key there's no older one
+// to wait with, so it signs straight away.
+func (ks *KeySet) activeAt(now time.Time) *SigningKey {
+	if ks.pinned != nil {
+		return ks.pinned
+	}
+	n := len(ks.signers)
+	switch {
+	case n == 0:
+		return nil
+	case n > 1 && now.Before(ks.loadedAt.Add(ks.publishDelay)):
+		return ks.signers[n-2]
+	default:
+		return ks.signers[n-1]
+	}
+}
+
+// CanSign reports whether there's any key to sign tokens with
+func (ks *KeySet) CanSign() bool {
+	return len(ks.signers) > 0 || len(ks.hmacSecret) > 0
+}
+
+// sign signs the claims with the active key, or HS256 if there isn't one
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	active := ks.Active()
+	if active == nil {
+		if len(ks.hmacSecret) == 0 {
+			return "", errors.New("no signing key configured")
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.hmacSecret)
+	}
+	token := jwt.NewWithClaims(active.method(), claims)
+	token.Header["kid"] = active.ID
+	return token.SignedString(active.private)
+}
+
+// keyFunc picks the verification key for a token by its kid, checking the algorithm matches
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if !ks.acceptsHS256(time.Now()) {
+			return nil, ErrInvalidToken
+		}
+		return ks.hmacSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok || token.Method.Alg() != key.Algorithm {
+		return nil, ErrInvalidToken
+	}
+	return key.public, nil
+}
+
+// acceptsHS256 reports whether legacy shared-secret tokens still verify
+func (ks *KeySet) acceptsHS256(now time.Time) bool {
+	if len(ks.hmacSecret) == 0 {
+		return false
+	}
+	if len(ks.signers) == 0 {
+		return true
+	}
+	return now.Before(ks.hmacUntil)
+}
+
+// validMethods lists the algorithms the parser should allow
+func (ks *KeySet) validMethods() []string {
+	var methods []string
+	if ks.acceptsHS256(time.Now()) {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	seen := map[string]bool{}
+	for _, key := range ks.keys {
+		if !seen[key.Algorithm] {
+			seen[key.Algorithm] = true
+			methods = append(methods, key.Algorithm)
+		}
+	}
+	return methods
+}
+
+// JWK is a public key in RFC 7517 form
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every asymmetric key, so other services can verify
+// access tokens without holding any secret
+func (ks *KeySet) JWKS() JWKS {
+	kids := make([]string, 0, len(ks.keys))
+	for kid := range ks.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, kid := range kids {
+		key := ks.keys[kid]
+		jwk := JWK{KeyID: kid, Algorithm: key.Algorithm, Use: "sig"}
+		switch pub := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
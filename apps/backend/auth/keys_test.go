@@ -0,0 +1,67 @@
+package auth_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pjontop/placer/backend/auth"
+)
+
+// writeKey saves a new Ed25519 private key to dir under kid
+func writeKey(t *testing.T, dir, kid string) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("encode key: %v", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+}
+
+func TestKeySetActive(t *testing.T) {
+	tests := []struct {
+		name      string
+		kids      []string
+		activeKID string
+		delay     time.Duration
+		want      string
+	}{
+		{name: "new key waits to be published", kids: []string{"20260101-000000", "20260201-000000"}, delay: time.Hour, want: "20260101-000000"},
+		{name: "new key signs once published", kids: []string{"20260101-000000", "20260201-000000"}, want: "20260201-000000"},
+		{name: "only key signs straight away", kids: []string{"20260101-000000"}, delay: time.Hour, want: "20260101-000000"},
+		{name: "pinned key", kids: []string{"20260101-000000", "20260201-000000"}, activeKID: "20260201-000000", delay: time.Hour, want: "20260201-000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, kid := range tt.kids {
+				writeKey(t, dir, kid)
+			}
+			keys, err := auth.LoadKeySet(dir, tt.activeKID)
+			if err != nil {
+				t.Fatalf("LoadKeySet() error = %v", err)
+			}
+			keys.WithPublishDelay(tt.delay)
+
+			if got := keys.Active(); got == nil || got.ID != tt.want {
+				t.Errorf("Active() = %+v, want %s", got, tt.want)
+			}
+			// Every key is published from the start, whichever of them signs
+			if jwks := keys.JWKS(); len(jwks.Keys) != len(tt.kids) {
+				t.Errorf("JWKS() has %d keys, want %d", len(jwks.Keys), len(tt.kids))
+			}
+		})
+	}
+}
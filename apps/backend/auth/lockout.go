@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/models"
+)
+
+// ErrAccountLocked is returned when an account is locked out after too many failed logins
+var ErrAccountLocked = errors.New("account temporarily locked")
+
+// LockoutError reports when a locked account can try again, it matches ErrAccountLocked
+type LockoutError struct {
+	Until time.Time
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("%s until %s", ErrAccountLocked, e.Until.Format(time.RFC3339))
+}
+
+func (e *LockoutError) Unwrap() error {
+	return ErrAccountLocked
+}
+
+// RetryAfter is how long until the lockout ends
+func (e *LockoutError) RetryAfter() time.Duration {
+	return time.Until(e.Until)
+}
+
+// checkLockout fails if the account is locked, before any password hashing is done
+func (s *AuthService) checkLockout(user *models.User) error {
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		return &LockoutError{Until: *user.LockedUntil}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a wrong password and locks the account once the count reaches the
+// threshold. Every further failure doubles the lockout, up to the configured maximum. The
+// attempt goes into the user's login history alongside.
+func (s *AuthService) recordLoginFailure(ctx context.Context, user *models.User, client models.ClientInfo) error {
+	var count int
+	var lockout time.Duration
+	err := s.tx.WithTx(ctx, func(ctx context.Context, stores models.Stores) error {
+		if err := stores.LoginHistory.RecordLogin(ctx, user.ID, models.LoginMethodPassword, models.LoginOutcomeFailure, client); err != nil {
+			return err
+		}
+		var err error
+		count, lockout, err = s.countLoginFailure(ctx, stores, user.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.logLockout(user.ID, count, lockout)
+	return nil
+}
+
+// recordReauthFailure counts a wrong password or code from a signed in user proving who they
+// are again, towards the same lockout as logins. It isn't a login attempt, so unlike
+// recordLoginFailure it leaves the login history alone.
+func (s *AuthService) recordReauthFailure(ctx context.Context, userID uuid.UUID) error {
+	var count int
+	var lockout time.Duration
+	err := s.tx.WithTx(ctx, func(ctx context.Context, stores models.Stores) error {
+		var err error
+		count, lockout, err = s.countLoginFailure(ctx, stores, userID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.logLockout(userID, count, lockout)
+	return nil
+}
+
+// countLoginFailure adds a failure to the user's count and locks the account if that takes
+// the count to the threshold, returning the count and the lockout, zero if there wasn't one
+func (s *AuthService) countLoginFailure(ctx context.Context, stores models.Stores, userID uuid.UUID) (int, time.Duration, error) {
+	count, err := stores.Users.RecordFailedLogin(ctx, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	lockout := s.lockoutFor(count)
+	if lockout == 0 {
+		return count, 0, nil
+	}
+	return count, lockout, stores.Users.LockUser(ctx, userID, time.Now().Add(lockout))
+}
+
+// logLockout notes a lockout once the transaction that made it has committed
+func (s *AuthService) logLockout(userID uuid.UUID, count int, lockout time.Duration) {
+	if lockout > 0 {
+		s.logger.Warn("user locked out", "user_id", userID, "duration", lockout, "failed_logins", count)
+	}
+}
+
+// lockoutFor is how long to lock an account for after count failed logins in a row, zero
+// while the count is below the threshold
+func (s *AuthService) lockoutFor(count int) time.Duration {
+	if s.cfg.LockoutThreshold <= 0 || count < s.cfg.LockoutThreshold {
+		return 0
+	}
+	lockout := s.cfg.LockoutBase
+	for i := s.cfg.LockoutThreshold; i < count && lockout < s.cfg.LockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > s.cfg.LockoutMax {
+		lockout = s.cfg.LockoutMax
+	}
+	return lockout
+}
+
+// recordFailedAttempt adds a failed login to the user's history without counting it towards
+// a lockout, for attempts refused before any credential was checked
+func (s *AuthService) recordFailedAttempt(ctx context.Context, userID uuid.UUID, method string, client models.ClientInfo) error {
+	return s.tx.WithTx(ctx, func(ctx context.Context, stores models.Stores) error {
+		return stores.LoginHistory.RecordLogin(ctx, userID, method, models.LoginOutcomeFailure, client)
+	})
+}
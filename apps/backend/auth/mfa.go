@@ -0,0 +1,402 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/models"
+)
+
+var (
+	ErrInvalidMFACode    = errors.New("invalid mfa code")
+	ErrMFAAlreadyEnabled = errors.New("mfa already enabled")
+	ErrMFANotEnabled     = errors.New("mfa not enabled")
+)
+
+const (
+	recoveryCodeCount    = 10
+	recoveryCodeLength   = 10
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	// maxMFAAttempts is how many wrong codes an MFA challenge survives
+	maxMFAAttempts = 5
+)
+
+// MFAError is a failed answer to an MFA challenge, naming the user the challenge was issued to
+// so the failure can be audited against them. It matches the error it wraps.
+type MFAError struct {
+	UserID uuid.UUID
+	Err    error
+}
+
+func (e *MFAError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MFAError) Unwrap() error {
+	return e.Err
+}
+
+// TOTPEnrollment is what a user needs to add the account to an authenticator app
+type TOTPEnrollment struct {
+	Secret          string
+	ProvisioningURI string
+}
+
+// MFAStatus summarises a user's second factors
+type MFAStatus struct {
+	TOTPEnabled            bool
+	RecoveryCodesRemaining int
+}
+
+// totpEnabled reports whether the user has a confirmed TOTP enrollment
+func (s *AuthService) totpEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	cred, err := s.mfaRepo.GetTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return cred.ConfirmedAt != nil, nil
+}
+
+// issueMFAChallenge creates the short-lived token a client trades, with a code, for a session
+func (s *AuthService) issueMFAChallenge(ctx context.Context, user *models.User) (string, error) {
+	token, tokenHash, err := generateSignedToken(s.jwtSecret, models.TokenPurposeMFAChallenge)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.userTokenRepo.CreateUserToken(ctx, user.ID, models.TokenPurposeMFAChallenge, tokenHash, s.cfg.MFAChallengeTTL); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// VerifyMFA completes a two-step login by checking a TOTP or recovery code against an MFA
+// challenge. Once the challenge is found, errors are an *MFAError naming its user.
+func (s *AuthService) VerifyMFA(ctx context.Context, mfaToken, code string, refreshTokenTTL time.Duration, client models.ClientInfo) (*LoginResult, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.VerifyMFA")
+	defer span.End()
+
+	challenge, err := s.loadMFAChallenge(ctx, mfaToken)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.answerMFAChallenge(ctx, challenge, code, refreshTokenTTL, client)
+	if err != nil {
+		return nil, &MFAError{UserID: challenge.UserID, Err: err}
+	}
+	return result, nil
+}
+
+// answerMFAChallenge checks a TOTP or recovery code against a challenge and completes the login
+func (s *AuthService) answerMFAChallenge(ctx context.Context, challenge *models.UserToken, code string, refreshTokenTTL time.Duration, client models.ClientInfo) (*LoginResult, error) {
+	user, err := s.mfaChallengeUser(ctx, challenge, client)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := s.verifySecondFactor(ctx, user.ID, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err := s.failMFAChallenge(ctx, challenge, client); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidMFACode
+	}
+	return s.completeMFAChallenge(ctx, challenge, user, refreshTokenTTL, client)
+}
+
+// loadMFAChallenge looks up a live MFA challenge without using it up
+func (s *AuthService) loadMFAChallenge(ctx context.Context, mfaToken string) (*models.UserToken, error) {
+	if !verifySignedToken(s.jwtSecret, models.TokenPurposeMFAChallenge, mfaToken) {
+		return nil, ErrInvalidToken
+	}
+	challenge, err := s.userTokenRepo.GetUserToken(ctx, models.TokenPurposeMFAChallenge, hashOpaqueToken(mfaToken))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// mfaChallengeUser loads the user an MFA challenge was issued to and refuses it while their
+// account is locked, a challenge issued before the lockout mustn't get around it
+func (s *AuthService) mfaChallengeUser(ctx context.Context, challenge *models.UserToken, client models.ClientInfo) (*models.User, error) {
+	user, err := s.userRepo.GetUserByID(ctx, challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkLockout(user); err != nil {
+		if err := s.recordFailedAttempt(ctx, user.ID, models.LoginMethodPassword, client); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// failMFAChallenge counts a wrong second factor and burns the challenge after too many,
+// so codes can't be guessed and the user has to log in again. A wrong second factor also
+// counts towards the account lockout like a wrong password, otherwise logging in again for
+// a fresh challenge would allow unlimited guesses. The password was right, but the login
+// still goes into the user's history as failed.
+func (s *AuthService) failMFAChallenge(ctx context.Context, challenge *models.UserToken, client models.ClientInfo) error {
+	var attempts, count int
+	var lockout time.Duration
+	err := s.tx.WithTx(ctx, func(ctx context.Context, stores models.Stores) error {
+		if err := stores.LoginHistory.RecordLogin(ctx, challenge.UserID, models.LoginMethodPassword, models.LoginOutcomeFailure, client); err != nil {
+			return err
+		}
+		var err error
+		count, lockout, err = s.countLoginFailure(ctx, stores, challenge.UserID)
+		if err != nil {
+			return err
+		}
+		attempts, err = stores.UserTokens.IncrementUserTokenAttempts(ctx, challenge.ID)
+		// A lockout ends the challenge too, it mustn't outlast the account being locked
+		if err != nil || (attempts < maxMFAAttempts && lockout == 0) {
+			return err
+		}
+		_, err = stores.UserTokens.ConsumeUserTokenByID(ctx, challenge.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if attempts >= maxMFAAttempts {
+		s.logger.Warn("mfa challenge burned", "user_id", challenge.UserID, "failed_attempts", attempts)
+	}
+	s.logLockout(challenge.UserID, count, lockout)
+	return nil
+}
+
+// completeMFAChallenge uses up a challenge and starts the session it was guarding. Challenges
+// only follow a password, so that's the method the login is recorded with.
+func (s *AuthService) completeMFAChallenge(ctx context.Context, challenge *models.UserToken, user *models.User, refreshTokenTTL time.Duration, client models.ClientInfo) (*LoginResult, error) {
+	// Each challenge completes one login
+	consumed, err := s.userTokenRepo.ConsumeUserTokenByID(ctx, challenge.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !consumed {
+		return nil, ErrInvalidToken
+	}
+	return s.startSession(ctx, user, models.LoginMethodPassword, refreshTokenTTL, client)
+}
+
+// verifySecondFactor checks a TOTP code, or failing that a recovery code, for the user
+func (s *AuthService) verifySecondFactor(ctx context.Context, userID uuid.UUID, code string) (bool, error) {
+	cred, err := s.mfaRepo.GetTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if cred.ConfirmedAt == nil {
+		return false, nil
+	}
+
+	secret, err := s.secrets.open(cred.SecretEncrypted)
+	if err != nil {
+		return false, err
+	}
+	if step, ok := validateTOTP(secret, code, time.Now()); ok {
+		// A code works once, even inside its validity window
+		return s.mfaRepo.UseTOTPStep(ctx, userID, step)
+	}
+
+	return s.mfaRepo.UseRecoveryCode(ctx, userID, s.hashRecoveryCode(code))
+}
+
+// MFAStatus reports which second factors a user has set up
+func (s *AuthService) MFAStatus(ctx context.Context, userID uuid.UUID) (*MFAStatus, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.MFAStatus")
+	defer span.End()
+
+	enabled, err := s.totpEnabled(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	status := &MFAStatus{TOTPEnabled: enabled}
+	if enabled {
+		status.RecoveryCodesRemaining, err = s.mfaRepo.CountRecoveryCodes(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// EnrollTOTP starts TOTP enrollment, it isn't enforced until confirmed with a code
+func (s *AuthService) EnrollTOTP(ctx context.Context, userID uuid.UUID) (*TOTPEnrollment, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.EnrollTOTP")
+	defer span.End()
+
+	user, err := s.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.secrets.seal(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mfaRepo.SaveTOTP(ctx, userID, sealed); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totpProvisioningURI(s.cfg.MFAIssuer, user.Email, secret),
+	}, nil
+}
+
+// ConfirmTOTP activates a pending enrollment once the user proves their app produces valid codes,
+// and returns a fresh set of recovery codes which are only ever shown this once
+func (s *AuthService) ConfirmTOTP(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.ConfirmTOTP")
+	defer span.End()
+
+	cred, err := s.mfaRepo.GetTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMFANotEnabled
+		}
+		return nil, err
+	}
+	if cred.ConfirmedAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := s.secrets.open(cred.SecretEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	if _, err := s.mfaRepo.UseTOTPStep(ctx, userID, step); err != nil {
+		return nil, err
+	}
+
+	codes, err := s.replaceRecoveryCodes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mfaRepo.ConfirmTOTP(ctx, userID); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP removes TOTP and the recovery codes after checking a current code
+func (s *AuthService) DisableTOTP(ctx context.Context, userID uuid.UUID, code string) error {
+	ctx, span := tracer.Start(ctx, "AuthService.DisableTOTP")
+	defer span.End()
+
+	if err := s.requireSecondFactor(ctx, userID, code); err != nil {
+		return err
+	}
+	return s.mfaRepo.DeleteTOTP(ctx, userID)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after checking a current code
+func (s *AuthService) RegenerateRecoveryCodes(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.RegenerateRecoveryCodes")
+	defer span.End()
+
+	if err := s.requireSecondFactor(ctx, userID, code); err != nil {
+		return nil, err
+	}
+	return s.replaceRecoveryCodes(ctx, userID)
+}
+
+// requireSecondFactor fails unless MFA is enabled and code is valid for it. Wrong codes count
+// towards the account lockout like they do at login, a stolen session mustn't be a way to guess
+// codes without limit, and a locked account can't use them at all.
+func (s *AuthService) requireSecondFactor(ctx context.Context, userID uuid.UUID, code string) error {
+	enabled, err := s.totpEnabled(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrMFANotEnabled
+	}
+	user, err := s.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkLockout(user); err != nil {
+		return err
+	}
+	ok, err := s.verifySecondFactor(ctx, userID, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := s.recordReauthFailure(ctx, userID); err != nil {
+			return err
+		}
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// replaceRecoveryCodes generates new recovery codes and stores their digests
+func (s *AuthService) replaceRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = s.hashRecoveryCode(code)
+	}
+	if err := s.mfaRepo.ReplaceRecoveryCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode digests a recovery code with a keyed HMAC, the codes are short
+// enough that a plain hash from a database dump could be brute forced
+func (s *AuthService) hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return signToken([]byte(s.cfg.MFAEncryptionKey), "mfa_recovery_code", normalized)
+}
+
+// generateRecoveryCode creates a code like "k7m2p-x9qrt"
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, recoveryCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for i, v := range b {
+		if i == recoveryCodeLength/2 {
+			sb.WriteByte('-')
+		}
+		// 256 isn't a multiple of the alphabet size, the slight bias is harmless here
+		sb.WriteByte(recoveryCodeAlphabet[int(v)%len(recoveryCodeAlphabet)])
+	}
+	return sb.String(), nil
+}
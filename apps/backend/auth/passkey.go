@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/models"
+)
+
+// mfaMethods lists the second factors a user can answer an MFA challenge with. Logins need
+// one as soon as there's any, a confirmed TOTP enrollment or a passkey.
+func (s *AuthService) mfaMethods(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	var methods []string
+	totp, err := s.totpEnabled(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if totp {
+		methods = append(methods, "totp", "recovery_code")
+	}
+	creds, err := s.passkeys.ListCredentials(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range creds {
+		if !c.CloneWarning {
+			methods = append(methods, "passkey")
+			break
+		}
+	}
+	return methods, nil
+}
+
+// BeginPasskeyRegistration starts adding a passkey to the user's account
+func (s *AuthService) BeginPasskeyRegistration(ctx context.Context, userID uuid.UUID) (*protocol.CredentialCreation, uuid.UUID, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.BeginPasskeyRegistration")
+	defer span.End()
+
+	user, err := s.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	return s.passkeys.BeginRegistration(ctx, user)
+}
+
+// FinishPasskeyRegistration verifies the authenticator response and saves the passkey
+func (s *AuthService) FinishPasskeyRegistration(ctx context.Context, userID, sessionID uuid.UUID, name string, response []byte) (*models.WebAuthnCredential, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.FinishPasskeyRegistration")
+	defer span.End()
+
+	user, err := s.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.passkeys.FinishRegistration(ctx, user, sessionID, name, response)
+}
+
+// ListPasskeys returns the user's registered passkeys
+func (s *AuthService) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]*models.WebAuthnCredential, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.ListPasskeys")
+	defer span.End()
+
+	return s.passkeys.ListCredentials(ctx, userID)
+}
+
+// DeletePasskey removes one of the user's passkeys
+func (s *AuthService) DeletePasskey(ctx context.Context, userID uuid.UUID, credentialID []byte) error {
+	ctx, span := tracer.Start(ctx, "AuthService.DeletePasskey")
+	defer span.End()
+
+	return s.passkeys.DeleteCredential(ctx, userID, credentialID)
+}
+
+// BeginPasskeyLogin starts a passwordless login
+func (s *AuthService) BeginPasskeyLogin(ctx context.Context) (*protocol.CredentialAssertion, uuid.UUID, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.BeginPasskeyLogin")
+	defer span.End()
+
+	return s.passkeys.BeginDiscoverableLogin(ctx)
+}
+
+// FinishPasskeyLogin verifies a passwordless assertion and issues the same token pair as
+// LoginWithRefresh. The passkey is verified with the user's PIN or biometric, so it already
+// counts as two factors and no MFA challenge follows.
+func (s *AuthService) FinishPasskeyLogin(ctx context.Context, sessionID uuid.UUID, response []byte, refreshTokenTTL time.Duration, client models.ClientInfo) (*LoginResult, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.FinishPasskeyLogin")
+	defer span.End()
+
+	user, err := s.passkeys.FinishDiscoverableLogin(ctx, sessionID, response)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.RequireVerifiedEmail && user.EmailVerifiedAt == nil {
+		return nil, ErrEmailNotVerified
+	}
+	return s.startSession(ctx, user, models.LoginMethodPasskey, refreshTokenTTL, client)
+}
+
+// BeginMFAPasskey starts a passkey assertion to answer an MFA challenge
+func (s *AuthService) BeginMFAPasskey(ctx context.Context, mfaToken string) (*protocol.CredentialAssertion, uuid.UUID, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.BeginMFAPasskey")
+	defer span.End()
+
+	challenge, err := s.loadMFAChallenge(ctx, mfaToken)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	user, err := s.userRepo.GetUserByID(ctx, challenge.UserID)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	return s.passkeys.BeginLogin(ctx, user)
+}
+
+// FinishMFAPasskey completes a two-step login with a passkey assertion as the second factor.
+// Once the challenge is found, errors are an *MFAError naming its user.
+func (s *AuthService) FinishMFAPasskey(ctx context.Context, mfaToken string, sessionID uuid.UUID, response []byte, refreshTokenTTL time.Duration, client models.ClientInfo) (*LoginResult, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.FinishMFAPasskey")
+	defer span.End()
+
+	challenge, err := s.loadMFAChallenge(ctx, mfaToken)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.answerMFAPasskey(ctx, challenge, sessionID, response, refreshTokenTTL, client)
+	if err != nil {
+		return nil, &MFAError{UserID: challenge.UserID, Err: err}
+	}
+	return result, nil
+}
+
+// answerMFAPasskey checks a passkey assertion against a challenge and completes the login
+func (s *AuthService) answerMFAPasskey(ctx context.Context, challenge *models.UserToken, sessionID uuid.UUID, response []byte, refreshTokenTTL time.Duration, client models.ClientInfo) (*LoginResult, error) {
+	user, err := s.mfaChallengeUser(ctx, challenge, client)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.passkeys.FinishLogin(ctx, user, sessionID, response); err != nil {
+		if failErr := s.failMFAChallenge(ctx, challenge, client); failErr != nil {
+			return nil, failErr
+		}
+		return nil, err
+	}
+	return s.completeMFAChallenge(ctx, challenge, user, refreshTokenTTL, client)
+}
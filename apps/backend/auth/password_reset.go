@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/mail"
+	"github.com/pjontop/placer/backend/models"
+)
+
+// RequestPasswordReset emails a password reset link to the account with the given email.
+// Unknown and throttled accounts are skipped without an error so callers can't use this
+// to find out which emails are registered.
+func (s *AuthService) RequestPasswordReset(ctx context.Context, email string) error {
+	ctx, span := tracer.Start(ctx, "AuthService.RequestPasswordReset")
+	defer span.End()
+
+	user, err := s.userRepo.GetUserByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	allowed, err := s.canSendTokenEmail(ctx, user, models.TokenPurposePasswordReset)
+	if err != nil || !allowed {
+		return err
+	}
+
+	token, tokenHash, err := generateSignedToken(s.jwtSecret, models.TokenPurposePasswordReset)
+	if err != nil {
+		return err
+	}
+	if _, err := s.userTokenRepo.CreateUserToken(ctx, user.ID, models.TokenPurposePasswordReset, tokenHash, s.cfg.PasswordResetTTL); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", s.cfg.AppURL, url.QueryEscape(token))
+	return s.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. To choose a new one, open this link:\n\n%s\n\nThe link expires in %s. If it wasn't you, you can ignore this email.\n",
+			user.Name, link, s.cfg.PasswordResetTTL),
+	})
+}
+
+// ResetPassword consumes a reset token, sets the new password and signs the user out everywhere.
+// It returns the ID of the user whose password was reset, and with an error too once the token
+// has shown whose it is.
+func (s *AuthService) ResetPassword(ctx context.Context, token, newPassword string) (uuid.UUID, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.ResetPassword")
+	defer span.End()
+
+	if !verifySignedToken(s.jwtSecret, models.TokenPurposePasswordReset, token) {
+		return uuid.Nil, ErrInvalidToken
+	}
+	tokenHash := hashOpaqueToken(token)
+	userToken, err := s.userTokenRepo.GetUserToken(ctx, models.TokenPurposePasswordReset, tokenHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, ErrInvalidToken
+		}
+		return uuid.Nil, err
+	}
+	userID := userToken.UserID
+	// Hash before using the token up, so a password bcrypt rejects doesn't burn it
+	hashedPassword, err := HashPassword(ctx, newPassword)
+	if err != nil {
+		return userID, err
+	}
+	// Burning the link, setting the password and ending the sessions happen together, so a
+	// failure part way can't use up the link or leave old sessions alive
+	var refs []models.AccessTokenRef
+	err = s.tx.WithTx(ctx, func(ctx context.Context, stores models.Stores) error {
+		// The link may have been used since it was looked up
+		if _, err := stores.UserTokens.ConsumeUserToken(ctx, models.TokenPurposePasswordReset, tokenHash); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrInvalidToken
+			}
+			return err
+		}
+		if err := stores.Users.UpdatePassword(ctx, userID, hashedPassword); err != nil {
+			return err
+		}
+		// Any other reset link still in a mailbox is dead now too
+		if err := stores.UserTokens.ConsumeUserTokens(ctx, userID, models.TokenPurposePasswordReset); err != nil {
+			return err
+		}
+		if err := stores.RefreshTokens.RevokeUserRefreshTokens(ctx, userID); err != nil {
+			return err
+		}
+		refs, err = stores.RefreshTokens.UserAccessTokens(ctx, userID, uuid.Nil)
+		return err
+	})
+	if err != nil {
+		return userID, err
+	}
+	// The denylist isn't in the database transaction, so it's only written once that commits
+	return userID, s.revokeAccessTokens(ctx, refs)
+}
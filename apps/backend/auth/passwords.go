@@ -2,11 +2,16 @@
 package auth
 
 import (
+	"context"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
 // creates a bcrypt hash from a plain-text password
-func HashPassword(password string) (string, error) {
+func HashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracer.Start(ctx, "HashPassword")
+	defer span.End()
+
 	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return "", err
@@ -15,6 +20,9 @@ func HashPassword(password string) (string, error) {
 }
 
 // checks if the provided password matches the stored hash
-func VerifyPassword(hashedPassword, providedPassword string) error {
+func VerifyPassword(ctx context.Context, hashedPassword, providedPassword string) error {
+	_, span := tracer.Start(ctx, "VerifyPassword")
+	defer span.End()
+
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(providedPassword))
 }
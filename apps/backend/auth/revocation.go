@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/models"
+)
+
+// revokeAccessTokens adds access tokens to the denylist so they stop working before they expire
+func (s *AuthService) revokeAccessTokens(ctx context.Context, refs []models.AccessTokenRef) error {
+	for _, ref := range refs {
+		if err := s.revoked.Revoke(ctx, ref.JTI, ref.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endSession revokes a token family along with every access token issued in it
+func (s *AuthService) endSession(ctx context.Context, familyID uuid.UUID) error {
+	if err := s.refreshTokenRepo.RevokeTokenFamily(ctx, familyID); err != nil {
+		return err
+	}
+	refs, err := s.refreshTokenRepo.FamilyAccessTokens(ctx, familyID)
+	if err != nil {
+		return err
+	}
+	return s.revokeAccessTokens(ctx, refs)
+}
+
+// endUserSessions revokes every session of the user along with their access tokens
+func (s *AuthService) endUserSessions(ctx context.Context, userID uuid.UUID) error {
+	if err := s.refreshTokenRepo.RevokeUserRefreshTokens(ctx, userID); err != nil {
+		return err
+	}
+	refs, err := s.refreshTokenRepo.UserAccessTokens(ctx, userID, uuid.Nil)
+	if err != nil {
+		return err
+	}
+	return s.revokeAccessTokens(ctx, refs)
+}
+
+// Logout ends the session behind a refresh token and revokes the access token presented with it,
+// returning whose session it was if that could be told. Either token may be empty or invalid,
+// whatever can be identified is revoked.
+func (s *AuthService) Logout(ctx context.Context, refreshTokenString, accessTokenString string) (uuid.UUID, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.Logout")
+	defer span.End()
+
+	userID, sessionID := uuid.Nil, uuid.Nil
+	if accessTokenString != "" {
+		if claims, err := s.ValidateToken(ctx, accessTokenString); err == nil {
+			if err := s.revoked.Revoke(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+				return uuid.Nil, err
+			}
+			userID, sessionID = claims.UserID(), claims.Session()
+		}
+	}
+	if refreshTokenString != "" {
+		token, err := s.refreshTokenRepo.GetRefreshToken(ctx, hashOpaqueToken(refreshTokenString))
+		if err == nil {
+			userID, sessionID = token.UserID, token.FamilyID
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, err
+		}
+	}
+	if sessionID == uuid.Nil {
+		return uuid.Nil, nil
+	}
+	return userID, s.endSession(ctx, sessionID)
+}
+
+// ChangePassword replaces the password of a signed in user after checking the current one,
+// and signs them out of every other session
+func (s *AuthService) ChangePassword(ctx context.Context, userID, currentSessionID uuid.UUID, currentPassword, newPassword string) error {
+	ctx, span := tracer.Start(ctx, "AuthService.ChangePassword")
+	defer span.End()
+
+	user, err := s.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	// A stolen session mustn't be a way around the login lockout for guessing the password
+	if err := s.checkLockout(user); err != nil {
+		return err
+	}
+	if err := VerifyPassword(ctx, user.PasswordHash, currentPassword); err != nil {
+		if err := s.recordReauthFailure(ctx, userID); err != nil {
+			return err
+		}
+		return ErrInvalidCredentials
+	}
+	hashedPassword, err := HashPassword(ctx, newPassword)
+	if err != nil {
+		return err
+	}
+	// The new password and the end of the other sessions happen together, so old refresh
+	// tokens can't outlive a password change that went through
+	var refs []models.AccessTokenRef
+	err = s.tx.WithTx(ctx, func(ctx context.Context, stores models.Stores) error {
+		if err := stores.Users.UpdatePassword(ctx, userID, hashedPassword); err != nil {
+			return err
+		}
+		if _, err := stores.RefreshTokens.RevokeOtherTokenFamilies(ctx, userID, currentSessionID); err != nil {
+			return err
+		}
+		var err error
+		refs, err = stores.RefreshTokens.UserAccessTokens(ctx, userID, currentSessionID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// The denylist isn't in the database transaction, so it's only written once that commits
+	return s.revokeAccessTokens(ctx, refs)
+}
+
+// RevokeUserSessions signs a user out everywhere, for admins responding to a compromised account
+func (s *AuthService) RevokeUserSessions(ctx context.Context, userID uuid.UUID) error {
+	ctx, span := tracer.Start(ctx, "AuthService.RevokeUserSessions")
+	defer span.End()
+
+	if _, err := s.userRepo.GetUserByID(ctx, userID); err != nil {
+		return err
+	}
+	return s.endUserSessions(ctx, userID)
+}
@@ -1,180 +1,393 @@
 package auth
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/mail"
 	"github.com/pjontop/placer/backend/models"
+	"github.com/pjontop/placer/backend/revocation"
+	"github.com/pjontop/placer/backend/webauthn"
+	"go.opentelemetry.io/otel"
 )
 
 var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
 	ErrInvalidToken       = errors.New("invalid token")
 	ErrExpiredToken       = errors.New("token has expired")
-	ErrEmailInUse         = errors.New("email already in use")
+	ErrEmailInUse         = models.ErrEmailInUse
+	ErrTokenReused        = errors.New("refresh token reuse detected")
+	ErrEmailNotVerified   = errors.New("email address not verified")
+	ErrTokenRevoked       = errors.New("token has been revoked")
 )
 
+// Config holds the settings for AuthService
+type Config struct {
+	JWTSecret      string
+	AccessTokenTTL time.Duration
+	// Issuer and Audience are stamped on access tokens and required when validating them,
+	// so tokens from one environment aren't accepted by another
+	Issuer   string
+	Audience string
+	// Leeway allows for clock skew between servers when checking exp, nbf and iat
+	Leeway time.Duration
+	// AppURL is the frontend origin that links in emails point at
+	AppURL string
+	// RequireVerifiedEmail makes login refuse users who haven't verified their email
+	RequireVerifiedEmail bool
+	VerificationTokenTTL time.Duration
+	PasswordResetTTL     time.Duration
+	// EmailCooldown and EmailMaxPerHour throttle verification and reset emails per account
+	EmailCooldown   time.Duration
+	EmailMaxPerHour int
+	// MFAIssuer is the account issuer shown in authenticator apps
+	MFAIssuer string
+	// MFAEncryptionKey encrypts TOTP secrets and keys the recovery code digests
+	MFAEncryptionKey string
+	MFAChallengeTTL  time.Duration
+	// LockoutThreshold is how many failed logins in a row lock an account, for LockoutBase
+	// at first and doubling with each further failure up to LockoutMax
+	LockoutThreshold int
+	LockoutBase      time.Duration
+	LockoutMax       time.Duration
+}
+
+// tracer traces AuthService methods and password hashing
+var tracer = otel.Tracer("github.com/pjontop/placer/backend/auth")
+
 // AuthService provides authentication functionality
 type AuthService struct {
-	userRepo         *models.UserRepository
-	refreshTokenRepo *models.RefreshTokenRepository
-	jwtSecret        []byte
-	accessTokenTTL   time.Duration
+	userRepo         models.UserStore
+	refreshTokenRepo models.RefreshTokenStore
+	userTokenRepo    models.UserTokenStore
+	mfaRepo          models.MFAStore
+	tx               models.Transactor
+	passkeys         *webauthn.Service
+	keys             *KeySet
+	revoked          revocation.Store
+	mailer           mail.Sender
+	jwtSecret        []byte // keys the HMAC on emailed and MFA tokens
+	secrets          *secretBox
+	cfg              Config
+	logger           *slog.Logger
 }
 
 // NewAuthService creates a new authentication service
-func NewAuthService(userRepo *models.UserRepository, refreshTokenRepo *models.RefreshTokenRepository, jwtSecret string, accessTokenTTL time.Duration) *AuthService {
+func NewAuthService(userRepo models.UserStore, refreshTokenRepo models.RefreshTokenStore, userTokenRepo models.UserTokenStore, mfaRepo models.MFAStore, tx models.Transactor, passkeys *webauthn.Service, keys *KeySet, revoked revocation.Store, mailer mail.Sender, cfg Config, logger *slog.Logger) (*AuthService, error) {
+	secrets, err := newSecretBox(cfg.MFAEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
 	return &AuthService{
 		userRepo:         userRepo,
 		refreshTokenRepo: refreshTokenRepo,
-		jwtSecret:        []byte(jwtSecret),
-		accessTokenTTL:   accessTokenTTL,
-	}
+		userTokenRepo:    userTokenRepo,
+		mfaRepo:          mfaRepo,
+		tx:               tx,
+		passkeys:         passkeys,
+		keys:             keys,
+		revoked:          revoked,
+		mailer:           mailer,
+		jwtSecret:        []byte(cfg.JWTSecret),
+		secrets:          secrets,
+		cfg:              cfg,
+		logger:           logger,
+	}, nil
+}
+
+// LoginResult is the outcome of a login: either a token pair, or an MFA challenge
+// when the user still has to present a second factor
+type LoginResult struct {
+	// UserID is who logged in, set for challenges too
+	UserID       uuid.UUID
+	AccessToken  string
+	RefreshToken string
+	MFAToken     string
+	// MFAMethods lists the second factors that can answer the challenge
+	MFAMethods []string
 }
 
 // Register creates a new user with the provided credentials
-func (s *AuthService) Register(email, name, password string) (*models.User, error) {
-	// Check if user already exists
-	_, err := s.userRepo.GetUserByEmail(email)
-	if err == nil {
-		return nil, ErrEmailInUse
-	}
-	// Only proceed if the error was "user not found"
-	if !errors.Is(err, sql.ErrNoRows) {
-		return nil, err
-	}
-	// Hash the password
-	hashedPassword, err := HashPassword(password)
+func (s *AuthService) Register(ctx context.Context, email, name, password string) (*models.User, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.Register")
+	defer span.End()
+
+	// Hash the password first, it's slow and shouldn't hold a transaction open
+	hashedPassword, err := HashPassword(ctx, password)
 	if err != nil {
 		return nil, err
 	}
-	// Create the user
-	user, err := s.userRepo.CreateUser(email, name, hashedPassword)
+	// Check and create together, so two signups for the same email can't both get through
+	var user *models.User
+	err = s.tx.WithTx(ctx, func(ctx context.Context, stores models.Stores) error {
+		// Check if user already exists
+		_, err := stores.Users.GetUserByEmail(ctx, email)
+		if err == nil {
+			return ErrEmailInUse
+		}
+		// Only proceed if the error was "user not found"
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// Create the user
+		user, err = stores.Users.CreateUser(ctx, email, name, hashedPassword)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return user, nil
-}
-
-// Login authenticates a user and returns an access token
-func (s *AuthService) Login(email, password string) (string, error) {
-	// Get the user from the database
-	user, err := s.userRepo.GetUserByEmail(email)
-	if err != nil {
-		return "", ErrInvalidCredentials
+	// The account exists either way, a failed email can be resent
+	if err := s.sendVerificationEmail(ctx, user); err != nil {
+		s.logger.Error("failed to send verification email", "user_id", user.ID, "err", err)
 	}
-	// Verify the password
-	if err := VerifyPassword(user.PasswordHash, password); err != nil {
-		return "", ErrInvalidCredentials
-	}
-	// Generate an access token
-	token, err := s.generateAccessToken(user)
-	if err != nil {
-		return "", err
-	}
-	return token, nil
+	return user, nil
 }
 
-// generateAccessToken creates a new JWT access token
-func (s *AuthService) generateAccessToken(user *models.User) (string, error) {
-	// Set the expiration time
-	expirationTime := time.Now().Add(s.accessTokenTTL)
+// generateAccessToken creates a new JWT access token for a session
+func (s *AuthService) generateAccessToken(user *models.User, sessionID uuid.UUID) (string, models.AccessTokenRef, error) {
+	now := time.Now()
 	// Create the JWT claims
-	claims := jwt.MapClaims{
-		"sub":   user.ID.String(),
-		"name":  user.Name,
-		"email": user.Email,
-		"exp":   expirationTime.Unix(),
-		"iat":   time.Now().Unix(),
-	}
-	// Create the token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	// Sign the token with our secret key
-	tokenString, err := token.SignedString(s.jwtSecret)
+	claims := &AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    s.cfg.Issuer,
+			Subject:   user.ID.String(),
+			Audience:  jwt.ClaimStrings{s.cfg.Audience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.cfg.AccessTokenTTL)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Name:      user.Name,
+		Email:     user.Email,
+		SessionID: sessionID.String(),
+		Role:      user.Role,
+	}
+	// Sign the token with the active key
+	tokenString, err := s.keys.sign(claims)
 	if err != nil {
-		return "", err
+		return "", models.AccessTokenRef{}, err
 	}
-	return tokenString, nil
+	return tokenString, models.AccessTokenRef{JTI: claims.ID, ExpiresAt: claims.ExpiresAt.Time}, nil
 }
 
 // ValidateToken verifies a JWT token and returns the claims
-func (s *AuthService) ValidateToken(tokenString string) (jwt.MapClaims, error) {
-	// Parse the token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, ErrInvalidToken
-		}
-		return s.jwtSecret, nil
-	})
+func (s *AuthService) ValidateToken(ctx context.Context, tokenString string) (*AccessClaims, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.ValidateToken")
+	defer span.End()
+
+	claims := &AccessClaims{}
+	// Parse the token, the key set picks the key by kid and checks the algorithm
+	token, err := jwt.ParseWithClaims(tokenString, claims, s.keys.keyFunc,
+		jwt.WithValidMethods(s.keys.validMethods()),
+		jwt.WithIssuer(s.cfg.Issuer),
+		jwt.WithAudience(s.cfg.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(s.cfg.Leeway),
+	)
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
 			return nil, ErrExpiredToken
 		}
 		return nil, ErrInvalidToken
 	}
-	// Extract and validate claims
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims, nil
+	if !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	// A valid signature isn't enough once the token has been revoked
+	revoked, err := s.revoked.IsRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
 	}
-	return nil, ErrInvalidToken
+	return claims, nil
 }
 
-// LoginWithRefresh authenticates a user and returns both access and refresh tokens
-func (s *AuthService) LoginWithRefresh(email, password string, refreshTokenTTL time.Duration) (accessToken string, refreshToken string, err error) {
+// JWKS returns the public keys access tokens can be verified with
+func (s *AuthService) JWKS() JWKS {
+	return s.keys.JWKS()
+}
+
+// LoginWithRefresh authenticates a user and returns both access and refresh tokens,
+// or an MFA challenge if the user has a second factor enabled
+func (s *AuthService) LoginWithRefresh(ctx context.Context, email, password string, refreshTokenTTL time.Duration, client models.ClientInfo) (*LoginResult, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.LoginWithRefresh")
+	defer span.End()
+
 	// Get the user from the database
-	user, err := s.userRepo.GetUserByEmail(email)
+	user, err := s.userRepo.GetUserByEmail(ctx, email)
 	if err != nil {
-		return "", "", ErrInvalidCredentials
+		return nil, ErrInvalidCredentials
+	}
+	// Refuse locked accounts before spending any time on bcrypt
+	if err := s.checkLockout(user); err != nil {
+		if err := s.recordFailedAttempt(ctx, user.ID, models.LoginMethodPassword, client); err != nil {
+			return nil, err
+		}
+		return nil, err
 	}
 	// Verify the password
-	if err := VerifyPassword(user.PasswordHash, password); err != nil {
-		return "", "", ErrInvalidCredentials
+	if err := VerifyPassword(ctx, user.PasswordHash, password); err != nil {
+		if err := s.recordLoginFailure(ctx, user, client); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	}
+	// Only checked after the password so it doesn't reveal which emails are registered
+	if s.cfg.RequireVerifiedEmail && user.EmailVerifiedAt == nil {
+		return nil, ErrEmailNotVerified
 	}
+	// Hold back the tokens until the second factor is checked
+	methods, err := s.mfaMethods(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(methods) > 0 {
+		mfaToken, err := s.issueMFAChallenge(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{UserID: user.ID, MFAToken: mfaToken, MFAMethods: methods}, nil
+	}
+	return s.startSession(ctx, user, models.LoginMethodPassword, refreshTokenTTL, client)
+}
+
+// startSession issues an access token and a refresh token in a new token family, and records
+// the login made by the given method. What a login writes is done in one transaction, so it
+// happens completely or not at all.
+func (s *AuthService) startSession(ctx context.Context, user *models.User, method string, refreshTokenTTL time.Duration, client models.ClientInfo) (*LoginResult, error) {
+	// Start a new token family for this login
+	sessionID := uuid.New()
 	// Generate an access token
-	accessToken, err = s.generateAccessToken(user)
+	accessToken, accessRef, err := s.generateAccessToken(user, sessionID)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
-	// Create a refresh token
-	token, err := s.refreshTokenRepo.CreateRefreshToken(user.ID, refreshTokenTTL)
+	var refreshToken string
+	err = s.tx.WithTx(ctx, func(ctx context.Context, stores models.Stores) error {
+		// Failures only stop counting once every factor has been passed, a right password
+		// followed by a wrong code still counts towards the lockout
+		if user.FailedLoginCount > 0 {
+			if err := stores.Users.ResetFailedLogins(ctx, user.ID); err != nil {
+				return err
+			}
+		}
+		if err := stores.Users.UpdateLastLogin(ctx, user.ID); err != nil {
+			return err
+		}
+		if err := stores.LoginHistory.RecordLogin(ctx, user.ID, method, models.LoginOutcomeSuccess, client); err != nil {
+			return err
+		}
+		refreshToken, err = issueRefreshToken(ctx, stores.RefreshTokens, user.ID, sessionID, refreshTokenTTL, client, accessRef)
+		return err
+	})
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
-	return accessToken, token.Token, nil
+	return &LoginResult{UserID: user.ID, AccessToken: accessToken, RefreshToken: refreshToken}, nil
 }
 
-// RefreshAccessToken creates a new access token using a refresh token
-func (s *AuthService) RefreshAccessToken(refreshTokenString string) (string, error) {
+// RefreshAccessToken rotates a refresh token, returning a new access token and a new refresh token.
+// The presented token is revoked; presenting a revoked token again revokes its whole family.
+func (s *AuthService) RefreshAccessToken(ctx context.Context, refreshTokenString string, refreshTokenTTL time.Duration, client models.ClientInfo) (*LoginResult, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.RefreshAccessToken")
+	defer span.End()
+
 	// Retrieve the refresh token
-	token, err := s.refreshTokenRepo.GetRefreshToken(refreshTokenString)
+	token, err := s.refreshTokenRepo.GetRefreshToken(ctx, hashOpaqueToken(refreshTokenString))
 	if err != nil {
-		return "", ErrInvalidToken
+		return nil, ErrInvalidToken
 	}
-	// Check if the token is valid
+	// A revoked token coming back means it was copied, so kill the family
 	if token.Revoked {
-		return "", ErrInvalidToken
+		return nil, s.handleTokenReuse(ctx, token)
 	}
 	// Check if the token has expired
 	if time.Now().After(token.ExpiresAt) {
-		return "", ErrExpiredToken
+		return nil, ErrExpiredToken
 	}
-	// Get the user
-	user, err := s.userRepo.GetUserByID(token.UserID)
+	// Swap the token for its replacement in one go, a failure part way must not leave the
+	// session with no live token
+	var result *LoginResult
+	consumed := false
+	err = s.tx.WithTx(ctx, func(ctx context.Context, stores models.Stores) error {
+		// Revoke the presented token, losing a race here is also reuse
+		var err error
+		consumed, err = stores.RefreshTokens.ConsumeRefreshToken(ctx, token.ID)
+		if err != nil || !consumed {
+			return err
+		}
+		// Get the user
+		user, err := stores.Users.GetUserByID(ctx, token.UserID)
+		if err != nil {
+			return err
+		}
+		// A refresh counts as the user being active, it isn't another entry in their history
+		if err := stores.Users.UpdateLastLogin(ctx, user.ID); err != nil {
+			return err
+		}
+		// Generate a new access token
+		accessToken, accessRef, err := s.generateAccessToken(user, token.FamilyID)
+		if err != nil {
+			return err
+		}
+		// Issue the replacement in the same family
+		refreshToken, err := issueRefreshToken(ctx, stores.RefreshTokens, user.ID, token.FamilyID, refreshTokenTTL, client, accessRef)
+		if err != nil {
+			return err
+		}
+		result = &LoginResult{UserID: user.ID, AccessToken: accessToken, RefreshToken: refreshToken}
+		return nil
+	})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if !consumed {
+		return nil, s.handleTokenReuse(ctx, token)
 	}
-	// Generate a new access token
-	accessToken, err := s.generateAccessToken(user)
+	return result, nil
+}
+
+// issueRefreshToken generates a random refresh token and stores only its digest
+func issueRefreshToken(ctx context.Context, refreshTokens models.RefreshTokenStore, userID, familyID uuid.UUID, ttl time.Duration, client models.ClientInfo, accessToken models.AccessTokenRef) (string, error) {
+	token, tokenHash, err := generateOpaqueToken()
 	if err != nil {
 		return "", err
 	}
-	return accessToken, nil
+	if _, err := refreshTokens.CreateRefreshToken(ctx, userID, familyID, tokenHash, ttl, client, accessToken); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// handleTokenReuse revokes every token in the family of a reused refresh token
+func (s *AuthService) handleTokenReuse(ctx context.Context, token *models.RefreshToken) error {
+	s.logger.Warn("refresh token reuse detected, revoking family", "user_id", token.UserID, "family_id", token.FamilyID)
+	if err := s.endSession(ctx, token.FamilyID); err != nil {
+		return err
+	}
+	return &TokenReuseError{UserID: token.UserID, FamilyID: token.FamilyID}
+}
+
+// TokenReuseError says whose session was revoked because a refresh token was reused,
+// it matches ErrTokenReused
+type TokenReuseError struct {
+	UserID   uuid.UUID
+	FamilyID uuid.UUID
+}
+
+func (e *TokenReuseError) Error() string {
+	return fmt.Sprintf("%s for user %s", ErrTokenReused, e.UserID)
 }
 
-// RevokeRefreshToken revokes a refresh token string
-func (s *AuthService) RevokeRefreshToken(refreshTokenString string) error {
-	return s.refreshTokenRepo.RevokeRefreshToken(refreshTokenString)
+func (e *TokenReuseError) Unwrap() error {
+	return ErrTokenReused
 }
@@ -0,0 +1,702 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/auth/authtest"
+	"github.com/pjontop/placer/backend/models"
+)
+
+const email = "ada@example.com"
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		email    string
+		wantErr  error
+	}{
+		{name: "new email", email: email},
+		{name: "taken email", existing: email, email: email, wantErr: auth.ErrEmailInUse},
+		{name: "other email taken", existing: "grace@example.com", email: email},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := authtest.New(t)
+			if tt.existing != "" {
+				env.CreateUser(t, tt.existing)
+			}
+
+			user, err := env.Service.Register(context.Background(), tt.email, "Ada", authtest.Password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Register() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if user.PasswordHash == authtest.Password {
+				t.Error("password stored in plain text")
+			}
+			if user.Role != models.RoleUser {
+				t.Errorf("role = %q, want %q", user.Role, models.RoleUser)
+			}
+			if got := len(env.Mailbox.Messages(tt.email)); got != 1 {
+				t.Errorf("sent %d verification emails, want 1", got)
+			}
+		})
+	}
+}
+
+func TestRegisterConcurrently(t *testing.T) {
+	env := authtest.New(t)
+
+	const attempts = 8
+	errs := make(chan error, attempts)
+	var wg sync.WaitGroup
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := env.Service.Register(context.Background(), email, "Ada", authtest.Password)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	registered := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			registered++
+		case !errors.Is(err, auth.ErrEmailInUse):
+			t.Errorf("Register() error = %v, want nil or %v", err, auth.ErrEmailInUse)
+		}
+	}
+	if registered != 1 {
+		t.Errorf("%d of %d signups for the same email succeeded, want 1", registered, attempts)
+	}
+}
+
+func TestLoginWithRefresh(t *testing.T) {
+	tests := []struct {
+		name          string
+		requireVerify bool
+		verified      bool
+		email         string
+		password      string
+		wantErr       error
+	}{
+		{name: "valid credentials", verified: true, email: email, password: authtest.Password},
+		{name: "wrong password", verified: true, email: email, password: "wrong", wantErr: auth.ErrInvalidCredentials},
+		{name: "unknown email", verified: true, email: "nobody@example.com", password: authtest.Password, wantErr: auth.ErrInvalidCredentials},
+		{name: "unverified email allowed", email: email, password: authtest.Password},
+		{name: "unverified email required", requireVerify: true, email: email, password: authtest.Password, wantErr: auth.ErrEmailNotVerified},
+		{name: "unverified email, wrong password", requireVerify: true, email: email, password: "wrong", wantErr: auth.ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := authtest.New(t, func(cfg *auth.Config) { cfg.RequireVerifiedEmail = tt.requireVerify })
+			ctx := context.Background()
+			user, err := env.Service.Register(ctx, email, "Ada", authtest.Password)
+			if err != nil {
+				t.Fatalf("Register() error = %v", err)
+			}
+			if tt.verified {
+				env.Users.MarkEmailVerified(ctx, user.ID)
+			}
+
+			result, err := env.Service.LoginWithRefresh(ctx, tt.email, tt.password, time.Hour, models.ClientInfo{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("LoginWithRefresh() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if result.AccessToken == "" || result.RefreshToken == "" {
+				t.Fatalf("LoginWithRefresh() = %+v, want a token pair", result)
+			}
+			claims, err := env.Service.ValidateToken(ctx, result.AccessToken)
+			if err != nil {
+				t.Fatalf("ValidateToken() error = %v", err)
+			}
+			if claims.UserID() != user.ID {
+				t.Errorf("token subject = %s, want %s", claims.UserID(), user.ID)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	env := authtest.New(t)
+	env.CreateUser(t, email)
+	ctx := context.Background()
+
+	for i := 0; i < env.Config.LockoutThreshold; i++ {
+		_, err := env.Service.LoginWithRefresh(ctx, email, "wrong", time.Hour, models.ClientInfo{})
+		if !errors.Is(err, auth.ErrInvalidCredentials) {
+			t.Fatalf("attempt %d: error = %v, want %v", i+1, err, auth.ErrInvalidCredentials)
+		}
+	}
+
+	// Locked now, even the right password is refused
+	_, err := env.Service.LoginWithRefresh(ctx, email, authtest.Password, time.Hour, models.ClientInfo{})
+	var lockout *auth.LockoutError
+	if !errors.As(err, &lockout) {
+		t.Fatalf("error = %v, want a LockoutError", err)
+	}
+	if retry := lockout.RetryAfter(); retry <= 0 || retry > env.Config.LockoutBase {
+		t.Errorf("RetryAfter() = %s, want up to %s", retry, env.Config.LockoutBase)
+	}
+
+	// Once the lockout has passed a good login clears the count
+	user, _ := env.Users.GetUserByEmail(ctx, email)
+	env.Users.LockUser(ctx, user.ID, time.Now().Add(-time.Second))
+	env.Login(t, email)
+	user, _ = env.Users.GetUserByEmail(ctx, email)
+	if user.FailedLoginCount != 0 || user.LockedUntil != nil {
+		t.Errorf("after login failed count = %d, locked until = %v, want both cleared", user.FailedLoginCount, user.LockedUntil)
+	}
+}
+
+func TestLoginHistory(t *testing.T) {
+	env := authtest.New(t)
+	user := env.CreateUser(t, email)
+	ctx := context.Background()
+	client := models.ClientInfo{UserAgent: "Firefox", IPAddress: "192.0.2.1"}
+
+	if _, err := env.Service.LoginWithRefresh(ctx, email, "wrong", time.Hour, client); !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Fatalf("wrong password: error = %v, want %v", err, auth.ErrInvalidCredentials)
+	}
+	if got, _ := env.Users.GetUserByID(ctx, user.ID); got.LastLogin != nil {
+		t.Errorf("after a failed login LastLogin = %v, want nil", got.LastLogin)
+	}
+	login, err := env.Service.LoginWithRefresh(ctx, email, authtest.Password, time.Hour, client)
+	if err != nil {
+		t.Fatalf("LoginWithRefresh() error = %v", err)
+	}
+	loggedIn, _ := env.Users.GetUserByID(ctx, user.ID)
+	if loggedIn.LastLogin == nil {
+		t.Fatal("after a login LastLogin = nil, want it set")
+	}
+
+	records, err := env.LoginHistory.ListLogins(ctx, user.ID, 10)
+	if err != nil {
+		t.Fatalf("ListLogins() error = %v", err)
+	}
+	want := []string{models.LoginOutcomeSuccess, models.LoginOutcomeFailure}
+	if len(records) != len(want) {
+		t.Fatalf("ListLogins() returned %d records, want %d: %+v", len(records), len(want), records)
+	}
+	for i, record := range records {
+		if record.Outcome != want[i] || record.Method != models.LoginMethodPassword || record.IPAddress != client.IPAddress || record.UserAgent != client.UserAgent {
+			t.Errorf("record %d = %+v, want a password %s from %s", i, record, want[i], client.IPAddress)
+		}
+	}
+
+	// Refreshing moves last_login on without adding to the history
+	time.Sleep(10 * time.Millisecond)
+	if _, err := env.Service.RefreshAccessToken(ctx, login.RefreshToken, time.Hour, client); err != nil {
+		t.Fatalf("RefreshAccessToken() error = %v", err)
+	}
+	if got, _ := env.Users.GetUserByID(ctx, user.ID); got.LastLogin == nil || !got.LastLogin.After(*loggedIn.LastLogin) {
+		t.Errorf("after a refresh LastLogin = %v, want later than %v", got.LastLogin, loggedIn.LastLogin)
+	}
+	if records, _ := env.LoginHistory.ListLogins(ctx, user.ID, 10); len(records) != len(want) {
+		t.Errorf("after a refresh ListLogins() returned %d records, want %d", len(records), len(want))
+	}
+}
+
+func TestRefreshAccessToken(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("rotates the refresh token", func(t *testing.T) {
+		env := authtest.New(t)
+		env.CreateUser(t, email)
+		login := env.Login(t, email)
+
+		refreshed, err := env.Service.RefreshAccessToken(ctx, login.RefreshToken, time.Hour, models.ClientInfo{})
+		if err != nil {
+			t.Fatalf("RefreshAccessToken() error = %v", err)
+		}
+		if refreshed.RefreshToken == login.RefreshToken {
+			t.Error("refresh token was not rotated")
+		}
+		if _, err := env.Service.ValidateToken(ctx, refreshed.AccessToken); err != nil {
+			t.Errorf("new access token: ValidateToken() error = %v", err)
+		}
+	})
+
+	t.Run("reuse revokes the session", func(t *testing.T) {
+		env := authtest.New(t)
+		env.CreateUser(t, email)
+		login := env.Login(t, email)
+		refreshed, err := env.Service.RefreshAccessToken(ctx, login.RefreshToken, time.Hour, models.ClientInfo{})
+		if err != nil {
+			t.Fatalf("RefreshAccessToken() error = %v", err)
+		}
+
+		_, err = env.Service.RefreshAccessToken(ctx, login.RefreshToken, time.Hour, models.ClientInfo{})
+		var reuse *auth.TokenReuseError
+		if !errors.As(err, &reuse) || reuse.UserID != login.UserID {
+			t.Fatalf("reusing a token: error = %v, want a TokenReuseError for %s", err, login.UserID)
+		}
+		if _, err := env.Service.RefreshAccessToken(ctx, refreshed.RefreshToken, time.Hour, models.ClientInfo{}); !errors.Is(err, auth.ErrTokenReused) {
+			t.Errorf("latest token after reuse: error = %v, want %v", err, auth.ErrTokenReused)
+		}
+		if _, err := env.Service.ValidateToken(ctx, refreshed.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+			t.Errorf("access token after reuse: error = %v, want %v", err, auth.ErrTokenRevoked)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		token   func(login *auth.LoginResult) string
+		wantErr error
+	}{
+		{name: "unknown token", ttl: time.Hour, token: func(*auth.LoginResult) string { return "not-a-token" }, wantErr: auth.ErrInvalidToken},
+		{name: "empty token", ttl: time.Hour, token: func(*auth.LoginResult) string { return "" }, wantErr: auth.ErrInvalidToken},
+		{name: "expired token", ttl: -time.Second, token: func(login *auth.LoginResult) string { return login.RefreshToken }, wantErr: auth.ErrExpiredToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := authtest.New(t)
+			env.CreateUser(t, email)
+			login, err := env.Service.LoginWithRefresh(ctx, email, authtest.Password, tt.ttl, models.ClientInfo{})
+			if err != nil {
+				t.Fatalf("LoginWithRefresh() error = %v", err)
+			}
+
+			_, err = env.Service.RefreshAccessToken(ctx, tt.token(login), time.Hour, models.ClientInfo{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("RefreshAccessToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	ctx := context.Background()
+	env := authtest.New(t)
+	env.CreateUser(t, email)
+
+	otherAudience := authtest.New(t, func(cfg *auth.Config) { cfg.Audience = "https://other.example.com" })
+	otherAudience.CreateUser(t, email)
+
+	otherSecret := authtest.New(t, func(cfg *auth.Config) { cfg.JWTSecret = "another-secret" })
+	otherSecret.CreateUser(t, email)
+
+	expired := authtest.New(t, func(cfg *auth.Config) { cfg.AccessTokenTTL = -time.Minute })
+	expired.CreateUser(t, email)
+
+	loggedOut := env.Login(t, email)
+	if _, err := env.Service.Logout(ctx, loggedOut.RefreshToken, loggedOut.AccessToken); err != nil {
+		t.Fatalf("Logout() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "valid", token: env.Login(t, email).AccessToken},
+		{name: "garbage", token: "not.a.jwt", wantErr: auth.ErrInvalidToken},
+		{name: "other audience", token: otherAudience.Login(t, email).AccessToken, wantErr: auth.ErrInvalidToken},
+		{name: "other secret", token: otherSecret.Login(t, email).AccessToken, wantErr: auth.ErrInvalidToken},
+		{name: "expired", token: expired.Login(t, email).AccessToken, wantErr: auth.ErrExpiredToken},
+		{name: "logged out", token: loggedOut.AccessToken, wantErr: auth.ErrTokenRevoked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := env.Service.ValidateToken(ctx, tt.token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ValidateToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	ctx := context.Background()
+	env := authtest.New(t)
+	user := env.CreateUser(t, email)
+	login := env.Login(t, email)
+
+	userID, err := env.Service.Logout(ctx, login.RefreshToken, login.AccessToken)
+	if err != nil {
+		t.Fatalf("Logout() error = %v", err)
+	}
+	if userID != user.ID {
+		t.Errorf("Logout() user = %s, want %s", userID, user.ID)
+	}
+	if _, err := env.Service.RefreshAccessToken(ctx, login.RefreshToken, time.Hour, models.ClientInfo{}); err == nil {
+		t.Error("refresh token still works after logout")
+	}
+	if _, err := env.Service.Logout(ctx, "", ""); err != nil {
+		t.Errorf("Logout() with no tokens error = %v, want nil", err)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	ctx := context.Background()
+	env := authtest.New(t)
+	user, err := env.Service.Register(ctx, email, "Ada", authtest.Password)
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	token := env.Mailbox.Token(t, email)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "bad signature", token: token + "x", wantErr: auth.ErrInvalidToken},
+		{name: "emailed token", token: token},
+		{name: "used token", token: token, wantErr: auth.ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := env.Service.VerifyEmail(ctx, tt.token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyEmail() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	verified, _ := env.Users.GetUserByID(ctx, user.ID)
+	if verified.EmailVerifiedAt == nil {
+		t.Error("email not marked verified")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	ctx := context.Background()
+	env := authtest.New(t)
+	user := env.CreateUser(t, email)
+	login := env.Login(t, email)
+
+	if err := env.Service.RequestPasswordReset(ctx, "nobody@example.com"); err != nil {
+		t.Fatalf("RequestPasswordReset() for an unknown email error = %v, want nil", err)
+	}
+	if err := env.Service.RequestPasswordReset(ctx, email); err != nil {
+		t.Fatalf("RequestPasswordReset() error = %v", err)
+	}
+	token := env.Mailbox.Token(t, email)
+
+	if _, err := env.Service.ResetPassword(ctx, "bogus", "new password"); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("ResetPassword() with a bogus token error = %v, want %v", err, auth.ErrInvalidToken)
+	}
+	// bcrypt refuses it, without using up the token, and the failure is still tied to the user
+	userID, err := env.Service.ResetPassword(ctx, token, strings.Repeat("x", 73))
+	if err == nil || userID != user.ID {
+		t.Errorf("ResetPassword() with an overlong password = %s, %v, want %s and an error", userID, err, user.ID)
+	}
+	if _, err := env.Service.ResetPassword(ctx, token, "new password"); err != nil {
+		t.Fatalf("ResetPassword() error = %v", err)
+	}
+	if _, err := env.Service.ResetPassword(ctx, token, "another password"); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("ResetPassword() with a used token error = %v, want %v", err, auth.ErrInvalidToken)
+	}
+
+	if _, err := env.Service.LoginWithRefresh(ctx, email, authtest.Password, time.Hour, models.ClientInfo{}); !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Errorf("old password: error = %v, want %v", err, auth.ErrInvalidCredentials)
+	}
+	if _, err := env.Service.LoginWithRefresh(ctx, email, "new password", time.Hour, models.ClientInfo{}); err != nil {
+		t.Errorf("new password: error = %v", err)
+	}
+	if _, err := env.Service.ValidateToken(ctx, login.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("access token from before the reset: error = %v, want %v", err, auth.ErrTokenRevoked)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	ctx := context.Background()
+	env := authtest.New(t)
+	user := env.CreateUser(t, email)
+	current := env.Login(t, email)
+	other := env.Login(t, email)
+	currentSession := sessionOf(t, env, current)
+
+	err := env.Service.ChangePassword(ctx, user.ID, currentSession, "wrong", "new password")
+	if !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Fatalf("ChangePassword() with the wrong password error = %v, want %v", err, auth.ErrInvalidCredentials)
+	}
+	got, _ := env.Users.GetUserByID(ctx, user.ID)
+	if got.FailedLoginCount != 1 {
+		t.Errorf("failed count after a wrong current password = %d, want 1", got.FailedLoginCount)
+	}
+	if err := env.Service.ChangePassword(ctx, user.ID, currentSession, authtest.Password, "new password"); err != nil {
+		t.Fatalf("ChangePassword() error = %v", err)
+	}
+
+	if _, err := env.Service.ValidateToken(ctx, current.AccessToken); err != nil {
+		t.Errorf("current session: ValidateToken() error = %v, want it kept", err)
+	}
+	if _, err := env.Service.ValidateToken(ctx, other.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("other session: ValidateToken() error = %v, want %v", err, auth.ErrTokenRevoked)
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	ctx := context.Background()
+	env := authtest.New(t)
+	user := env.CreateUser(t, email)
+	session := sessionOf(t, env, env.Login(t, email))
+
+	for i := 0; i < env.Config.LockoutThreshold; i++ {
+		if err := env.Service.ChangePassword(ctx, user.ID, session, "wrong", "new password"); !errors.Is(err, auth.ErrInvalidCredentials) {
+			t.Fatalf("attempt %d: ChangePassword() error = %v, want %v", i+1, err, auth.ErrInvalidCredentials)
+		}
+	}
+	// Locked now, so even the right password is refused
+	if err := env.Service.ChangePassword(ctx, user.ID, session, authtest.Password, "new password"); !errors.Is(err, auth.ErrAccountLocked) {
+		t.Errorf("ChangePassword() while locked error = %v, want %v", err, auth.ErrAccountLocked)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ctx := context.Background()
+	env := authtest.New(t)
+	user := env.CreateUser(t, email)
+	first := env.Login(t, email)
+	second := env.Login(t, email)
+	third := env.Login(t, email)
+
+	sessions, err := env.Service.ListSessions(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("ListSessions() error = %v", err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("ListSessions() returned %d sessions, want 3", len(sessions))
+	}
+
+	tests := []struct {
+		name    string
+		userID  uuid.UUID
+		session uuid.UUID
+		wantErr error
+	}{
+		{name: "own session", userID: user.ID, session: sessionOf(t, env, first)},
+		{name: "already revoked", userID: user.ID, session: sessionOf(t, env, first), wantErr: auth.ErrSessionNotFound},
+		{name: "someone else's session", userID: uuid.New(), session: sessionOf(t, env, second), wantErr: auth.ErrSessionNotFound},
+		{name: "unknown session", userID: user.ID, session: uuid.New(), wantErr: auth.ErrSessionNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := env.Service.RevokeSession(ctx, tt.userID, tt.session); !errors.Is(err, tt.wantErr) {
+				t.Errorf("RevokeSession() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := env.Service.ValidateToken(ctx, first.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("revoked session: ValidateToken() error = %v, want %v", err, auth.ErrTokenRevoked)
+	}
+
+	count, err := env.Service.RevokeOtherSessions(ctx, user.ID, sessionOf(t, env, third))
+	if err != nil {
+		t.Fatalf("RevokeOtherSessions() error = %v", err)
+	}
+	if count != 1 {
+		t.Errorf("RevokeOtherSessions() ended %d sessions, want 1", count)
+	}
+
+	if err := env.Service.RevokeUserSessions(ctx, user.ID); err != nil {
+		t.Fatalf("RevokeUserSessions() error = %v", err)
+	}
+	if sessions, _ := env.Service.ListSessions(ctx, user.ID); len(sessions) != 0 {
+		t.Errorf("after RevokeUserSessions() %d sessions remain, want 0", len(sessions))
+	}
+}
+
+func TestMFA(t *testing.T) {
+	ctx := context.Background()
+	env := authtest.New(t)
+	user := env.CreateUser(t, email)
+	secret, recoveryCodes := env.EnableTOTP(t, email)
+
+	if _, err := env.Service.EnrollTOTP(ctx, user.ID); !errors.Is(err, auth.ErrMFAAlreadyEnabled) {
+		t.Errorf("EnrollTOTP() again error = %v, want %v", err, auth.ErrMFAAlreadyEnabled)
+	}
+	status, err := env.Service.MFAStatus(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("MFAStatus() error = %v", err)
+	}
+	if !status.TOTPEnabled || status.RecoveryCodesRemaining != len(recoveryCodes) {
+		t.Errorf("MFAStatus() = %+v, want TOTP enabled with %d recovery codes", status, len(recoveryCodes))
+	}
+
+	challenge := func(t *testing.T) string {
+		t.Helper()
+		result, err := env.Service.LoginWithRefresh(ctx, email, authtest.Password, time.Hour, models.ClientInfo{})
+		if err != nil {
+			t.Fatalf("LoginWithRefresh() error = %v", err)
+		}
+		if result.MFAToken == "" || result.AccessToken != "" {
+			t.Fatalf("LoginWithRefresh() = %+v, want only an MFA challenge", result)
+		}
+		return result.MFAToken
+	}
+
+	// The confirming code used the current step, so the next one is the first that can log in
+	nextCode := authtest.TOTPCode(t, secret, time.Now().Add(30*time.Second))
+	tests := []struct {
+		name    string
+		token   func(t *testing.T) string
+		code    string
+		wantErr error
+	}{
+		{name: "wrong code", token: challenge, code: "000000", wantErr: auth.ErrInvalidMFACode},
+		{name: "bogus challenge", token: func(*testing.T) string { return "bogus" }, code: nextCode, wantErr: auth.ErrInvalidToken},
+		{name: "totp code", token: challenge, code: nextCode},
+		{name: "replayed totp code", token: challenge, code: nextCode, wantErr: auth.ErrInvalidMFACode},
+		{name: "recovery code", token: challenge, code: recoveryCodes[0]},
+		{name: "used recovery code", token: challenge, code: recoveryCodes[0], wantErr: auth.ErrInvalidMFACode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := env.Service.VerifyMFA(ctx, tt.token(t), tt.code, time.Hour, models.ClientInfo{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("VerifyMFA() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && result.AccessToken == "" {
+				t.Errorf("VerifyMFA() = %+v, want tokens", result)
+			}
+		})
+	}
+
+	if err := env.Service.DisableTOTP(ctx, user.ID, "000000"); !errors.Is(err, auth.ErrInvalidMFACode) {
+		t.Errorf("DisableTOTP() with a wrong code error = %v, want %v", err, auth.ErrInvalidMFACode)
+	}
+	if err := env.Service.DisableTOTP(ctx, user.ID, recoveryCodes[1]); err != nil {
+		t.Fatalf("DisableTOTP() error = %v", err)
+	}
+	if err := env.Service.DisableTOTP(ctx, user.ID, recoveryCodes[2]); !errors.Is(err, auth.ErrMFANotEnabled) {
+		t.Errorf("DisableTOTP() again error = %v, want %v", err, auth.ErrMFANotEnabled)
+	}
+	env.Login(t, email)
+}
+
+func TestMFAMethods(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		totp    bool
+		passkey *models.WebAuthnCredential
+		want    []string
+	}{
+		{name: "none"},
+		{name: "totp", totp: true, want: []string{"totp", "recovery_code"}},
+		{name: "passkey", passkey: &models.WebAuthnCredential{ID: []byte("key")}, want: []string{"passkey"}},
+		{name: "cloned passkey", passkey: &models.WebAuthnCredential{ID: []byte("key"), CloneWarning: true}},
+		{name: "both", totp: true, passkey: &models.WebAuthnCredential{ID: []byte("key")}, want: []string{"totp", "recovery_code", "passkey"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := authtest.New(t)
+			user := env.CreateUser(t, email)
+			if tt.totp {
+				env.EnableTOTP(t, email)
+			}
+			if tt.passkey != nil {
+				tt.passkey.UserID = user.ID
+				if err := env.WebAuthn.CreateCredential(ctx, tt.passkey); err != nil {
+					t.Fatalf("CreateCredential() error = %v", err)
+				}
+			}
+
+			result, err := env.Service.LoginWithRefresh(ctx, email, authtest.Password, time.Hour, models.ClientInfo{})
+			if err != nil {
+				t.Fatalf("LoginWithRefresh() error = %v", err)
+			}
+			if !slices.Equal(result.MFAMethods, tt.want) {
+				t.Errorf("MFAMethods = %v, want %v", result.MFAMethods, tt.want)
+			}
+			// Any second factor holds back the tokens
+			if (result.MFAToken != "") != (len(tt.want) > 0) || (result.AccessToken != "") != (len(tt.want) == 0) {
+				t.Errorf("LoginWithRefresh() = %+v, want a challenge only with a second factor", result)
+			}
+		})
+	}
+}
+
+func TestMFALockout(t *testing.T) {
+	ctx := context.Background()
+	env := authtest.New(t)
+	user := env.CreateUser(t, email)
+	secret, recoveryCodes := env.EnableTOTP(t, email)
+	outstanding, err := env.Service.LoginWithRefresh(ctx, email, authtest.Password, time.Hour, models.ClientInfo{})
+	if err != nil {
+		t.Fatalf("LoginWithRefresh() error = %v", err)
+	}
+
+	// Each wrong code counts, even with a fresh challenge from the right password every time
+	var mfaToken string
+	for i := 0; i < env.Config.LockoutThreshold; i++ {
+		result, err := env.Service.LoginWithRefresh(ctx, email, authtest.Password, time.Hour, models.ClientInfo{})
+		if err != nil {
+			t.Fatalf("attempt %d: LoginWithRefresh() error = %v", i+1, err)
+		}
+		mfaToken = result.MFAToken
+		if _, err := env.Service.VerifyMFA(ctx, mfaToken, "000000", time.Hour, models.ClientInfo{}); !errors.Is(err, auth.ErrInvalidMFACode) {
+			t.Fatalf("attempt %d: VerifyMFA() error = %v, want %v", i+1, err, auth.ErrInvalidMFACode)
+		}
+	}
+
+	got, _ := env.Users.GetUserByID(ctx, user.ID)
+	if got.FailedLoginCount != env.Config.LockoutThreshold || got.LockedUntil == nil {
+		t.Fatalf("failed count = %d, locked until = %v, want %d and locked", got.FailedLoginCount, got.LockedUntil, env.Config.LockoutThreshold)
+	}
+	if _, err := env.Service.LoginWithRefresh(ctx, email, authtest.Password, time.Hour, models.ClientInfo{}); !errors.Is(err, auth.ErrAccountLocked) {
+		t.Errorf("LoginWithRefresh() while locked error = %v, want %v", err, auth.ErrAccountLocked)
+	}
+	// The lockout burned the challenge that caused it
+	if _, err := env.Service.VerifyMFA(ctx, mfaToken, "000000", time.Hour, models.ClientInfo{}); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("VerifyMFA() on the last challenge error = %v, want %v", err, auth.ErrInvalidToken)
+	}
+	// and a challenge from before the lockout can't get around it, even with the right code
+	nextCode := authtest.TOTPCode(t, secret, time.Now().Add(30*time.Second))
+	if _, err := env.Service.VerifyMFA(ctx, outstanding.MFAToken, nextCode, time.Hour, models.ClientInfo{}); !errors.Is(err, auth.ErrAccountLocked) {
+		t.Errorf("VerifyMFA() on an earlier challenge error = %v, want %v", err, auth.ErrAccountLocked)
+	}
+	if err := env.Service.DisableTOTP(ctx, user.ID, recoveryCodes[0]); !errors.Is(err, auth.ErrAccountLocked) {
+		t.Errorf("DisableTOTP() while locked error = %v, want %v", err, auth.ErrAccountLocked)
+	}
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	ctx := context.Background()
+	env := authtest.New(t)
+	user := env.CreateUser(t, email)
+	env.EnableTOTP(t, email)
+
+	// A signed in session guessing codes to turn MFA off counts towards the lockout too
+	for i := 0; i < env.Config.LockoutThreshold; i++ {
+		if _, err := env.Service.RegenerateRecoveryCodes(ctx, user.ID, "000000"); !errors.Is(err, auth.ErrInvalidMFACode) {
+			t.Fatalf("attempt %d: RegenerateRecoveryCodes() error = %v, want %v", i+1, err, auth.ErrInvalidMFACode)
+		}
+	}
+	if err := env.Service.DisableTOTP(ctx, user.ID, "000000"); !errors.Is(err, auth.ErrAccountLocked) {
+		t.Errorf("DisableTOTP() after %d wrong codes error = %v, want %v", env.Config.LockoutThreshold, err, auth.ErrAccountLocked)
+	}
+	if _, err := env.Service.LoginWithRefresh(ctx, email, authtest.Password, time.Hour, models.ClientInfo{}); !errors.Is(err, auth.ErrAccountLocked) {
+		t.Errorf("LoginWithRefresh() while locked error = %v, want %v", err, auth.ErrAccountLocked)
+	}
+}
+
+// sessionOf returns the session an access token belongs to
+func sessionOf(t *testing.T, env *authtest.Env, login *auth.LoginResult) uuid.UUID {
+	t.Helper()
+	claims, err := env.Service.ValidateToken(context.Background(), login.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	return claims.Session()
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/models"
+)
+
+// ErrSessionNotFound is returned when a session doesn't exist, has ended, or isn't the user's
+var ErrSessionNotFound = errors.New("session not found")
+
+// maxUserAgentLength caps what's stored from the User-Agent header
+const maxUserAgentLength = 512
+
+// NewClientInfo describes the client a session is started or refreshed from
+func NewClientInfo(userAgent, ip string) models.ClientInfo {
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return models.ClientInfo{
+		UserAgent:   userAgent,
+		IPAddress:   ip,
+		DeviceLabel: deviceLabel(userAgent),
+	}
+}
+
+// deviceLabel turns a user agent into a short name like "Firefox on Windows". It only needs
+// to be good enough for a user to recognise their own devices, so it checks the common cases
+// in an order that handles browsers claiming to be other browsers.
+func deviceLabel(userAgent string) string {
+	browser := ""
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	platform := ""
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		platform = "iOS"
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "CrOS"):
+		platform = "ChromeOS"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	}
+	return "Unknown device"
+}
+
+// ListSessions returns the user's active sessions, most recently used first
+func (s *AuthService) ListSessions(ctx context.Context, userID uuid.UUID) ([]models.Session, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.ListSessions")
+	defer span.End()
+
+	return s.refreshTokenRepo.ListSessions(ctx, userID)
+}
+
+// RevokeSession ends one of the user's sessions, its refresh token stops working immediately
+func (s *AuthService) RevokeSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	ctx, span := tracer.Start(ctx, "AuthService.RevokeSession")
+	defer span.End()
+
+	revoked, err := s.refreshTokenRepo.RevokeUserTokenFamily(ctx, userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrSessionNotFound
+	}
+	refs, err := s.refreshTokenRepo.FamilyAccessTokens(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	return s.revokeAccessTokens(ctx, refs)
+}
+
+// RevokeOtherSessions ends every session of the user except the current one,
+// returning how many were ended
+func (s *AuthService) RevokeOtherSessions(ctx context.Context, userID, currentSessionID uuid.UUID) (int, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.RevokeOtherSessions")
+	defer span.End()
+
+	count, err := s.refreshTokenRepo.RevokeOtherTokenFamilies(ctx, userID, currentSessionID)
+	if err != nil {
+		return 0, err
+	}
+	refs, err := s.refreshTokenRepo.UserAccessTokens(ctx, userID, currentSessionID)
+	if err != nil {
+		return 0, err
+	}
+	return count, s.revokeAccessTokens(ctx, refs)
+}
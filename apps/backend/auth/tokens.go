@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// opaqueTokenBytes is the amount of randomness in every opaque token we hand out
+const opaqueTokenBytes = 32
+
+// generateOpaqueToken creates a random URL-safe token and the digest that gets stored for it
+func generateOpaqueToken() (token string, tokenHash string, err error) {
+	b := make([]byte, opaqueTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashOpaqueToken(token), nil
+}
+
+// hashOpaqueToken returns the hex SHA-256 digest of a token, only this is ever persisted
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateSignedToken creates an opaque token with an HMAC over its purpose appended,
+// so tokens minted for one flow are rejected by another before touching the database
+func generateSignedToken(key []byte, purpose string) (token string, tokenHash string, err error) {
+	random, _, err := generateOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	token = random + "." + signToken(key, purpose, random)
+	return token, hashOpaqueToken(token), nil
+}
+
+// verifySignedToken checks the signature of a token made by generateSignedToken
+func verifySignedToken(key []byte, purpose, token string) bool {
+	random, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(signToken(key, purpose, random)))
+}
+
+// signToken computes the URL-safe HMAC-SHA256 of a token's random part bound to its purpose
+func signToken(key []byte, purpose, random string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose + ":" + random))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
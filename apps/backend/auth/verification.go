@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pjontop/placer/backend/mail"
+	"github.com/pjontop/placer/backend/models"
+)
+
+// sendVerificationEmail issues a verification token for the user and emails them a link with it
+func (s *AuthService) sendVerificationEmail(ctx context.Context, user *models.User) error {
+	token, tokenHash, err := generateSignedToken(s.jwtSecret, models.TokenPurposeEmailVerification)
+	if err != nil {
+		return err
+	}
+	if _, err := s.userTokenRepo.CreateUserToken(ctx, user.ID, models.TokenPurposeEmailVerification, tokenHash, s.cfg.VerificationTokenTTL); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", s.cfg.AppURL, url.QueryEscape(token))
+	return s.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm your email address by opening this link:\n\n%s\n\nThe link expires in %s. If you didn't sign up, you can ignore this email.\n",
+			user.Name, link, s.cfg.VerificationTokenTTL),
+	})
+}
+
+// VerifyEmail consumes a verification token and marks its user's email as verified
+func (s *AuthService) VerifyEmail(ctx context.Context, token string) error {
+	ctx, span := tracer.Start(ctx, "AuthService.VerifyEmail")
+	defer span.End()
+
+	if !verifySignedToken(s.jwtSecret, models.TokenPurposeEmailVerification, token) {
+		return ErrInvalidToken
+	}
+	userToken, err := s.userTokenRepo.ConsumeUserToken(ctx, models.TokenPurposeEmailVerification, hashOpaqueToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		return err
+	}
+	return s.userRepo.MarkEmailVerified(ctx, userToken.UserID)
+}
+
+// ResendVerificationEmail sends a fresh verification link to an unverified account.
+// Unknown, already verified and cooling-down accounts are skipped without an error
+// so callers can't use this to find out which emails are registered.
+func (s *AuthService) ResendVerificationEmail(ctx context.Context, email string) error {
+	ctx, span := tracer.Start(ctx, "AuthService.ResendVerificationEmail")
+	defer span.End()
+
+	user, err := s.userRepo.GetUserByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+
+	allowed, err := s.canSendTokenEmail(ctx, user, models.TokenPurposeEmailVerification)
+	if err != nil || !allowed {
+		return err
+	}
+
+	return s.sendVerificationEmail(ctx, user)
+}
+
+// canSendTokenEmail enforces a short cooldown between token emails and a cap per hour
+func (s *AuthService) canSendTokenEmail(ctx context.Context, user *models.User, purpose string) (bool, error) {
+	count, latest, err := s.userTokenRepo.CountUserTokensSince(ctx, user.ID, purpose, time.Now().Add(-time.Hour))
+	if err != nil {
+		return false, err
+	}
+	if latest != nil && time.Since(*latest) < s.cfg.EmailCooldown {
+		s.logger.Info("email skipped, cooldown active", "purpose", purpose, "user_id", user.ID)
+		return false, nil
+	}
+	if count >= s.cfg.EmailMaxPerHour {
+		s.logger.Info("email skipped, hourly limit reached", "purpose", purpose, "user_id", user.ID)
+		return false, nil
+	}
+	return true, nil
+}
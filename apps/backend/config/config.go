@@ -0,0 +1,345 @@
+// Package config loads the backend's settings once at startup. They come from environment
+// variables, a .env file and optionally a YAML file named by CONFIG_FILE, and are validated
+// together so a bad deploy reports every problem at once.
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pjontop/placer/backend/db"
+	"github.com/pjontop/placer/backend/ratelimit"
+)
+
+// Config is every setting the server runs with
+type Config struct {
+	// Env is the deployment environment, "production" changes some defaults
+	Env         string
+	Port        string
+	FrontendURL string
+	// DatabaseURL is a secret, it usually has the password in it
+	DatabaseURL string
+	AutoMigrate bool
+	// TrustProxy takes the client IP from X-Forwarded-For, only enable it behind a proxy that sets it
+	TrustProxy bool
+
+	DB         DBConfig
+	Log        LogConfig
+	HTTP       HTTPConfig
+	Tracing    TracingConfig
+	Cookie     CookieConfig
+	JWT        JWTConfig
+	Email      EmailConfig
+	Mail       MailConfig
+	MFA        MFAConfig
+	WebAuthn   WebAuthnConfig
+	Revocation RevocationConfig
+	Login      LoginConfig
+}
+
+// DBConfig covers the connection pool and how the database is used once connected
+type DBConfig struct {
+	Pool db.PoolConfig
+	// Timeouts bound every query, so a stuck database fails requests rather than piling them up
+	Timeouts db.Timeouts
+}
+
+// LogConfig sets up the logger
+type LogConfig struct {
+	Format string
+	Level  string
+}
+
+// HTTPConfig hardens the servers and sets how they shut down
+type HTTPConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	ShutdownTimeout   time.Duration
+	// DrainDelay is how long readiness fails before connections are drained
+	DrainDelay       time.Duration
+	ReadinessTimeout time.Duration
+	MetricsAddr      string
+}
+
+// TracingConfig picks where spans are exported
+type TracingConfig struct {
+	Exporter    string
+	ServiceName string
+}
+
+// CookieConfig describes the refresh token cookie
+type CookieConfig struct {
+	Domain          string
+	Secure          bool
+	SameSite        http.SameSite
+	RefreshTokenTTL time.Duration
+}
+
+// JWTConfig covers signing and checking access tokens
+type JWTConfig struct {
+	// Secret is a secret, it keys HS256 tokens and the HMAC on emailed tokens
+	Secret           string
+	KeysDir          string
+	ActiveKID        string
+	HS256AcceptUntil time.Time
+	Issuer           string
+	Audience         string
+	Leeway           time.Duration
+	AccessTokenTTL   time.Duration
+}
+
+// EmailConfig covers verification and password reset emails
+type EmailConfig struct {
+	RequireVerification bool
+	VerificationTTL     time.Duration
+	PasswordResetTTL    time.Duration
+	Cooldown            time.Duration
+	MaxPerHour          int
+}
+
+// MailConfig picks how emails are sent
+type MailConfig struct {
+	Sender       string
+	From         string
+	FileDir      string
+	SMTPAddr     string
+	SMTPUsername string
+	// SMTPPassword is a secret
+	SMTPPassword string
+}
+
+// MFAConfig covers second factors
+type MFAConfig struct {
+	Issuer string
+	// EncryptionKey is a secret, it encrypts TOTP secrets at rest
+	EncryptionKey string
+	ChallengeTTL  time.Duration
+}
+
+// WebAuthnConfig describes us as a passkey relying party
+type WebAuthnConfig struct {
+	RPID       string
+	RPName     string
+	RPOrigins  []string
+	SessionTTL time.Duration
+}
+
+// RevocationConfig picks where revoked access tokens are kept
+type RevocationConfig struct {
+	Store         string
+	MemorySize    int
+	PruneInterval time.Duration
+}
+
+// LoginConfig throttles login attempts
+type LoginConfig struct {
+	RateLimitStore   string
+	RateLimitIP      ratelimit.Rate
+	RateLimitEmail   ratelimit.Rate
+	LockoutThreshold int
+	LockoutBase      time.Duration
+	LockoutMax       time.Duration
+}
+
+// Load reads and validates the configuration, returning every problem it found joined together
+func Load() (*Config, error) {
+	l, err := newLoader()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		Env:         l.string("APP_ENV", "development"),
+		Port:        l.string("PORT", "8080"),
+		FrontendURL: l.required("FRONTEND_URL"),
+		DatabaseURL: l.required("DATABASE_URL"),
+		AutoMigrate: l.bool("DB_AUTO_MIGRATE", true),
+		TrustProxy:  l.bool("TRUST_PROXY", false),
+	}
+	frontend, err := url.Parse(cfg.FrontendURL)
+	if err != nil {
+		frontend = &url.URL{}
+	}
+	if cfg.FrontendURL != "" && (frontend.Scheme == "" || frontend.Host == "") {
+		l.fail("FRONTEND_URL", "must be an absolute URL, got %q", cfg.FrontendURL)
+	}
+
+	cfg.DB = DBConfig{
+		Pool: db.PoolConfig{
+			MaxConns:          int32(l.int("DB_MAX_CONNS", 10, 1)),
+			MinConns:          int32(l.int("DB_MIN_CONNS", 1, 0)),
+			MaxConnLifetime:   l.duration("DB_MAX_CONN_LIFETIME", time.Hour),
+			HealthCheckPeriod: l.duration("DB_HEALTH_CHECK_PERIOD", time.Minute),
+			ConnectRetry:      l.duration("DB_CONNECT_RETRY", 30*time.Second),
+		},
+		Timeouts: db.Timeouts{
+			Read:  l.duration("DB_READ_TIMEOUT", 3*time.Second),
+			Write: l.duration("DB_WRITE_TIMEOUT", 5*time.Second),
+		},
+	}
+	if cfg.DB.Pool.MinConns > cfg.DB.Pool.MaxConns {
+		l.fail("DB_MIN_CONNS", "must not be more than DB_MAX_CONNS (%d), got %d", cfg.DB.Pool.MaxConns, cfg.DB.Pool.MinConns)
+	}
+
+	defaultLogFormat := "text"
+	if cfg.Env == "production" {
+		defaultLogFormat = "json"
+	}
+	cfg.Log = LogConfig{
+		Format: l.oneOf("LOG_FORMAT", defaultLogFormat, "text", "json"),
+		Level:  l.oneOf("LOG_LEVEL", "info", "debug", "info", "warn", "error"),
+	}
+
+	cfg.HTTP = HTTPConfig{
+		ReadHeaderTimeout: l.duration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       l.duration("HTTP_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:      l.duration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       l.duration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    l.int("HTTP_MAX_HEADER_BYTES", 1<<16, 1),
+		ShutdownTimeout:   l.duration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		DrainDelay:        l.duration("SHUTDOWN_DRAIN_DELAY", 5*time.Second),
+		ReadinessTimeout:  l.duration("READINESS_TIMEOUT", 2*time.Second),
+		MetricsAddr:       l.string("METRICS_ADDR", ":9090"),
+	}
+
+	cfg.Tracing = TracingConfig{
+		Exporter:    l.oneOf("TRACE_EXPORTER", "none", "none", "otlp", "stdout"),
+		ServiceName: l.string("OTEL_SERVICE_NAME", "placer-backend"),
+	}
+
+	cfg.Cookie = CookieConfig{
+		Domain:          l.string("COOKIE_DOMAIN", ""),
+		Secure:          l.bool("COOKIE_SECURE", true),
+		SameSite:        l.sameSite("COOKIE_SAMESITE", "None"),
+		RefreshTokenTTL: l.duration("REFRESH_TOKEN_EXPIRES_IN", 7*24*time.Hour),
+	}
+
+	cfg.JWT = JWTConfig{
+		Secret:           l.required("JWT_SECRET"),
+		KeysDir:          l.string("JWT_KEYS_DIR", "keys"),
+		ActiveKID:        l.string("JWT_ACTIVE_KID", ""),
+		HS256AcceptUntil: l.time("JWT_HS256_ACCEPT_UNTIL"),
+		Issuer:           l.string("JWT_ISSUER", "placer"),
+		Audience:         l.string("JWT_AUDIENCE", cfg.FrontendURL),
+		Leeway:           l.duration("JWT_LEEWAY", 30*time.Second),
+		AccessTokenTTL:   15 * time.Minute,
+	}
+
+	cfg.Email = EmailConfig{
+		RequireVerification: l.bool("REQUIRE_EMAIL_VERIFICATION", false),
+		VerificationTTL:     l.duration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+		PasswordResetTTL:    l.duration("PASSWORD_RESET_TTL", 30*time.Minute),
+		Cooldown:            l.duration("AUTH_EMAIL_COOLDOWN", time.Minute),
+		MaxPerHour:          5,
+	}
+
+	cfg.Mail = MailConfig{
+		Sender:       l.oneOf("MAIL_SENDER", "log", "log", "file", "smtp"),
+		From:         l.string("MAIL_FROM", "no-reply@localhost"),
+		FileDir:      l.string("MAIL_FILE_DIR", "tmp/mail"),
+		SMTPAddr:     l.string("SMTP_ADDR", ""),
+		SMTPUsername: l.string("SMTP_USERNAME", ""),
+		SMTPPassword: l.string("SMTP_PASSWORD", ""),
+	}
+	if cfg.Mail.Sender == "smtp" && cfg.Mail.SMTPAddr == "" {
+		l.fail("SMTP_ADDR", "is required when MAIL_SENDER is smtp")
+	}
+
+	cfg.MFA = MFAConfig{
+		Issuer:        l.string("MFA_ISSUER", "Placer"),
+		EncryptionKey: l.string("MFA_ENCRYPTION_KEY", cfg.JWT.Secret),
+		ChallengeTTL:  5 * time.Minute,
+	}
+	if key := l.string("MFA_ENCRYPTION_KEY", ""); cfg.Env != "development" && key == "" {
+		l.fail("MFA_ENCRYPTION_KEY", "must be set to a secret key outside development")
+	}
+
+	cfg.WebAuthn = WebAuthnConfig{
+		RPID:       l.string("WEBAUTHN_RP_ID", frontend.Hostname()),
+		RPName:     l.string("WEBAUTHN_RP_NAME", "Placer"),
+		RPOrigins:  l.list("WEBAUTHN_RP_ORIGINS", []string{cfg.FrontendURL}),
+		SessionTTL: 5 * time.Minute,
+	}
+
+	cfg.Revocation = RevocationConfig{
+		Store:         l.oneOf("REVOCATION_STORE", "postgres", "postgres", "memory"),
+		MemorySize:    l.int("REVOCATION_MEMORY_SIZE", 10000, 1),
+		PruneInterval: l.duration("REVOCATION_PRUNE_INTERVAL", 10*time.Minute),
+	}
+
+	cfg.Login = LoginConfig{
+		RateLimitStore:   l.oneOf("RATE_LIMIT_STORE", "memory", "memory", "postgres"),
+		RateLimitIP:      l.rate("LOGIN_RATE_LIMIT_IP", "20/1m"),
+		RateLimitEmail:   l.rate("LOGIN_RATE_LIMIT_EMAIL", "5/1m"),
+		LockoutThreshold: 5,
+		LockoutBase:      l.duration("LOGIN_LOCKOUT_BASE", time.Minute),
+		LockoutMax:       l.duration("LOGIN_LOCKOUT_MAX", time.Hour),
+	}
+
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadDatabaseURL reads only DATABASE_URL, for the subcommands that need nothing else
+func LoadDatabaseURL() (string, error) {
+	l, err := newLoader()
+	if err != nil {
+		return "", err
+	}
+	databaseURL := l.required("DATABASE_URL")
+	return databaseURL, l.err()
+}
+
+// LoadKeysDir reads only JWT_KEYS_DIR, for the keys subcommand
+func LoadKeysDir() (string, error) {
+	l, err := newLoader()
+	if err != nil {
+		return "", err
+	}
+	return l.string("JWT_KEYS_DIR", "keys"), nil
+}
+
+// redactedValue replaces secrets when the config is printed
+const redactedValue = "[REDACTED]"
+
+// Redacted returns a copy of the config with every secret blanked out, and the password
+// taken out of the database URL
+func (c Config) Redacted() Config {
+	if u, err := url.Parse(c.DatabaseURL); err == nil && u.Scheme != "" {
+		c.DatabaseURL = u.Redacted()
+	} else if c.DatabaseURL != "" {
+		c.DatabaseURL = redactedValue
+	}
+	c.JWT.Secret = redact(c.JWT.Secret)
+	c.MFA.EncryptionKey = redact(c.MFA.EncryptionKey)
+	c.Mail.SMTPPassword = redact(c.Mail.SMTPPassword)
+	return c
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// printable has Config's fields without its methods, so formatting it doesn't recurse into String
+type printable Config
+
+// String prints the config with its secrets redacted
+func (c Config) String() string {
+	return fmt.Sprintf("%+v", printable(c.Redacted()))
+}
+
+// LogValue logs the config with its secrets redacted
+func (c Config) LogValue() slog.Value {
+	return slog.AnyValue(printable(c.Redacted()))
+}
@@ -0,0 +1,201 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pjontop/placer/backend/ratelimit"
+	"gopkg.in/yaml.v3"
+)
+
+// loader merges the settings from every source and parses them, collecting every problem
+// it finds instead of stopping at the first one
+type loader struct {
+	values map[string]string
+	errs   []error
+}
+
+// newLoader reads the settings. The environment wins over .env, which wins over the file
+// named by CONFIG_FILE in either of them.
+func newLoader() (*loader, error) {
+	dotenv, err := godotenv.Read(".env")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read .env: %w", err)
+	}
+
+	l := &loader{values: map[string]string{}}
+	file := os.Getenv("CONFIG_FILE")
+	if file == "" {
+		file = dotenv["CONFIG_FILE"]
+	}
+	if file != "" {
+		if err := l.readFile(file); err != nil {
+			return nil, err
+		}
+	}
+	for name, value := range dotenv {
+		l.values[name] = value
+	}
+	for _, kv := range os.Environ() {
+		if name, value, ok := strings.Cut(kv, "="); ok && value != "" {
+			l.values[name] = value
+		}
+	}
+	return l, nil
+}
+
+// readFile reads a YAML file of settings keyed by the same names as the environment
+// variables, in any case. Lists become comma separated values.
+func (l *loader) readFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("parse config file %s: %w", file, err)
+	}
+	for name, value := range settings {
+		switch v := value.(type) {
+		case nil:
+			continue
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			l.values[strings.ToUpper(name)] = strings.Join(items, ",")
+		case map[string]any:
+			return fmt.Errorf("config file %s: %s must be a value or a list", file, name)
+		default:
+			l.values[strings.ToUpper(name)] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// fail records a problem with a setting
+func (l *loader) fail(name, format string, args ...any) {
+	l.errs = append(l.errs, fmt.Errorf("%s: "+format, append([]any{name}, args...)...))
+}
+
+// err returns every problem found, or nil
+func (l *loader) err() error {
+	return errors.Join(l.errs...)
+}
+
+func (l *loader) string(name, fallback string) string {
+	if v := strings.TrimSpace(l.values[name]); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (l *loader) required(name string) string {
+	v := l.string(name, "")
+	if v == "" {
+		l.fail(name, "is required")
+	}
+	return v
+}
+
+func (l *loader) oneOf(name, fallback string, options ...string) string {
+	v := l.string(name, fallback)
+	if !slices.Contains(options, v) {
+		l.fail(name, "must be one of %s, got %q", strings.Join(options, ", "), v)
+	}
+	return v
+}
+
+func (l *loader) bool(name string, fallback bool) bool {
+	v := l.string(name, "")
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.fail(name, "must be true or false, got %q", v)
+		return fallback
+	}
+	return b
+}
+
+func (l *loader) int(name string, fallback, atLeast int) int {
+	v := l.string(name, "")
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < atLeast {
+		l.fail(name, "must be a whole number of at least %d, got %q", atLeast, v)
+		return fallback
+	}
+	return n
+}
+
+func (l *loader) duration(name string, fallback time.Duration) time.Duration {
+	v := l.string(name, "")
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		l.fail(name, "must be a duration like 30s or 1h, got %q", v)
+		return fallback
+	}
+	return d
+}
+
+// time parses an optional RFC 3339 timestamp, the zero time if it's unset
+func (l *loader) time(name string) time.Time {
+	v := l.string(name, "")
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		l.fail(name, "must be an RFC 3339 time like 2026-01-02T15:04:05Z, got %q", v)
+	}
+	return t
+}
+
+func (l *loader) list(name string, fallback []string) []string {
+	v := l.string(name, "")
+	if v == "" {
+		return fallback
+	}
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (l *loader) rate(name, fallback string) ratelimit.Rate {
+	v := l.string(name, fallback)
+	rate, err := ratelimit.ParseRate(v)
+	if err != nil {
+		l.fail(name, "%v", err)
+	}
+	return rate
+}
+
+func (l *loader) sameSite(name, fallback string) http.SameSite {
+	switch l.oneOf(name, fallback, "None", "Lax", "Strict") {
+	case "Lax":
+		return http.SameSiteLaxMode
+	case "Strict":
+		return http.SameSiteStrictMode
+	}
+	return http.SameSiteNoneMode
+}
@@ -1,37 +1,102 @@
 package db
 
 import (
-	"database/sql"
-	_ "embed"
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var schemaSQL string
+// PoolConfig tunes the connection pool. Zero fields keep pgx's defaults, or whatever the
+// connection string sets with pool_max_conns and friends.
+type PoolConfig struct {
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	HealthCheckPeriod time.Duration
+	// ConnectRetry is how long Connect keeps retrying a database that isn't up yet, zero
+	// gives up after the first attempt
+	ConnectRetry time.Duration
+}
+
+// Backoff between connection attempts, doubling from the first up to the max
+const (
+	firstConnectBackoff = 250 * time.Millisecond
+	maxConnectBackoff   = 5 * time.Second
+)
 
 // Establish Connection with the Database
-func Connect(connectionString string) (*sql.DB, error) {
-	db, err := sql.Open("pgx", connectionString)
+func Connect(ctx context.Context, connectionString string, cfg PoolConfig) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(connectionString)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxConns > 0 {
+		poolConfig.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		poolConfig.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	if cfg.HealthCheckPeriod > 0 {
+		poolConfig.HealthCheckPeriod = cfg.HealthCheckPeriod
+	}
+	// Queries are traced on the connection, so they show up under the span of the request
+	poolConfig.ConnConfig.Tracer = queryTracer{}
 
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	// Testing the Connection
-	if err := db.Ping(); err != nil {
+	// Testing the Connection, the database may still be starting when we deploy alongside it
+	if err := pingWithRetry(ctx, cfg.ConnectRetry, pool.Ping, sleep); err != nil {
+		pool.Close()
 		return nil, err
 	}
 
-	log.Println("Connected to the database successfully") // yay!
+	slog.Info("connected to the database") // yay!
 
-	// init schema
-	log.Println("db schema init...")
-	if _, err := db.Exec(schemaSQL); err != nil {
-		log.Printf("failed to initialize schema with: %v", err)
-	} else {
-		log.Println("db schema initialized")
+	return pool, nil
+}
+
+// pingWithRetry pings until it works, backing off between attempts for as long as the next
+// wait would still end within retry. wait does the waiting, so tests can skip it.
+func pingWithRetry(ctx context.Context, retry time.Duration, ping func(ctx context.Context) error, wait func(ctx context.Context, d time.Duration) error) error {
+	var spent time.Duration
+	backoff := firstConnectBackoff
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := ping(ctx)
+		if err == nil {
+			return nil
+		}
+		spent += time.Since(start)
+		if spent+backoff > retry {
+			if attempt > 1 {
+				err = fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+		slog.Warn("database not reachable, retrying", "attempt", attempt, "backoff", backoff, "err", err)
+		if err := wait(ctx, backoff); err != nil {
+			return err
+		}
+		spent += backoff
+		backoff = min(backoff*2, maxConnectBackoff)
 	}
+}
 
-	return db, nil
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
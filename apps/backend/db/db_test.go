@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPingWithRetry(t *testing.T) {
+	errDown := errors.New("connection refused")
+	ms := time.Millisecond
+	tests := []struct {
+		name      string
+		retry     time.Duration
+		failures  int
+		wantWaits []time.Duration
+		wantErr   string
+	}{
+		{name: "up straight away", retry: 30 * time.Second},
+		{name: "up after a while", retry: 30 * time.Second, failures: 3, wantWaits: []time.Duration{250 * ms, 500 * ms, time.Second}},
+		{name: "no retry", failures: 100, wantErr: "connection refused"},
+		{name: "gives up before the retry runs out", retry: 3 * time.Second, failures: 100,
+			wantWaits: []time.Duration{250 * ms, 500 * ms, time.Second}, wantErr: "gave up after 4 attempts: connection refused"},
+		{name: "backoff is capped", retry: 30 * time.Second, failures: 100,
+			wantWaits: []time.Duration{250 * ms, 500 * ms, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second},
+			wantErr:   "gave up after 10 attempts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			ping := func(ctx context.Context) error {
+				attempts++
+				if attempts <= tt.failures {
+					return errDown
+				}
+				return nil
+			}
+			var waits []time.Duration
+			wait := func(ctx context.Context, d time.Duration) error {
+				waits = append(waits, d)
+				return nil
+			}
+
+			err := pingWithRetry(context.Background(), tt.retry, ping, wait)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("pingWithRetry() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.Is(err, errDown)) {
+				t.Fatalf("pingWithRetry() error = %v, want %q wrapping the ping error", err, tt.wantErr)
+			}
+			if !slices.Equal(waits, tt.wantWaits) {
+				t.Errorf("waits = %v, want %v", waits, tt.wantWaits)
+			}
+		})
+	}
+}
+
+func TestPingWithRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ping := func(ctx context.Context) error { return errors.New("connection refused") }
+	wait := func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return sleep(ctx, d)
+	}
+	if err := pingWithRetry(ctx, time.Minute, ping, wait); !errors.Is(err, context.Canceled) {
+		t.Errorf("pingWithRetry() error = %v, want %v", err, context.Canceled)
+	}
+}
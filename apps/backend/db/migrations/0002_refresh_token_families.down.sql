@@ -0,0 +1,3 @@
+-- the plaintext tokens can't be recovered, so only the family column is undone
+DROP INDEX IF EXISTS idx_refresh_tokens_family_id;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS family_id;
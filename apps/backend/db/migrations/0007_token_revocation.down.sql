@@ -0,0 +1,4 @@
+ALTER TABLE users DROP COLUMN IF EXISTS role;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS access_expires_at;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS access_jti;
+DROP TABLE IF EXISTS revoked_access_tokens;
@@ -0,0 +1,13 @@
+-- access tokens revoked before they expired, rows can be pruned once expires_at passes
+CREATE TABLE IF NOT EXISTS revoked_access_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_revoked_access_tokens_expires_at ON revoked_access_tokens(expires_at);
+
+-- the access token issued alongside each refresh token, so ending a session can revoke it too
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS access_jti VARCHAR(64);
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS access_expires_at TIMESTAMP;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(32) NOT NULL DEFAULT 'user';
@@ -0,0 +1,13 @@
+-- token buckets shared by every replica, key is a digest of the limiter name and the client key
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    key VARCHAR(64) PRIMARY KEY,
+    limiter VARCHAR(64) NOT NULL,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_updated_at ON rate_limit_buckets(limiter, updated_at);
+
+-- consecutive failed logins, an account is locked out for a growing time past a threshold
+ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_login_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts bounds how long a single query may run, so a hung database fails requests
+// instead of holding them open. Reads are the lookups on the request path, writes change
+// state and may wait on row locks. A zero timeout leaves only the caller's deadline.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+// ReadContext returns ctx with the read timeout applied, an earlier deadline on ctx still wins
+func (t Timeouts) ReadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Read)
+}
+
+// WriteContext returns ctx with the write timeout applied, an earlier deadline on ctx still wins
+func (t Timeouts) WriteContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Write)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
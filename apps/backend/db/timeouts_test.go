@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTimeouts(t *testing.T) {
+	timeouts := Timeouts{Read: time.Second, Write: time.Minute}
+	tests := []struct {
+		name    string
+		ctx     func(ctx context.Context) (context.Context, context.CancelFunc)
+		parent  time.Duration
+		want    time.Duration
+		noLimit bool
+	}{
+		{name: "read", ctx: timeouts.ReadContext, want: time.Second},
+		{name: "write", ctx: timeouts.WriteContext, want: time.Minute},
+		{name: "earlier deadline wins", ctx: timeouts.WriteContext, parent: time.Second, want: time.Second},
+		{name: "zero timeout", ctx: Timeouts{}.ReadContext, noLimit: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := context.Background()
+			if tt.parent > 0 {
+				var cancel context.CancelFunc
+				parent, cancel = context.WithTimeout(parent, tt.parent)
+				defer cancel()
+			}
+			ctx, cancel := tt.ctx(parent)
+			deadline, ok := ctx.Deadline()
+			if tt.noLimit {
+				if ok {
+					t.Errorf("deadline = %v, want none", deadline)
+				}
+			} else if remaining := time.Until(deadline); !ok || remaining > tt.want || remaining < tt.want-time.Second/2 {
+				t.Errorf("deadline in %v, want about %v", remaining, tt.want)
+			}
+
+			// Every context can be cancelled, so the query stops when the store method returns
+			cancel()
+			if ctx.Err() != context.Canceled {
+				t.Errorf("after cancel Err() = %v, want %v", ctx.Err(), context.Canceled)
+			}
+		})
+	}
+}
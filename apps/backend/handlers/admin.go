@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pjontop/placer/backend/audit"
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/problem"
+)
+
+// Page sizes for the audit log listing
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 200
+)
+
+// AdminHandler contains HTTP handlers for administrative endpoints
+type AdminHandler struct {
+	authService *auth.AuthService
+	auditLog    audit.Store
+	logger      *slog.Logger
+}
+
+// NewAdminHandler creates a new admin handler
+func NewAdminHandler(authService *auth.AuthService, auditLog audit.Store, logger *slog.Logger) *AdminHandler {
+	return &AdminHandler{
+		authService: authService,
+		auditLog:    auditLog,
+		logger:      logger,
+	}
+}
+
+// RevokeUserSessions signs a user out of every session and revokes their access tokens
+func (h *AdminHandler) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		problem.Write(w, r, problem.NotFound("User not found"))
+		return
+	}
+
+	if err := h.authService.RevokeUserSessions(r.Context(), userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			problem.Write(w, r, problem.NotFound("User not found"))
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "error revoking sessions", "user_id", userID, "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "admin revoked all sessions", "user_id", userID)
+	recordAudit(h.auditLog, r, audit.Event{
+		Type:     audit.EventAdminRevokeSessions,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]string{"target_user_id": userID.String()},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AuditEventResponse is one entry of the audit log
+type AuditEventResponse struct {
+	ID        int64             `json:"id"`
+	Type      string            `json:"type"`
+	Outcome   string            `json:"outcome"`
+	ActorID   *uuid.UUID        `json:"actor_id"`
+	Email     string            `json:"email,omitempty"`
+	IPAddress string            `json:"ip_address"`
+	UserAgent string            `json:"user_agent"`
+	RequestID string            `json:"request_id,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// AuditLogResponse is a page of the audit log, pass NextCursor as before to get the next one
+type AuditLogResponse struct {
+	Events     []AuditEventResponse `json:"events"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+// ListAudit returns audit events newest first. It filters on the type, outcome, actor_id,
+// email, since and until (RFC 3339) query parameters and pages with limit and before.
+func (h *AdminHandler) ListAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := audit.Filter{
+		Type:    query.Get("type"),
+		Outcome: query.Get("outcome"),
+		Email:   query.Get("email"),
+		Limit:   defaultAuditPageSize,
+	}
+
+	var invalid []problem.FieldError
+	if v := query.Get("actor_id"); v != "" {
+		actorID, err := uuid.Parse(v)
+		if err != nil {
+			invalid = append(invalid, problem.InvalidField("actor_id", "must be a user id"))
+		} else {
+			filter.ActorID = &actorID
+		}
+	}
+	for _, name := range []string{"since", "until"} {
+		if v := query.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				invalid = append(invalid, problem.InvalidField(name, "must be an RFC 3339 time"))
+				continue
+			}
+			if name == "since" {
+				filter.Since = t
+			} else {
+				filter.Until = t
+			}
+		}
+	}
+	if v := query.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			invalid = append(invalid, problem.InvalidField("before", "must be a cursor from a previous page"))
+		}
+		filter.Before = before
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			invalid = append(invalid, problem.InvalidField("limit", "must be between 1 and "+strconv.Itoa(maxAuditPageSize)))
+		} else {
+			filter.Limit = limit
+		}
+	}
+	if len(invalid) > 0 {
+		problem.Write(w, r, problem.Invalid(invalid...))
+		return
+	}
+
+	events, err := h.auditLog.List(r.Context(), filter)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "error listing audit events", "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	response := AuditLogResponse{Events: make([]AuditEventResponse, 0, len(events))}
+	for _, e := range events {
+		response.Events = append(response.Events, AuditEventResponse{
+			ID:        e.ID,
+			Type:      e.Type,
+			Outcome:   e.Outcome,
+			ActorID:   e.ActorID,
+			Email:     e.Email,
+			IPAddress: e.IPAddress,
+			UserAgent: e.UserAgent,
+			RequestID: e.RequestID,
+			Metadata:  e.Metadata,
+			CreatedAt: e.CreatedAt,
+		})
+	}
+	// A full page means there may be more
+	if len(events) == filter.Limit {
+		response.NextCursor = strconv.FormatInt(events[len(events)-1].ID, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
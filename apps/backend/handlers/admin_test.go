@@ -0,0 +1,127 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/audit"
+	"github.com/pjontop/placer/backend/handlers"
+	"github.com/pjontop/placer/backend/problem"
+)
+
+func TestAdminRequiresRole(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	token := s.login(t, email)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		code   string
+	}{
+		{name: "signed out", status: http.StatusUnauthorized, code: problem.CodeUnauthorized},
+		{name: "regular user", token: token, status: http.StatusForbidden, code: problem.CodeForbidden},
+		{name: "admin", token: s.admin(t, "admin@example.com"), status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantStatus(t, s.do(t, request{Method: "GET", Path: "/api/admin/audit", Token: tt.token}), tt.status, tt.code)
+		})
+	}
+}
+
+func TestAdminRevokeUserSessions(t *testing.T) {
+	s := newServer(t)
+	user := s.CreateUser(t, email)
+	victim := s.login(t, email)
+	token := s.admin(t, "admin@example.com")
+
+	tests := []struct {
+		name   string
+		id     string
+		status int
+		code   string
+	}{
+		{name: "not a user id", id: "bogus", status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "unknown user", id: uuid.NewString(), status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "user", id: user.ID.String(), status: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "POST", Path: "/api/admin/users/" + tt.id + "/revoke-sessions", Token: token})
+			wantStatus(t, rec, tt.status, tt.code)
+		})
+	}
+
+	wantStatus(t, s.do(t, request{Method: "GET", Path: "/api/profile", Token: victim}), http.StatusUnauthorized, problem.CodeTokenRevoked)
+	events, _ := s.Audit.List(t.Context(), audit.Filter{Type: audit.EventAdminRevokeSessions, Limit: 10})
+	if len(events) != 1 {
+		t.Errorf("got %d admin revoke events, want 1", len(events))
+	}
+}
+
+func TestListAudit(t *testing.T) {
+	s := newServer(t)
+	user := s.CreateUser(t, email)
+	token := s.admin(t, "admin@example.com")
+	for i := 0; i < 3; i++ {
+		s.Audit.Record(t.Context(), audit.Event{Type: audit.EventLogin, Outcome: audit.OutcomeSuccess, ActorID: &user.ID, Email: email})
+	}
+	s.Audit.Record(t.Context(), audit.Event{Type: audit.EventLogin, Outcome: audit.OutcomeFailure, Email: "nobody@example.com"})
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+		events int
+		next   bool
+	}{
+		{name: "everything", query: url.Values{"type": {audit.EventLogin}}, status: http.StatusOK, events: 4},
+		{name: "by outcome", query: url.Values{"type": {audit.EventLogin}, "outcome": {audit.OutcomeFailure}}, status: http.StatusOK, events: 1},
+		{name: "by actor", query: url.Values{"actor_id": {user.ID.String()}}, status: http.StatusOK, events: 3},
+		{name: "by email", query: url.Values{"email": {"NOBODY@example.com"}}, status: http.StatusOK, events: 1},
+		{name: "first page", query: url.Values{"type": {audit.EventLogin}, "limit": {"2"}}, status: http.StatusOK, events: 2, next: true},
+		{name: "since the future", query: url.Values{"since": {time.Now().Add(time.Hour).Format(time.RFC3339)}}, status: http.StatusOK},
+		{name: "bad actor", query: url.Values{"actor_id": {"bogus"}}, status: http.StatusBadRequest},
+		{name: "bad time", query: url.Values{"until": {"yesterday"}}, status: http.StatusBadRequest},
+		{name: "bad cursor", query: url.Values{"before": {"x"}}, status: http.StatusBadRequest},
+		{name: "limit too big", query: url.Values{"limit": {"100000"}}, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "GET", Path: "/api/admin/audit?" + tt.query.Encode(), Token: token})
+			if tt.status != http.StatusOK {
+				wantStatus(t, rec, tt.status, problem.CodeValidationFailed)
+				return
+			}
+			wantStatus(t, rec, tt.status, "")
+			var resp handlers.AuditLogResponse
+			decode(t, rec, &resp)
+			if len(resp.Events) != tt.events {
+				t.Errorf("got %d events, want %d", len(resp.Events), tt.events)
+			}
+			if (resp.NextCursor != "") != tt.next {
+				t.Errorf("next cursor = %q, want one: %v", resp.NextCursor, tt.next)
+			}
+		})
+	}
+
+	// The cursor from the first page picks up where it stopped
+	rec := s.do(t, request{Method: "GET", Path: "/api/admin/audit?type=login&limit=2", Token: token})
+	var first handlers.AuditLogResponse
+	decode(t, rec, &first)
+	rec = s.do(t, request{Method: "GET", Path: "/api/admin/audit?type=login&limit=2&before=" + first.NextCursor, Token: token})
+	var second handlers.AuditLogResponse
+	decode(t, rec, &second)
+	if len(second.Events) != 2 || second.Events[0].ID >= first.Events[1].ID {
+		t.Errorf("second page = %+v, want the two events before %s", second.Events, first.NextCursor)
+	}
+	if _, err := strconv.ParseInt(first.NextCursor, 10, 64); err != nil {
+		t.Errorf("cursor %q isn't an event id", first.NextCursor)
+	}
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/audit"
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/metrics"
+	"github.com/pjontop/placer/backend/middleware"
+	"github.com/pjontop/placer/backend/webauthn"
+)
+
+// recordAudit fills in where an audit event came from and records it. The actor defaults
+// to the authenticated user, if there is one.
+func recordAudit(auditLog audit.Store, r *http.Request, e audit.Event) {
+	e.IPAddress = middleware.ClientIP(r)
+	e.UserAgent = r.UserAgent()
+	e.RequestID = middleware.GetRequestID(r)
+	if e.ActorID == nil {
+		if userID, ok := middleware.GetUserID(r); ok {
+			e.ActorID = &userID
+		}
+	}
+	auditLog.Record(r.Context(), e)
+}
+
+// record adds an audit event for a request to the auth handler and counts it in the
+// auth metrics
+func (h *AuthHandler) record(r *http.Request, e audit.Event) {
+	recordAudit(h.auditLog, r, e)
+	observeAuthEvent(h.metrics, e)
+}
+
+// loginMethods maps the audit events that end a login attempt to the login method
+var loginMethods = map[string]string{
+	audit.EventLogin:        "password",
+	audit.EventMFAVerify:    "mfa",
+	audit.EventPasskeyLogin: "passkey",
+}
+
+// observeAuthEvent counts logins and refreshes from the audit event describing them
+func observeAuthEvent(m *metrics.Metrics, e audit.Event) {
+	switch e.Type {
+	case audit.EventLogin, audit.EventMFAVerify, audit.EventPasskeyLogin:
+		m.ObserveLogin(loginMethods[e.Type], e.Outcome, e.Metadata["reason"])
+	case audit.EventRefresh, audit.EventTokenReuse:
+		m.ObserveRefresh(e.Outcome)
+	}
+}
+
+// actor returns a user ID as an audit actor, nil for the zero ID
+func actor(userID uuid.UUID) *uuid.UUID {
+	if userID == uuid.Nil {
+		return nil
+	}
+	return &userID
+}
+
+// failedUser is the user an MFA error names, the zero ID for other errors
+func failedUser(err error) uuid.UUID {
+	var mfaErr *auth.MFAError
+	if errors.As(err, &mfaErr) {
+		return mfaErr.UserID
+	}
+	return uuid.Nil
+}
+
+// failure builds a failed audit event with the reason for err in its metadata
+func failure(eventType string, userID uuid.UUID, err error) audit.Event {
+	return audit.Event{
+		Type:     eventType,
+		Outcome:  audit.OutcomeFailure,
+		ActorID:  actor(userID),
+		Metadata: map[string]string{"reason": auditReason(err)},
+	}
+}
+
+// success builds a successful audit event
+func success(eventType string, userID uuid.UUID) audit.Event {
+	return audit.Event{Type: eventType, Outcome: audit.OutcomeSuccess, ActorID: actor(userID)}
+}
+
+// auditReason names an error for the metadata of a failed audit event
+func auditReason(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		return "invalid_credentials"
+	case errors.Is(err, auth.ErrInvalidToken), errors.Is(err, auth.ErrExpiredToken):
+		return "invalid_token"
+	case errors.Is(err, auth.ErrTokenReused):
+		return "token_reused"
+	case errors.Is(err, auth.ErrEmailNotVerified):
+		return "email_not_verified"
+	case errors.Is(err, auth.ErrAccountLocked):
+		return "account_locked"
+	case errors.Is(err, auth.ErrEmailInUse):
+		return "email_in_use"
+	case errors.Is(err, auth.ErrInvalidMFACode):
+		return "invalid_code"
+	case errors.Is(err, auth.ErrMFANotEnabled):
+		return "mfa_not_enabled"
+	case errors.Is(err, auth.ErrMFAAlreadyEnabled):
+		return "mfa_already_enabled"
+	case errors.Is(err, webauthn.ErrCloneDetected):
+		return "passkey_cloned"
+	case errors.Is(err, webauthn.ErrVerificationFailed):
+		return "passkey_verification_failed"
+	case errors.Is(err, webauthn.ErrSessionNotFound):
+		return "passkey_session_expired"
+	case errors.Is(err, webauthn.ErrNoCredentials):
+		return "no_passkeys"
+	}
+	return "error"
+}
@@ -3,23 +3,38 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/audit"
 	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/config"
+	"github.com/pjontop/placer/backend/metrics"
+	"github.com/pjontop/placer/backend/middleware"
+	"github.com/pjontop/placer/backend/models"
+	"github.com/pjontop/placer/backend/problem"
 )
 
 // AuthHandler contains HTTP handlers for authentication
 type AuthHandler struct {
 	authService *auth.AuthService
+	auditLog    audit.Store
+	metrics     *metrics.Metrics
+	cookies     config.CookieConfig
+	logger      *slog.Logger
 }
 
 // NewAuthHandler creates a new auth handler
-func NewAuthHandler(authService *auth.AuthService) *AuthHandler {
+func NewAuthHandler(authService *auth.AuthService, auditLog audit.Store, m *metrics.Metrics, cookies config.CookieConfig, logger *slog.Logger) *AuthHandler {
 	return &AuthHandler{
 		authService: authService,
+		auditLog:    auditLog,
+		metrics:     m,
+		cookies:     cookies,
+		logger:      logger,
 	}
 }
 
@@ -39,37 +54,41 @@ type RegisterResponse struct {
 
 // Register handles user registration
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
-	log.Println("register recieved")
+	h.logger.DebugContext(r.Context(), "register request received")
 
 	// Parse the request body
 	var req RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("register invalides payload with: %v", err)
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		h.logger.InfoContext(r.Context(), "invalid register payload", "err", err)
+		problem.Write(w, r, problem.Malformed())
 		return
 	}
 
-	log.Printf("register user attempt: %s", req.Email)
+	h.logger.InfoContext(r.Context(), "register attempt", "email", req.Email)
 
 	// Validate input
-	if req.Email == "" || req.Name == "" || req.Password == "" {
-		log.Println("registration missing fields")
-		http.Error(w, "Email, name, and password are required", http.StatusBadRequest)
+	if !checkRequired(w, r, field{"email", req.Email}, field{"name", req.Name}, field{"password", req.Password}) {
+		h.logger.InfoContext(r.Context(), "registration missing fields")
 		return
 	}
 	// Call the auth service to register the user
-	user, err := h.authService.Register(req.Email, req.Name, req.Password)
+	user, err := h.authService.Register(r.Context(), req.Email, req.Name, req.Password)
 	if err != nil {
+		event := failure(audit.EventRegister, uuid.Nil, err)
+		event.Email = req.Email
+		h.record(r, event)
 		if errors.Is(err, auth.ErrEmailInUse) {
-			log.Printf("email already in use with: %s", req.Email)
-			http.Error(w, "Email already in use", http.StatusConflict)
-			return
+			h.logger.InfoContext(r.Context(), "email already in use", "email", req.Email)
+		} else {
+			h.logger.ErrorContext(r.Context(), "error creating user", "err", err)
 		}
-		log.Printf("error creating user with: %v", err)
-		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		problem.Error(w, r, err)
 		return
 	}
-	log.Printf("user creation succesfull with: %s (ID: %s)", user.Email, user.ID)
+	h.logger.InfoContext(r.Context(), "user created", "email", user.Email, "user_id", user.ID)
+	event := success(audit.EventRegister, user.ID)
+	event.Email = user.Email
+	h.record(r, event)
 
 	// Return the created user (without sensitive data)
 	response := RegisterResponse{
@@ -88,85 +107,95 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
-// LoginResponse contains the JWT token after successful login
+// LoginResponse contains the JWT token after successful login, or an MFA challenge
+// token when the user still has to verify a second factor
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token       string   `json:"token,omitempty"`
+	MFARequired bool     `json:"mfa_required,omitempty"`
+	MFAToken    string   `json:"mfa_token,omitempty"`
+	MFAMethods  []string `json:"mfa_methods,omitempty"`
 }
 
 // Login handles user login
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
-	log.Println("login request received")
+	h.logger.DebugContext(r.Context(), "login request received")
 
 	// Parse the request body
 	var req LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("login invalid request payload: %v", err)
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		h.logger.InfoContext(r.Context(), "invalid login payload", "err", err)
+		problem.Write(w, r, problem.Malformed())
 		return
 	}
 
-	log.Printf("attempting login for user: %s", req.Email)
-
-	// Get refresh TTL from env or default to 7 days
-	refreshTTLStr := os.Getenv("REFRESH_TOKEN_EXPIRES_IN")
-	if refreshTTLStr == "" {
-		refreshTTLStr = "168h"
-	}
-	refreshTTL, err := time.ParseDuration(refreshTTLStr)
-	if err != nil {
-		http.Error(w, "Invalid refresh token TTL configuration", http.StatusInternalServerError)
-		return
-	}
+	h.logger.InfoContext(r.Context(), "login attempt", "email", req.Email)
 
 	// Attempt to login and create refresh token
-	accessToken, refreshToken, err := h.authService.LoginWithRefresh(req.Email, req.Password, refreshTTL)
+	result, err := h.authService.LoginWithRefresh(r.Context(), req.Email, req.Password, h.cookies.RefreshTokenTTL, clientInfo(r))
 	if err != nil {
+		event := failure(audit.EventLogin, uuid.Nil, err)
+		event.Email = req.Email
+		h.record(r, event)
 		if errors.Is(err, auth.ErrInvalidCredentials) {
-			log.Printf("invaled creds for: %s", req.Email)
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			h.logger.InfoContext(r.Context(), "invalid credentials", "email", req.Email)
+		} else if errors.Is(err, auth.ErrEmailNotVerified) {
+			h.logger.InfoContext(r.Context(), "login blocked, email not verified", "email", req.Email)
+		} else if errors.Is(err, auth.ErrAccountLocked) {
+			h.logger.InfoContext(r.Context(), "login blocked, account locked", "email", req.Email)
 		} else {
-			log.Printf("error doing login with: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			h.logger.ErrorContext(r.Context(), "error logging in", "err", err)
 		}
+		problem.Error(w, r, err)
 		return
 	}
 
-	log.Printf("user logged in: %s", req.Email)
-
-	// Cookie settings from env
-	cookieSecure := true
-	if os.Getenv("COOKIE_SECURE") == "false" {
-		cookieSecure = false
-	}
-	cookieSameSite := http.SameSiteNoneMode
-	switch os.Getenv("COOKIE_SAMESITE") {
-	case "Lax":
-		cookieSameSite = http.SameSiteLaxMode
-	case "Strict":
-		cookieSameSite = http.SameSiteStrictMode
+	// Password was fine but a second factor is needed before any tokens are issued
+	if result.MFAToken != "" {
+		h.logger.InfoContext(r.Context(), "mfa required", "email", req.Email)
+		h.record(r, audit.Event{Type: audit.EventLogin, Outcome: audit.OutcomeMFARequired, ActorID: actor(result.UserID), Email: req.Email})
+		response := LoginResponse{MFARequired: true, MFAToken: result.MFAToken, MFAMethods: result.MFAMethods}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
 	}
 
-	cookie := &http.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		HttpOnly: true,
-		Secure:   cookieSecure,
-		SameSite: cookieSameSite,
-		Path:     "/",
-		Expires:  time.Now().Add(refreshTTL),
-	}
-	if domain := os.Getenv("COOKIE_DOMAIN"); domain != "" {
-		cookie.Domain = domain
-	}
+	h.logger.InfoContext(r.Context(), "user logged in", "email", req.Email)
+	event := success(audit.EventLogin, result.UserID)
+	event.Email = req.Email
+	h.record(r, event)
 
-	http.SetCookie(w, cookie)
+	h.setRefreshCookie(w, result.RefreshToken)
 
 	// Return access token in response body
-	response := LoginResponse{Token: accessToken}
+	response := LoginResponse{Token: result.AccessToken}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// clientInfo describes the client making the request, for the session it starts or refreshes
+func clientInfo(r *http.Request) models.ClientInfo {
+	return auth.NewClientInfo(r.UserAgent(), middleware.ClientIP(r))
+}
+
+// refreshCookie builds the refresh token cookie with the configured attributes
+func (h *AuthHandler) refreshCookie(value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     "refresh_token",
+		Value:    value,
+		HttpOnly: true,
+		Secure:   h.cookies.Secure,
+		SameSite: h.cookies.SameSite,
+		Domain:   h.cookies.Domain,
+		Path:     "/",
+		Expires:  expires,
+	}
+}
+
+// setRefreshCookie writes the refresh token cookie
+func (h *AuthHandler) setRefreshCookie(w http.ResponseWriter, refreshToken string) {
+	http.SetCookie(w, h.refreshCookie(refreshToken, time.Now().Add(h.cookies.RefreshTokenTTL)))
+}
+
 // RefreshResponse contains the new access token
 type RefreshResponse struct {
 	Token string `json:"token"`
@@ -174,65 +203,254 @@ type RefreshResponse struct {
 
 // RefreshToken handles access token refresh
 func (h *AuthHandler) RefreshToken(w http.ResponseWriter, r *http.Request) {
-	log.Println("refresh token request recieved")
+	h.logger.DebugContext(r.Context(), "refresh token request received")
 
 	// Read refresh token from cookie
 	cookie, err := r.Cookie("refresh_token")
 	if err != nil {
-		log.Println("no fresh token cookie found")
-		http.Error(w, "Refresh token required", http.StatusUnauthorized)
+		h.logger.InfoContext(r.Context(), "no refresh token cookie found")
+		problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "Refresh token required"))
 		return
 	}
 
-	// Attempt to refresh the token using the cookie
-	token, err := h.authService.RefreshAccessToken(cookie.Value)
+	// Rotate the refresh token, the cookie one is no longer usable after this
+	result, err := h.authService.RefreshAccessToken(r.Context(), cookie.Value, h.cookies.RefreshTokenTTL, clientInfo(r))
 	if err != nil {
-		if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrExpiredToken) {
-			log.Println("bad request token")
-			http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+		var reuse *auth.TokenReuseError
+		if errors.As(err, &reuse) {
+			event := failure(audit.EventTokenReuse, reuse.UserID, err)
+			event.Metadata["session_id"] = reuse.FamilyID.String()
+			h.record(r, event)
+		} else {
+			h.record(r, failure(audit.EventRefresh, uuid.Nil, err))
+		}
+		if errors.Is(err, auth.ErrTokenReused) {
+			h.logger.InfoContext(r.Context(), "refresh token reused, family revoked")
+		} else if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrExpiredToken) {
+			h.logger.InfoContext(r.Context(), "invalid refresh token")
 		} else {
-			log.Printf("error requesting token with: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			h.logger.ErrorContext(r.Context(), "error refreshing token", "err", err)
 		}
+		problem.Error(w, r, err)
 		return
 	}
 
-	log.Println("access token refreshed!")
+	h.setRefreshCookie(w, result.RefreshToken)
+
+	h.logger.InfoContext(r.Context(), "access token refreshed")
+	h.record(r, success(audit.EventRefresh, result.UserID))
 
 	// Return the new access token
-	response := RefreshResponse{Token: token}
+	response := RefreshResponse{Token: result.AccessToken}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
 // Logout handles sign out by revoking the refresh token and clearing the cookie
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
-	log.Println("logout request recieved")
+	h.logger.DebugContext(r.Context(), "logout request received")
 
-	cookie, err := r.Cookie("refresh_token")
-	if err == nil {
-		log.Println("revoking refresh token")
-		// best-effort revoke
-		_ = h.authService.RevokeRefreshToken(cookie.Value)
+	// Revoke whatever the client presented, logging out should always clear the cookie
+	refreshToken := ""
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		refreshToken = cookie.Value
 	} else {
-		log.Println("no refresh token cookie found")
+		h.logger.InfoContext(r.Context(), "no refresh token cookie found")
+	}
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	userID, err := h.authService.Logout(r.Context(), refreshToken, accessToken)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "error revoking session on logout", "err", err)
+		h.record(r, failure(audit.EventLogout, userID, err))
+	} else {
+		h.record(r, success(audit.EventLogout, userID))
 	}
 
-	log.Println("user logged out")
+	h.logger.InfoContext(r.Context(), "user logged out")
 
-	clear := &http.Cookie{
-		Name:     "refresh_token",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   os.Getenv("COOKIE_SECURE") != "false",
-		Expires:  time.Unix(0, 0),
-		MaxAge:   -1,
-		SameSite: http.SameSiteNoneMode,
-	}
-	if domain := os.Getenv("COOKIE_DOMAIN"); domain != "" {
-		clear.Domain = domain
-	}
+	// The attributes have to match the cookie's or browsers won't clear it
+	clear := h.refreshCookie("", time.Unix(0, 0))
+	clear.MaxAge = -1
 	http.SetCookie(w, clear)
 	w.WriteHeader(http.StatusOK)
 }
+
+// badToken is the problem for an emailed token that doesn't check out. It's a 400 rather
+// than the 401 FromError gives, as it has nothing to do with the caller's access token.
+func badToken(title string) *problem.Problem {
+	return problem.New(http.StatusBadRequest, problem.CodeInvalidToken, title)
+}
+
+// VerifyEmailRequest represents the email verification payload
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// VerifyEmail handles confirming an email address with the token from the verification email
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "verify email request received")
+
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"token", req.Token}) {
+		return
+	}
+
+	if err := h.authService.VerifyEmail(r.Context(), req.Token); err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			h.logger.InfoContext(r.Context(), "invalid or used verification token")
+			problem.Write(w, r, badToken("Invalid or expired verification token"))
+		} else {
+			h.logger.ErrorContext(r.Context(), "error verifying email", "err", err)
+			problem.Write(w, r, problem.Internal())
+		}
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "email verified")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResendVerificationRequest represents the resend verification payload
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// ResendVerification handles sending a new verification email.
+// It always answers 202 so it can't be used to probe for registered emails.
+func (h *AuthHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "resend verification request received")
+
+	var req ResendVerificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"email", req.Email}) {
+		return
+	}
+
+	if err := h.authService.ResendVerificationEmail(r.Context(), req.Email); err != nil {
+		h.logger.ErrorContext(r.Context(), "error resending verification", "err", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ForgotPasswordRequest represents the forgot password payload
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ForgotPassword handles requesting a password reset email.
+// It always answers 202 so it can't be used to probe for registered emails.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "forgot password request received")
+
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"email", req.Email}) {
+		return
+	}
+
+	// Recorded whether or not the account exists, the same as the response
+	event := audit.Event{Type: audit.EventPasswordResetRequest, Outcome: audit.OutcomeSuccess, Email: req.Email}
+	if err := h.authService.RequestPasswordReset(r.Context(), req.Email); err != nil {
+		h.logger.ErrorContext(r.Context(), "error requesting password reset", "err", err)
+		event = failure(audit.EventPasswordResetRequest, uuid.Nil, err)
+		event.Email = req.Email
+	}
+	h.record(r, event)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPasswordRequest represents the password reset payload
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ResetPassword handles setting a new password with the token from the reset email
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "reset password request received")
+
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"token", req.Token}, field{"password", req.Password}) {
+		return
+	}
+
+	userID, err := h.authService.ResetPassword(r.Context(), req.Token, req.Password)
+	if err != nil {
+		h.record(r, failure(audit.EventPasswordReset, userID, err))
+		if errors.Is(err, auth.ErrInvalidToken) {
+			h.logger.InfoContext(r.Context(), "invalid or used password reset token")
+			problem.Write(w, r, badToken("Invalid or expired reset token"))
+		} else {
+			h.logger.ErrorContext(r.Context(), "error resetting password", "err", err)
+			problem.Write(w, r, problem.Internal())
+		}
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "password reset")
+	h.record(r, success(audit.EventPasswordReset, userID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangePasswordRequest represents the password change payload
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword handles a signed in user replacing their password, other sessions are signed out
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "change password request received")
+
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+	sessionID, _ := middleware.GetSessionID(r)
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"current_password", req.CurrentPassword}, field{"new_password", req.NewPassword}) {
+		return
+	}
+
+	if err := h.authService.ChangePassword(r.Context(), userID, sessionID, req.CurrentPassword, req.NewPassword); err != nil {
+		h.record(r, failure(audit.EventPasswordChange, userID, err))
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			h.logger.InfoContext(r.Context(), "wrong current password", "user_id", userID)
+			// 403 rather than 401, the access token is fine and clients shouldn't try refreshing it
+			problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeInvalidCredentials, "Current password is incorrect"))
+		} else if errors.Is(err, auth.ErrAccountLocked) {
+			h.logger.InfoContext(r.Context(), "password change blocked, account locked", "user_id", userID)
+			problem.Error(w, r, err)
+		} else {
+			h.logger.ErrorContext(r.Context(), "error changing password", "err", err)
+			problem.Write(w, r, problem.Internal())
+		}
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "password changed", "user_id", userID)
+	h.record(r, success(audit.EventPasswordChange, userID))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,434 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/audit"
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/auth/authtest"
+	"github.com/pjontop/placer/backend/handlers"
+	"github.com/pjontop/placer/backend/models"
+	"github.com/pjontop/placer/backend/problem"
+	"github.com/pjontop/placer/backend/ratelimit"
+)
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{name: "new user", body: handlers.RegisterRequest{Email: "grace@example.com", Name: "Grace", Password: authtest.Password}, status: http.StatusCreated},
+		{name: "taken email", body: handlers.RegisterRequest{Email: email, Name: "Ada", Password: authtest.Password}, status: http.StatusConflict, code: problem.CodeEmailInUse},
+		{name: "missing fields", body: handlers.RegisterRequest{Email: "grace@example.com"}, status: http.StatusBadRequest, code: problem.CodeValidationFailed},
+		{name: "malformed json", body: "{", status: http.StatusBadRequest, code: problem.CodeMalformedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			s.CreateUser(t, email)
+
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/register", Body: tt.body})
+			wantStatus(t, rec, tt.status, tt.code)
+			if tt.status != http.StatusCreated {
+				return
+			}
+			var resp handlers.RegisterResponse
+			decode(t, rec, &resp)
+			if resp.Email != "grace@example.com" || resp.ID == "" {
+				t.Errorf("response = %+v, want the new user", resp)
+			}
+		})
+	}
+}
+
+func TestRegisterValidationErrors(t *testing.T) {
+	s := newServer(t)
+	rec := s.do(t, request{Method: "POST", Path: "/api/auth/register", Body: handlers.RegisterRequest{Name: "Ada"}})
+	wantStatus(t, rec, http.StatusBadRequest, "")
+
+	var p problem.Problem
+	decode(t, rec, &p)
+	fields := map[string]bool{}
+	for _, e := range p.Errors {
+		fields[e.Field] = true
+	}
+	if len(fields) != 2 || !fields["email"] || !fields["password"] {
+		t.Errorf("errors = %+v, want email and password", p.Errors)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(cfg *auth.Config)
+		verified  bool
+		body      any
+		status    int
+		code      string
+	}{
+		{name: "valid credentials", verified: true, body: handlers.LoginRequest{Email: email, Password: authtest.Password}, status: http.StatusOK},
+		{name: "wrong password", verified: true, body: handlers.LoginRequest{Email: email, Password: "wrong"}, status: http.StatusUnauthorized, code: problem.CodeInvalidCredentials},
+		{name: "unknown email", verified: true, body: handlers.LoginRequest{Email: "nobody@example.com", Password: authtest.Password}, status: http.StatusUnauthorized, code: problem.CodeInvalidCredentials},
+		{
+			name:      "unverified email",
+			configure: func(cfg *auth.Config) { cfg.RequireVerifiedEmail = true },
+			body:      handlers.LoginRequest{Email: email, Password: authtest.Password},
+			status:    http.StatusForbidden,
+			code:      problem.CodeEmailNotVerified,
+		},
+		{name: "malformed json", body: "{", status: http.StatusBadRequest, code: problem.CodeMalformedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []serverOption
+			if tt.configure != nil {
+				opts = append(opts, withAuthConfig(tt.configure))
+			}
+			s := newServer(t, opts...)
+			if tt.verified {
+				s.CreateUser(t, email)
+			} else if _, err := s.Service.Register(t.Context(), email, "Ada", authtest.Password); err != nil {
+				t.Fatalf("Register() error = %v", err)
+			}
+
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/login", Body: tt.body})
+			wantStatus(t, rec, tt.status, tt.code)
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp handlers.LoginResponse
+			decode(t, rec, &resp)
+			if resp.Token == "" || resp.MFARequired {
+				t.Errorf("response = %+v, want an access token", resp)
+			}
+			cookie := refreshCookie(t, rec)
+			if !cookie.HttpOnly || !cookie.Secure || cookie.Value == "" {
+				t.Errorf("refresh cookie = %+v, want a secure HttpOnly token", cookie)
+			}
+		})
+	}
+}
+
+func TestLoginMFARequired(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	s.EnableTOTP(t, email)
+
+	rec := s.do(t, request{Method: "POST", Path: "/api/auth/login", Body: handlers.LoginRequest{Email: email, Password: authtest.Password}})
+	wantStatus(t, rec, http.StatusOK, "")
+	var resp handlers.LoginResponse
+	decode(t, rec, &resp)
+	if !resp.MFARequired || resp.MFAToken == "" || resp.Token != "" {
+		t.Errorf("response = %+v, want only an MFA challenge", resp)
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		t.Error("refresh cookie set before the second factor")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+
+	for i := 0; i < s.Config.LockoutThreshold; i++ {
+		rec := s.do(t, request{Method: "POST", Path: "/api/auth/login", Body: handlers.LoginRequest{Email: email, Password: "wrong"}})
+		wantStatus(t, rec, http.StatusUnauthorized, problem.CodeInvalidCredentials)
+	}
+	rec := s.do(t, request{Method: "POST", Path: "/api/auth/login", Body: handlers.LoginRequest{Email: email, Password: authtest.Password}})
+	if retry, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retry < 1 {
+		t.Errorf("Retry-After = %q, want a number of seconds", rec.Header().Get("Retry-After"))
+	}
+	wantStatus(t, rec, http.StatusTooManyRequests, problem.CodeAccountLocked)
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	s := newServer(t, withLoginRate(ratelimit.Rate{Limit: 2, Period: time.Minute}))
+	s.CreateUser(t, email)
+	body := handlers.LoginRequest{Email: email, Password: authtest.Password}
+
+	for i := 0; i < 2; i++ {
+		wantStatus(t, s.do(t, request{Method: "POST", Path: "/api/auth/login", Body: body}), http.StatusOK, "")
+	}
+	rec := s.do(t, request{Method: "POST", Path: "/api/auth/login", Body: body})
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+	wantStatus(t, rec, http.StatusTooManyRequests, problem.CodeRateLimited)
+}
+
+// TestCredentialRateLimit checks every other route that takes a password, code or passkey
+// shares the per-IP login limit, so guesses can't be spread across them
+func TestCredentialRateLimit(t *testing.T) {
+	paths := []string{
+		"/api/auth/mfa/verify",
+		"/api/auth/mfa/passkey/begin",
+		"/api/auth/mfa/passkey/finish",
+		"/api/auth/passkeys/login/begin",
+		"/api/auth/passkeys/login/finish",
+		"/api/auth/password/change",
+		"/api/auth/mfa/totp/disable",
+		"/api/auth/mfa/recovery-codes",
+	}
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			s := newServer(t, withLoginRate(ratelimit.Rate{Limit: 1, Period: time.Minute}))
+			s.CreateUser(t, email)
+			login := s.Login(t, email)
+
+			body := handlers.LoginRequest{Email: email, Password: authtest.Password}
+			wantStatus(t, s.do(t, request{Method: "POST", Path: "/api/auth/login", Body: body}), http.StatusOK, "")
+			rec := s.do(t, request{Method: "POST", Path: path, Token: login.AccessToken})
+			wantStatus(t, rec, http.StatusTooManyRequests, problem.CodeRateLimited)
+		})
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie func(s *server, login *auth.LoginResult) string
+		status int
+		code   string
+	}{
+		{name: "valid cookie", cookie: func(_ *server, login *auth.LoginResult) string { return login.RefreshToken }, status: http.StatusOK},
+		{name: "no cookie", cookie: func(*server, *auth.LoginResult) string { return "" }, status: http.StatusUnauthorized, code: problem.CodeUnauthorized},
+		{name: "unknown token", cookie: func(*server, *auth.LoginResult) string { return "bogus" }, status: http.StatusUnauthorized, code: problem.CodeInvalidToken},
+		{
+			name: "reused token",
+			cookie: func(s *server, login *auth.LoginResult) string {
+				s.Service.RefreshAccessToken(context.Background(), login.RefreshToken, time.Hour, models.ClientInfo{})
+				return login.RefreshToken
+			},
+			status: http.StatusUnauthorized,
+			code:   problem.CodeInvalidToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			s.CreateUser(t, email)
+			login := s.Login(t, email)
+
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/refresh", RefreshToken: tt.cookie(s, login)})
+			wantStatus(t, rec, tt.status, tt.code)
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp handlers.RefreshResponse
+			decode(t, rec, &resp)
+			if resp.Token == "" {
+				t.Error("no access token in the response")
+			}
+			if cookie := refreshCookie(t, rec); cookie.Value == login.RefreshToken {
+				t.Error("refresh token was not rotated")
+			}
+		})
+	}
+}
+
+func TestRefreshTokenReuseIsAudited(t *testing.T) {
+	s := newServer(t)
+	user := s.CreateUser(t, email)
+	login := s.Login(t, email)
+
+	s.do(t, request{Method: "POST", Path: "/api/auth/refresh", RefreshToken: login.RefreshToken})
+	s.do(t, request{Method: "POST", Path: "/api/auth/refresh", RefreshToken: login.RefreshToken})
+
+	events, _ := s.Audit.List(t.Context(), audit.Filter{Type: audit.EventTokenReuse, Limit: 10})
+	if len(events) != 1 || events[0].ActorID == nil || *events[0].ActorID != user.ID {
+		t.Errorf("token reuse events = %+v, want one for %s", events, user.ID)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	login := s.Login(t, email)
+
+	rec := s.do(t, request{Method: "POST", Path: "/api/auth/logout", Token: login.AccessToken, RefreshToken: login.RefreshToken})
+	wantStatus(t, rec, http.StatusOK, "")
+	if cookie := refreshCookie(t, rec); cookie.MaxAge >= 0 || cookie.Value != "" {
+		t.Errorf("cookie = %+v, want it cleared", cookie)
+	}
+
+	wantStatus(t, s.do(t, request{Method: "GET", Path: "/api/profile", Token: login.AccessToken}), http.StatusUnauthorized, problem.CodeTokenRevoked)
+	wantStatus(t, s.do(t, request{Method: "POST", Path: "/api/auth/refresh", RefreshToken: login.RefreshToken}), http.StatusUnauthorized, problem.CodeInvalidToken)
+
+	// Logging out without a session still clears the cookie
+	wantStatus(t, s.do(t, request{Method: "POST", Path: "/api/auth/logout"}), http.StatusOK, "")
+}
+
+func TestVerifyEmail(t *testing.T) {
+	s := newServer(t)
+	if _, err := s.Service.Register(t.Context(), email, "Ada", authtest.Password); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	token := s.Mailbox.Token(t, email)
+
+	tests := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{name: "missing token", body: handlers.VerifyEmailRequest{}, status: http.StatusBadRequest, code: problem.CodeValidationFailed},
+		{name: "bogus token", body: handlers.VerifyEmailRequest{Token: "bogus"}, status: http.StatusBadRequest, code: problem.CodeInvalidToken},
+		{name: "emailed token", body: handlers.VerifyEmailRequest{Token: token}, status: http.StatusNoContent},
+		{name: "used token", body: handlers.VerifyEmailRequest{Token: token}, status: http.StatusBadRequest, code: problem.CodeInvalidToken},
+		{name: "malformed json", body: "{", status: http.StatusBadRequest, code: problem.CodeMalformedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/verify-email", Body: tt.body})
+			wantStatus(t, rec, tt.status, tt.code)
+		})
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+		sent   int
+	}{
+		{name: "registered email", body: handlers.ResendVerificationRequest{Email: email}, status: http.StatusAccepted, sent: 2},
+		{name: "unknown email", body: handlers.ResendVerificationRequest{Email: "nobody@example.com"}, status: http.StatusAccepted, sent: 1},
+		{name: "missing email", body: handlers.ResendVerificationRequest{}, status: http.StatusBadRequest, code: problem.CodeValidationFailed, sent: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			if _, err := s.Service.Register(t.Context(), email, "Ada", authtest.Password); err != nil {
+				t.Fatalf("Register() error = %v", err)
+			}
+
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/verify-email/resend", Body: tt.body})
+			wantStatus(t, rec, tt.status, tt.code)
+			if got := len(s.Mailbox.Messages(email)); got != tt.sent {
+				t.Errorf("%d emails sent to %s, want %d", got, email, tt.sent)
+			}
+		})
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+
+	for _, addr := range []string{email, "nobody@example.com"} {
+		rec := s.do(t, request{Method: "POST", Path: "/api/auth/password/forgot", Body: handlers.ForgotPasswordRequest{Email: addr}})
+		wantStatus(t, rec, http.StatusAccepted, "")
+	}
+	if got := len(s.Mailbox.Messages("nobody@example.com")); got != 0 {
+		t.Errorf("%d emails sent to an unknown address, want 0", got)
+	}
+	token := s.Mailbox.Token(t, email)
+
+	tests := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{name: "missing password", body: handlers.ResetPasswordRequest{Token: token}, status: http.StatusBadRequest, code: problem.CodeValidationFailed},
+		{name: "bogus token", body: handlers.ResetPasswordRequest{Token: "bogus", Password: "new password"}, status: http.StatusBadRequest, code: problem.CodeInvalidToken},
+		{name: "emailed token", body: handlers.ResetPasswordRequest{Token: token, Password: "new password"}, status: http.StatusNoContent},
+		{name: "used token", body: handlers.ResetPasswordRequest{Token: token, Password: "another password"}, status: http.StatusBadRequest, code: problem.CodeInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/password/reset", Body: tt.body})
+			wantStatus(t, rec, tt.status, tt.code)
+		})
+	}
+
+	rec := s.do(t, request{Method: "POST", Path: "/api/auth/login", Body: handlers.LoginRequest{Email: email, Password: "new password"}})
+	wantStatus(t, rec, http.StatusOK, "")
+}
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{name: "right password", body: handlers.ChangePasswordRequest{CurrentPassword: authtest.Password, NewPassword: "new password"}, status: http.StatusNoContent},
+		{name: "wrong password", body: handlers.ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "new password"}, status: http.StatusForbidden, code: problem.CodeInvalidCredentials},
+		{name: "missing fields", body: handlers.ChangePasswordRequest{}, status: http.StatusBadRequest, code: problem.CodeValidationFailed},
+		{name: "malformed json", body: "{", status: http.StatusBadRequest, code: problem.CodeMalformedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			s.CreateUser(t, email)
+			token := s.login(t, email)
+			other := s.login(t, email)
+
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/password/change", Token: token, Body: tt.body})
+			wantStatus(t, rec, tt.status, tt.code)
+			if tt.status != http.StatusNoContent {
+				return
+			}
+			wantStatus(t, s.do(t, request{Method: "GET", Path: "/api/profile", Token: token}), http.StatusOK, "")
+			wantStatus(t, s.do(t, request{Method: "GET", Path: "/api/profile", Token: other}), http.StatusUnauthorized, problem.CodeTokenRevoked)
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	s := newServer(t)
+	rec := s.do(t, request{Method: "GET", Path: "/.well-known/jwks.json"})
+	wantStatus(t, rec, http.StatusOK, "")
+
+	var jwks struct {
+		Keys []map[string]any `json:"keys"`
+	}
+	decode(t, rec, &jwks)
+	if jwks.Keys == nil {
+		t.Errorf("JWKS = %s, want a key set", rec.Body.String())
+	}
+	if rec.Header().Get("Cache-Control") == "" {
+		t.Error("JWKS response isn't cacheable")
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	s := newServer(t)
+	// Preflights carry no token, so protected routes have to answer them too
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"POST", "/api/auth/login"},
+		{"GET", "/api/profile/logins"},
+		{"DELETE", "/api/sessions/" + uuid.NewString()},
+		{"POST", "/api/sessions/revoke-all"},
+		{"POST", "/api/auth/password/change"},
+		{"GET", "/api/admin/audit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := s.do(t, request{Method: "OPTIONS", Path: tt.path, Header: http.Header{
+				"Origin":                         {frontendURL},
+				"Access-Control-Request-Method":  {tt.method},
+				"Access-Control-Request-Headers": {"authorization"},
+			}})
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != frontendURL {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, frontendURL)
+			}
+			if rec.Code >= 300 {
+				t.Errorf("preflight status = %d, want success", rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// HealthHandler serves the liveness and readiness probes
+type HealthHandler struct {
+	db       *pgxpool.Pool
+	migrator *db.Migrator
+	keys     *auth.KeySet
+	timeout  time.Duration
+	draining atomic.Bool
+	logger   *slog.Logger
+}
+
+// NewHealthHandler creates a health handler, timeout bounds all the readiness checks together
+func NewHealthHandler(database *pgxpool.Pool, migrator *db.Migrator, keys *auth.KeySet, timeout time.Duration, logger *slog.Logger) *HealthHandler {
+	return &HealthHandler{
+		db:       database,
+		migrator: migrator,
+		keys:     keys,
+		timeout:  timeout,
+		logger:   logger,
+	}
+}
+
+// CheckResult is the outcome of one readiness check
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Detail    string  `json:"detail,omitempty"`
+}
+
+// ReadinessResponse is the readiness document, Status is "ok" only if every check passed
+type ReadinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Drain makes readiness fail from now on, so load balancers stop sending traffic before
+// the server shuts down
+func (h *HealthHandler) Drain() {
+	h.draining.Store(true)
+}
+
+// Live reports that the process is up, it checks nothing else
+func (h *HealthHandler) Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Ready reports whether the instance can serve traffic: the database answers, its schema is
+// current, there's a key to sign tokens with and it isn't shutting down
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	response := ReadinessResponse{Status: "ok", Checks: map[string]CheckResult{}}
+	check := func(name string, fn func(ctx context.Context) (string, error)) {
+		start := time.Now()
+		detail, err := fn(ctx)
+		result := CheckResult{Status: "ok", Detail: detail}
+		if err != nil {
+			h.logger.WarnContext(r.Context(), "readiness check failed", "check", name, "err", err)
+			result.Status = "fail"
+			response.Status = "fail"
+		}
+		result.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+		response.Checks[name] = result
+	}
+
+	check("shutdown", h.checkShutdown)
+	check("database", h.checkDatabase)
+	check("migrations", h.checkMigrations)
+	check("signing_key", h.checkSigningKey)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// checkShutdown fails once the server has started draining
+func (h *HealthHandler) checkShutdown(ctx context.Context) (string, error) {
+	if h.draining.Load() {
+		return "shutting down", errors.New("shutting down")
+	}
+	return "", nil
+}
+
+// checkDatabase pings the database
+func (h *HealthHandler) checkDatabase(ctx context.Context) (string, error) {
+	if err := h.db.Ping(ctx); err != nil {
+		return "ping failed", err
+	}
+	return "", nil
+}
+
+// checkMigrations fails if the database is behind the migrations this binary knows about
+func (h *HealthHandler) checkMigrations(ctx context.Context) (string, error) {
+	applied, latest, err := h.migrator.Version(ctx)
+	if err != nil {
+		return "version unavailable", err
+	}
+	detail := fmt.Sprintf("version %d", applied)
+	if applied < latest {
+		return detail, fmt.Errorf("database is at migration %d, expected %d", applied, latest)
+	}
+	return detail, nil
+}
+
+// checkSigningKey reports which key signs access tokens, failing if none can
+func (h *HealthHandler) checkSigningKey(ctx context.Context) (string, error) {
+	if !h.keys.CanSign() {
+		return "no signing key", errors.New("no key to sign access tokens with")
+	}
+	if active := h.keys.Active(); active != nil {
+		return active.Algorithm + " " + active.ID, nil
+	}
+	return "HS256", nil
+}
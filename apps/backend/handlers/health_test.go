@@ -0,0 +1,23 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLive(t *testing.T) {
+	s := newServer(t)
+	s.Health.Drain()
+
+	// Draining only fails readiness, the process is still alive
+	rec := s.do(t, request{Method: "GET", Path: "/healthz"})
+	wantStatus(t, rec, http.StatusOK, "")
+	var resp map[string]string
+	decode(t, rec, &resp)
+	if resp["status"] != "ok" {
+		t.Errorf("response = %v, want status ok", resp)
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", rec.Header().Get("Cache-Control"))
+	}
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/pjontop/placer/backend/auth"
+)
+
+// JWKS serves the public keys other services use to verify our access tokens
+func (h *AuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// A rotated-in key is published for at least this long before it starts signing
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(auth.JWKSMaxAge.Seconds())))
+	json.NewEncoder(w).Encode(h.authService.JWKS())
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/pjontop/placer/backend/audit"
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/middleware"
+	"github.com/pjontop/placer/backend/problem"
+)
+
+// MFAVerifyRequest represents the second step of an MFA login
+type MFAVerifyRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// VerifyMFA handles exchanging an MFA challenge token and a TOTP or recovery code for a session
+func (h *AuthHandler) VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "mfa verify request received")
+
+	var req MFAVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"mfa_token", req.MFAToken}, field{"code", req.Code}) {
+		return
+	}
+
+	result, err := h.authService.VerifyMFA(r.Context(), req.MFAToken, req.Code, h.cookies.RefreshTokenTTL, clientInfo(r))
+	if err != nil {
+		h.record(r, failure(audit.EventMFAVerify, failedUser(err), err))
+		if errors.Is(err, auth.ErrInvalidToken) {
+			h.logger.InfoContext(r.Context(), "invalid or expired mfa challenge")
+		} else if errors.Is(err, auth.ErrInvalidMFACode) {
+			h.logger.InfoContext(r.Context(), "invalid mfa code")
+		} else {
+			h.logger.ErrorContext(r.Context(), "error verifying mfa", "err", err)
+		}
+		problem.Error(w, r, err)
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "user logged in with mfa")
+	h.record(r, success(audit.EventMFAVerify, result.UserID))
+
+	h.setRefreshCookie(w, result.RefreshToken)
+
+	response := LoginResponse{Token: result.AccessToken}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// MFAStatusResponse describes the user's second factors
+type MFAStatusResponse struct {
+	TOTPEnabled            bool `json:"totp_enabled"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// MFAStatus returns which second factors the authenticated user has enabled
+func (h *AuthHandler) MFAStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	status, err := h.authService.MFAStatus(r.Context(), userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "error loading mfa status", "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	response := MFAStatusResponse{
+		TOTPEnabled:            status.TOTPEnabled,
+		RecoveryCodesRemaining: status.RecoveryCodesRemaining,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// TOTPEnrollResponse contains what the client needs to show a QR code
+type TOTPEnrollResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"otpauth_url"`
+}
+
+// EnrollTOTP starts TOTP enrollment for the authenticated user
+func (h *AuthHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "totp enroll request received")
+
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	enrollment, err := h.authService.EnrollTOTP(r.Context(), userID)
+	if err != nil {
+		h.record(r, failure(audit.EventTOTPEnroll, userID, err))
+		if errors.Is(err, sql.ErrNoRows) {
+			problem.Write(w, r, problem.NotFound("User not found"))
+			return
+		}
+		if !errors.Is(err, auth.ErrMFAAlreadyEnabled) {
+			h.logger.ErrorContext(r.Context(), "error enrolling totp", "err", err)
+		}
+		problem.Error(w, r, err)
+		return
+	}
+
+	h.record(r, success(audit.EventTOTPEnroll, userID))
+
+	response := TOTPEnrollResponse{
+		Secret:          enrollment.Secret,
+		ProvisioningURI: enrollment.ProvisioningURI,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// MFACodeRequest carries a TOTP or recovery code
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// RecoveryCodesResponse lists freshly generated recovery codes
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// ConfirmTOTP activates TOTP for the authenticated user and returns their recovery codes
+func (h *AuthHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "totp confirm request received")
+
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"code", req.Code}) {
+		return
+	}
+
+	codes, err := h.authService.ConfirmTOTP(r.Context(), userID, req.Code)
+	if err != nil {
+		h.record(r, failure(audit.EventTOTPEnable, userID, err))
+		h.writeMFAError(w, r, err)
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "totp enabled", "user_id", userID)
+	h.record(r, success(audit.EventTOTPEnable, userID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTOTP turns TOTP off for the authenticated user
+func (h *AuthHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "totp disable request received")
+
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"code", req.Code}) {
+		return
+	}
+
+	if err := h.authService.DisableTOTP(r.Context(), userID, req.Code); err != nil {
+		h.record(r, failure(audit.EventTOTPDisable, userID, err))
+		h.writeMFAError(w, r, err)
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "totp disabled", "user_id", userID)
+	h.record(r, success(audit.EventTOTPDisable, userID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces the authenticated user's recovery codes
+func (h *AuthHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "recovery codes request received")
+
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"code", req.Code}) {
+		return
+	}
+
+	codes, err := h.authService.RegenerateRecoveryCodes(r.Context(), userID, req.Code)
+	if err != nil {
+		h.record(r, failure(audit.EventRecoveryCodes, userID, err))
+		h.writeMFAError(w, r, err)
+		return
+	}
+
+	h.record(r, success(audit.EventRecoveryCodes, userID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// writeMFAError maps MFA management errors to responses. A wrong code is a 400 here, the
+// caller is signed in and a 401 would look like their access token had expired.
+func (h *AuthHandler) writeMFAError(w http.ResponseWriter, r *http.Request, err error) {
+	p := problem.FromError(err)
+	if errors.Is(err, auth.ErrInvalidMFACode) {
+		p.Status = http.StatusBadRequest
+	} else if p.Status == http.StatusInternalServerError {
+		h.logger.ErrorContext(r.Context(), "mfa error", "err", err)
+	}
+	problem.Write(w, r, p)
+}
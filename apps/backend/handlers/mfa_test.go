@@ -0,0 +1,169 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pjontop/placer/backend/audit"
+	"github.com/pjontop/placer/backend/auth/authtest"
+	"github.com/pjontop/placer/backend/handlers"
+	"github.com/pjontop/placer/backend/models"
+	"github.com/pjontop/placer/backend/problem"
+)
+
+func TestVerifyMFA(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	secret, recoveryCodes := s.EnableTOTP(t, email)
+	challenge := func(t *testing.T) string {
+		t.Helper()
+		result, err := s.Service.LoginWithRefresh(t.Context(), email, authtest.Password, time.Hour, models.ClientInfo{})
+		if err != nil {
+			t.Fatalf("LoginWithRefresh() error = %v", err)
+		}
+		return result.MFAToken
+	}
+	nextCode := authtest.TOTPCode(t, secret, time.Now().Add(30*time.Second))
+
+	tests := []struct {
+		name    string
+		token   func(t *testing.T) string
+		code    string
+		status  int
+		errCode string
+	}{
+		{name: "missing code", token: challenge, status: http.StatusBadRequest, errCode: problem.CodeValidationFailed},
+		{name: "wrong code", token: challenge, code: "000000", status: http.StatusUnauthorized, errCode: problem.CodeInvalidMFACode},
+		{name: "bogus challenge", token: func(*testing.T) string { return "bogus" }, code: nextCode, status: http.StatusUnauthorized, errCode: problem.CodeInvalidToken},
+		{name: "totp code", token: challenge, code: nextCode, status: http.StatusOK},
+		{name: "recovery code", token: challenge, code: recoveryCodes[0], status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := handlers.MFAVerifyRequest{MFAToken: tt.token(t), Code: tt.code}
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/mfa/verify", Body: body})
+			wantStatus(t, rec, tt.status, tt.errCode)
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp handlers.LoginResponse
+			decode(t, rec, &resp)
+			if resp.Token == "" {
+				t.Errorf("response = %+v, want an access token", resp)
+			}
+			refreshCookie(t, rec)
+		})
+	}
+}
+
+func TestVerifyMFAFailureAudit(t *testing.T) {
+	s := newServer(t)
+	user := s.CreateUser(t, email)
+	s.EnableTOTP(t, email)
+	result, err := s.Service.LoginWithRefresh(t.Context(), email, authtest.Password, time.Hour, models.ClientInfo{})
+	if err != nil {
+		t.Fatalf("LoginWithRefresh() error = %v", err)
+	}
+
+	body := handlers.MFAVerifyRequest{MFAToken: result.MFAToken, Code: "000000"}
+	wantStatus(t, s.do(t, request{Method: "POST", Path: "/api/auth/mfa/verify", Body: body}), http.StatusUnauthorized, problem.CodeInvalidMFACode)
+
+	events, _ := s.Audit.List(t.Context(), audit.Filter{Type: audit.EventMFAVerify, Outcome: audit.OutcomeFailure, Limit: 10})
+	if len(events) != 1 || events[0].ActorID == nil || *events[0].ActorID != user.ID {
+		t.Errorf("failed mfa events = %+v, want one for %s", events, user.ID)
+	}
+}
+
+func TestLoginMFARequiredAudit(t *testing.T) {
+	s := newServer(t)
+	user := s.CreateUser(t, email)
+	s.EnableTOTP(t, email)
+
+	rec := s.do(t, request{Method: "POST", Path: "/api/auth/login", Body: handlers.LoginRequest{Email: email, Password: authtest.Password}})
+	wantStatus(t, rec, http.StatusOK, "")
+	var resp handlers.LoginResponse
+	decode(t, rec, &resp)
+	if !resp.MFARequired {
+		t.Fatalf("response = %+v, want an MFA challenge", resp)
+	}
+
+	events, _ := s.Audit.List(t.Context(), audit.Filter{Type: audit.EventLogin, Outcome: audit.OutcomeMFARequired, Limit: 10})
+	if len(events) != 1 || events[0].ActorID == nil || *events[0].ActorID != user.ID {
+		t.Errorf("mfa required events = %+v, want one for %s", events, user.ID)
+	}
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	token := s.login(t, email)
+
+	rec := s.do(t, request{Method: "GET", Path: "/api/auth/mfa", Token: token})
+	wantStatus(t, rec, http.StatusOK, "")
+	var status handlers.MFAStatusResponse
+	decode(t, rec, &status)
+	if status.TOTPEnabled {
+		t.Fatalf("status = %+v, want TOTP off", status)
+	}
+
+	rec = s.do(t, request{Method: "POST", Path: "/api/auth/mfa/totp/enroll", Token: token})
+	wantStatus(t, rec, http.StatusOK, "")
+	var enrollment handlers.TOTPEnrollResponse
+	decode(t, rec, &enrollment)
+	if enrollment.Secret == "" || enrollment.ProvisioningURI == "" {
+		t.Fatalf("enrollment = %+v, want a secret and otpauth URL", enrollment)
+	}
+	code := authtest.TOTPCode(t, enrollment.Secret, time.Now())
+
+	tests := []struct {
+		name    string
+		path    string
+		code    string
+		status  int
+		errCode string
+	}{
+		{name: "disable before enabled", path: "/api/auth/mfa/totp/disable", code: code, status: http.StatusConflict, errCode: problem.CodeMFANotEnabled},
+		{name: "confirm missing code", path: "/api/auth/mfa/totp/confirm", status: http.StatusBadRequest, errCode: problem.CodeValidationFailed},
+		{name: "confirm wrong code", path: "/api/auth/mfa/totp/confirm", code: "000000", status: http.StatusBadRequest, errCode: problem.CodeInvalidMFACode},
+		{name: "confirm", path: "/api/auth/mfa/totp/confirm", code: code, status: http.StatusOK},
+		{name: "enroll again", path: "/api/auth/mfa/totp/enroll", status: http.StatusConflict, errCode: problem.CodeMFAAlreadyEnabled},
+		{name: "recovery codes wrong code", path: "/api/auth/mfa/recovery-codes", code: "000000", status: http.StatusBadRequest, errCode: problem.CodeInvalidMFACode},
+		{name: "recovery codes", path: "/api/auth/mfa/recovery-codes", code: authtest.TOTPCode(t, enrollment.Secret, time.Now().Add(30*time.Second)), status: http.StatusOK},
+	}
+	var recoveryCodes []string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "POST", Path: tt.path, Token: token, Body: handlers.MFACodeRequest{Code: tt.code}})
+			wantStatus(t, rec, tt.status, tt.errCode)
+			if tt.status != http.StatusOK || tt.path == "/api/auth/mfa/totp/enroll" {
+				return
+			}
+			var resp handlers.RecoveryCodesResponse
+			decode(t, rec, &resp)
+			if len(resp.RecoveryCodes) == 0 {
+				t.Errorf("response = %+v, want recovery codes", resp)
+			}
+			recoveryCodes = resp.RecoveryCodes
+		})
+	}
+
+	rec = s.do(t, request{Method: "GET", Path: "/api/auth/mfa", Token: token})
+	decode(t, rec, &status)
+	if !status.TOTPEnabled || status.RecoveryCodesRemaining == 0 {
+		t.Errorf("status = %+v, want TOTP on with recovery codes", status)
+	}
+
+	// Both usable TOTP steps are spent, a recovery code turns it off
+	rec = s.do(t, request{Method: "POST", Path: "/api/auth/mfa/totp/disable", Token: token, Body: handlers.MFACodeRequest{Code: recoveryCodes[0]}})
+	wantStatus(t, rec, http.StatusNoContent, "")
+}
+
+func TestMFARequiresAuth(t *testing.T) {
+	s := newServer(t)
+	for _, path := range []string{"/api/auth/mfa/totp/enroll", "/api/auth/mfa/totp/confirm", "/api/auth/mfa/totp/disable", "/api/auth/mfa/recovery-codes"} {
+		t.Run(path, func(t *testing.T) {
+			wantStatus(t, s.do(t, request{Method: "POST", Path: path}), http.StatusUnauthorized, problem.CodeUnauthorized)
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pjontop/placer/backend/audit"
+	"github.com/pjontop/placer/backend/middleware"
+	"github.com/pjontop/placer/backend/problem"
+	"github.com/pjontop/placer/backend/webauthn"
+)
+
+// PasskeyBeginResponse carries the options for navigator.credentials and the ceremony ID
+// the client sends back with the authenticator's response
+type PasskeyBeginResponse struct {
+	SessionID string `json:"session_id"`
+	Options   any    `json:"options"`
+}
+
+// PasskeyFinishRequest carries the authenticator's response to a ceremony
+type PasskeyFinishRequest struct {
+	SessionID  string          `json:"session_id"`
+	MFAToken   string          `json:"mfa_token,omitempty"`
+	Name       string          `json:"name,omitempty"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+// PasskeyResponse describes a registered passkey
+type PasskeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// decodePasskeyFinish parses a finish payload and its session ID
+func decodePasskeyFinish(r *http.Request) (*PasskeyFinishRequest, uuid.UUID, bool) {
+	var req PasskeyFinishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Credential) == 0 {
+		return nil, uuid.Nil, false
+	}
+	sessionID, err := uuid.Parse(req.SessionID)
+	if err != nil {
+		return nil, uuid.Nil, false
+	}
+	return &req, sessionID, true
+}
+
+// BeginPasskeyRegistration starts registering a passkey for the authenticated user
+func (h *AuthHandler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "passkey registration begin request received")
+
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	options, sessionID, err := h.authService.BeginPasskeyRegistration(r.Context(), userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "error starting passkey registration", "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PasskeyBeginResponse{SessionID: sessionID.String(), Options: options})
+}
+
+// FinishPasskeyRegistration stores the passkey created by the authenticator
+func (h *AuthHandler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "passkey registration finish request received")
+
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	req, sessionID, ok := decodePasskeyFinish(r)
+	if !ok {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+
+	cred, err := h.authService.FinishPasskeyRegistration(r.Context(), userID, sessionID, req.Name, req.Credential)
+	if err != nil {
+		h.record(r, failure(audit.EventPasskeyAdd, userID, err))
+		h.writePasskeyError(w, r, err)
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "passkey registered", "user_id", userID)
+	event := success(audit.EventPasskeyAdd, userID)
+	event.Metadata = map[string]string{"name": cred.Name}
+	h.record(r, event)
+
+	response := PasskeyResponse{
+		ID:        base64.RawURLEncoding.EncodeToString(cred.ID),
+		Name:      cred.Name,
+		CreatedAt: cred.CreatedAt,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListPasskeys returns the authenticated user's passkeys
+func (h *AuthHandler) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	creds, err := h.authService.ListPasskeys(r.Context(), userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "error listing passkeys", "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	response := make([]PasskeyResponse, 0, len(creds))
+	for _, c := range creds {
+		response = append(response, PasskeyResponse{
+			ID:         base64.RawURLEncoding.EncodeToString(c.ID),
+			Name:       c.Name,
+			CreatedAt:  c.CreatedAt,
+			LastUsedAt: c.LastUsedAt,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeletePasskey removes one of the authenticated user's passkeys
+func (h *AuthHandler) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	credentialID, err := base64.RawURLEncoding.DecodeString(mux.Vars(r)["id"])
+	if err != nil {
+		problem.Write(w, r, problem.NotFound("Passkey not found"))
+		return
+	}
+
+	if err := h.authService.DeletePasskey(r.Context(), userID, credentialID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			problem.Write(w, r, problem.NotFound("Passkey not found"))
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "error deleting passkey", "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "passkey deleted", "user_id", userID)
+	h.record(r, success(audit.EventPasskeyRemove, userID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BeginPasskeyLogin starts a passwordless login
+func (h *AuthHandler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "passkey login begin request received")
+
+	options, sessionID, err := h.authService.BeginPasskeyLogin(r.Context())
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "error starting passkey login", "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PasskeyBeginResponse{SessionID: sessionID.String(), Options: options})
+}
+
+// FinishPasskeyLogin completes a passwordless login and issues the usual token pair
+func (h *AuthHandler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "passkey login finish request received")
+
+	req, sessionID, ok := decodePasskeyFinish(r)
+	if !ok {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+
+	result, err := h.authService.FinishPasskeyLogin(r.Context(), sessionID, req.Credential, h.cookies.RefreshTokenTTL, clientInfo(r))
+	if err != nil {
+		h.record(r, failure(audit.EventPasskeyLogin, uuid.Nil, err))
+		h.writePasskeyError(w, r, err)
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "user logged in with passkey")
+	h.record(r, success(audit.EventPasskeyLogin, result.UserID))
+
+	h.setRefreshCookie(w, result.RefreshToken)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{Token: result.AccessToken})
+}
+
+// MFAPasskeyBeginRequest starts answering an MFA challenge with a passkey
+type MFAPasskeyBeginRequest struct {
+	MFAToken string `json:"mfa_token"`
+}
+
+// BeginMFAPasskey starts a passkey assertion for the second step of a login
+func (h *AuthHandler) BeginMFAPasskey(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "mfa passkey begin request received")
+
+	var req MFAPasskeyBeginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"mfa_token", req.MFAToken}) {
+		return
+	}
+
+	options, sessionID, err := h.authService.BeginMFAPasskey(r.Context(), req.MFAToken)
+	if err != nil {
+		h.writePasskeyError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PasskeyBeginResponse{SessionID: sessionID.String(), Options: options})
+}
+
+// FinishMFAPasskey completes the second step of a login with a passkey
+func (h *AuthHandler) FinishMFAPasskey(w http.ResponseWriter, r *http.Request) {
+	h.logger.DebugContext(r.Context(), "mfa passkey finish request received")
+
+	req, sessionID, ok := decodePasskeyFinish(r)
+	if !ok {
+		problem.Write(w, r, problem.Malformed())
+		return
+	}
+	if !checkRequired(w, r, field{"mfa_token", req.MFAToken}) {
+		return
+	}
+
+	result, err := h.authService.FinishMFAPasskey(r.Context(), req.MFAToken, sessionID, req.Credential, h.cookies.RefreshTokenTTL, clientInfo(r))
+	if err != nil {
+		event := failure(audit.EventMFAVerify, failedUser(err), err)
+		event.Metadata["method"] = "passkey"
+		h.record(r, event)
+		h.writePasskeyError(w, r, err)
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "user logged in with mfa passkey")
+	event := success(audit.EventMFAVerify, result.UserID)
+	event.Metadata = map[string]string{"method": "passkey"}
+	h.record(r, event)
+
+	h.setRefreshCookie(w, result.RefreshToken)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{Token: result.AccessToken})
+}
+
+// writePasskeyError maps passkey ceremony errors to responses
+func (h *AuthHandler) writePasskeyError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, webauthn.ErrCloneDetected):
+		h.logger.InfoContext(r.Context(), "cloned passkey rejected")
+	case errors.Is(err, webauthn.ErrVerificationFailed):
+		h.logger.InfoContext(r.Context(), "passkey verification failed", "err", err)
+	}
+	p := problem.FromError(err)
+	if p.Status == http.StatusInternalServerError {
+		h.logger.ErrorContext(r.Context(), "passkey error", "err", err)
+	}
+	problem.Write(w, r, p)
+}
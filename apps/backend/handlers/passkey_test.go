@@ -0,0 +1,165 @@
+package handlers_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/auth/authtest"
+	"github.com/pjontop/placer/backend/handlers"
+	"github.com/pjontop/placer/backend/models"
+	"github.com/pjontop/placer/backend/problem"
+)
+
+// garbage stands in for an authenticator response, it parses as JSON but never verifies
+var garbage = json.RawMessage(`{"id":"x","type":"public-key"}`)
+
+// beginPasskey starts a ceremony and returns its session ID
+func beginPasskey(t *testing.T, s *server, req request) string {
+	t.Helper()
+	rec := s.do(t, req)
+	wantStatus(t, rec, http.StatusOK, "")
+	var resp handlers.PasskeyBeginResponse
+	decode(t, rec, &resp)
+	if resp.SessionID == "" || resp.Options == nil {
+		t.Fatalf("begin response = %+v, want a session and options", resp)
+	}
+	return resp.SessionID
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	token := s.login(t, email)
+	begin := request{Method: "POST", Path: "/api/auth/passkeys/register/begin", Token: token}
+
+	tests := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{name: "no credential", body: `{"session_id":"` + beginPasskey(t, s, begin) + `"}`, status: http.StatusBadRequest, code: problem.CodeMalformedRequest},
+		{name: "bad session id", body: handlers.PasskeyFinishRequest{SessionID: "bogus", Credential: garbage}, status: http.StatusBadRequest, code: problem.CodeMalformedRequest},
+		{name: "unknown session", body: handlers.PasskeyFinishRequest{SessionID: uuid.NewString(), Credential: garbage}, status: http.StatusBadRequest, code: problem.CodePasskeyExpired},
+		{name: "unverifiable credential", body: handlers.PasskeyFinishRequest{SessionID: beginPasskey(t, s, begin), Credential: garbage}, status: http.StatusUnauthorized, code: problem.CodePasskeyRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/passkeys/register/finish", Token: token, Body: tt.body})
+			wantStatus(t, rec, tt.status, tt.code)
+		})
+	}
+
+	wantStatus(t, s.do(t, request{Method: "POST", Path: "/api/auth/passkeys/register/begin"}), http.StatusUnauthorized, problem.CodeUnauthorized)
+}
+
+func TestPasskeyManagement(t *testing.T) {
+	s := newServer(t)
+	user := s.CreateUser(t, email)
+	token := s.login(t, email)
+	if err := s.WebAuthn.CreateCredential(t.Context(), &models.WebAuthnCredential{ID: []byte("key"), UserID: user.ID, Name: "Laptop"}); err != nil {
+		t.Fatalf("CreateCredential() error = %v", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString([]byte("key"))
+
+	rec := s.do(t, request{Method: "GET", Path: "/api/auth/passkeys", Token: token})
+	wantStatus(t, rec, http.StatusOK, "")
+	var passkeys []handlers.PasskeyResponse
+	decode(t, rec, &passkeys)
+	if len(passkeys) != 1 || passkeys[0].ID != id || passkeys[0].Name != "Laptop" {
+		t.Fatalf("passkeys = %+v, want the laptop", passkeys)
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		status int
+		code   string
+	}{
+		{name: "not base64", id: "!!", status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "unknown passkey", id: base64.RawURLEncoding.EncodeToString([]byte("other")), status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "own passkey", id: id, status: http.StatusNoContent},
+		{name: "already deleted", id: id, status: http.StatusNotFound, code: problem.CodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "DELETE", Path: "/api/auth/passkeys/" + tt.id, Token: token})
+			wantStatus(t, rec, tt.status, tt.code)
+		})
+	}
+
+	rec = s.do(t, request{Method: "GET", Path: "/api/auth/passkeys", Token: token})
+	decode(t, rec, &passkeys)
+	if len(passkeys) != 0 {
+		t.Errorf("passkeys = %+v, want none left", passkeys)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	s := newServer(t)
+	begin := request{Method: "POST", Path: "/api/auth/passkeys/login/begin"}
+	used := beginPasskey(t, s, begin)
+	s.do(t, request{Method: "POST", Path: "/api/auth/passkeys/login/finish", Body: handlers.PasskeyFinishRequest{SessionID: used, Credential: garbage}})
+
+	tests := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{name: "malformed json", body: "{", status: http.StatusBadRequest, code: problem.CodeMalformedRequest},
+		{name: "unverifiable credential", body: handlers.PasskeyFinishRequest{SessionID: beginPasskey(t, s, begin), Credential: garbage}, status: http.StatusUnauthorized, code: problem.CodePasskeyRejected},
+		{name: "used session", body: handlers.PasskeyFinishRequest{SessionID: used, Credential: garbage}, status: http.StatusBadRequest, code: problem.CodePasskeyExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/passkeys/login/finish", Body: tt.body})
+			wantStatus(t, rec, tt.status, tt.code)
+		})
+	}
+}
+
+func TestMFAPasskey(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	s.EnableTOTP(t, email)
+	login := s.do(t, request{Method: "POST", Path: "/api/auth/login", Body: handlers.LoginRequest{Email: email, Password: authtest.Password}})
+	var challenge handlers.LoginResponse
+	decode(t, login, &challenge)
+
+	begins := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{name: "missing challenge", body: handlers.MFAPasskeyBeginRequest{}, status: http.StatusBadRequest, code: problem.CodeValidationFailed},
+		{name: "bogus challenge", body: handlers.MFAPasskeyBeginRequest{MFAToken: "bogus"}, status: http.StatusUnauthorized, code: problem.CodeInvalidToken},
+		{name: "no passkeys", body: handlers.MFAPasskeyBeginRequest{MFAToken: challenge.MFAToken}, status: http.StatusBadRequest, code: problem.CodeNoPasskeys},
+	}
+	for _, tt := range begins {
+		t.Run("begin "+tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/mfa/passkey/begin", Body: tt.body})
+			wantStatus(t, rec, tt.status, tt.code)
+		})
+	}
+
+	finishes := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{name: "missing challenge", body: handlers.PasskeyFinishRequest{SessionID: uuid.NewString(), Credential: garbage}, status: http.StatusBadRequest, code: problem.CodeValidationFailed},
+		{name: "no credential", body: `{"session_id":"` + uuid.NewString() + `","mfa_token":"` + challenge.MFAToken + `"}`, status: http.StatusBadRequest, code: problem.CodeMalformedRequest},
+	}
+	for _, tt := range finishes {
+		t.Run("finish "+tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "POST", Path: "/api/auth/mfa/passkey/finish", Body: tt.body})
+			wantStatus(t, rec, tt.status, tt.code)
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pjontop/placer/backend/audit"
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/auth/authtest"
+	"github.com/pjontop/placer/backend/config"
+	"github.com/pjontop/placer/backend/handlers"
+	"github.com/pjontop/placer/backend/metrics"
+	"github.com/pjontop/placer/backend/middleware"
+	"github.com/pjontop/placer/backend/models"
+	"github.com/pjontop/placer/backend/problem"
+	"github.com/pjontop/placer/backend/ratelimit"
+)
+
+const (
+	email       = "ada@example.com"
+	frontendURL = "http://localhost:3000"
+)
+
+// server is the API wired up the way main does it, on in-memory stores
+type server struct {
+	*authtest.Env
+	Audit   *audit.MemoryStore
+	Health  *handlers.HealthHandler
+	handler http.Handler
+}
+
+// serverOption changes how newServer sets things up
+type serverOption func(o *serverOptions)
+
+type serverOptions struct {
+	auth      []func(cfg *auth.Config)
+	loginRate ratelimit.Rate
+	users     func(models.UserStore) models.UserStore
+}
+
+// withAuthConfig changes the AuthService settings
+func withAuthConfig(fn func(cfg *auth.Config)) serverOption {
+	return func(o *serverOptions) { o.auth = append(o.auth, fn) }
+}
+
+// withLoginRate sets the per-IP and per-email login rate limit
+func withLoginRate(rate ratelimit.Rate) serverOption {
+	return func(o *serverOptions) { o.loginRate = rate }
+}
+
+// withUserStore wraps the user store the user handler reads profiles from
+func withUserStore(wrap func(models.UserStore) models.UserStore) serverOption {
+	return func(o *serverOptions) { o.users = wrap }
+}
+
+func newServer(t *testing.T, opts ...serverOption) *server {
+	t.Helper()
+
+	o := serverOptions{loginRate: ratelimit.Rate{Limit: 1000, Period: time.Minute}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	env := authtest.New(t, o.auth...)
+	s := &server{Env: env, Audit: audit.NewMemoryStore()}
+	appMetrics := metrics.New(nil)
+	cookies := config.CookieConfig{Secure: true, SameSite: http.SameSiteNoneMode, RefreshTokenTTL: time.Hour}
+
+	authHandler := handlers.NewAuthHandler(env.Service, s.Audit, appMetrics, cookies, env.Logger)
+	var users models.UserStore = env.Users
+	if o.users != nil {
+		users = o.users(users)
+	}
+	userHandler := handlers.NewUserHandler(users, env.LoginHistory, env.Logger)
+	adminHandler := handlers.NewAdminHandler(env.Service, s.Audit, env.Logger)
+	// No database, only liveness and draining can be checked
+	s.Health = handlers.NewHealthHandler(nil, nil, nil, time.Second, env.Logger)
+
+	r := mux.NewRouter()
+	r.Use(middleware.RealIP(false), middleware.RequestID, middleware.Tracing, middleware.Logging(env.Logger),
+		middleware.Metrics(appMetrics), middleware.CORSMiddleware(frontendURL))
+
+	loginByIP := middleware.RateLimit(ratelimit.NewMemoryLimiter(o.loginRate), middleware.IPKey, env.Logger)
+	loginByEmail := middleware.RateLimit(ratelimit.NewMemoryLimiter(o.loginRate), middleware.EmailKey, env.Logger)
+
+	r.HandleFunc("/healthz", s.Health.Live).Methods("GET")
+	r.HandleFunc("/.well-known/jwks.json", authHandler.JWKS).Methods("GET")
+	r.HandleFunc("/api/auth/register", authHandler.Register).Methods("POST", "OPTIONS")
+	r.Handle("/api/auth/login", loginByIP(loginByEmail(http.HandlerFunc(authHandler.Login)))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/auth/refresh", authHandler.RefreshToken).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/auth/logout", authHandler.Logout).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/auth/verify-email", authHandler.VerifyEmail).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/auth/verify-email/resend", authHandler.ResendVerification).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/auth/password/forgot", authHandler.ForgotPassword).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/auth/password/reset", authHandler.ResetPassword).Methods("POST", "OPTIONS")
+	r.Handle("/api/auth/mfa/verify", loginByIP(http.HandlerFunc(authHandler.VerifyMFA))).Methods("POST", "OPTIONS")
+	r.Handle("/api/auth/mfa/passkey/begin", loginByIP(http.HandlerFunc(authHandler.BeginMFAPasskey))).Methods("POST", "OPTIONS")
+	r.Handle("/api/auth/mfa/passkey/finish", loginByIP(http.HandlerFunc(authHandler.FinishMFAPasskey))).Methods("POST", "OPTIONS")
+	r.Handle("/api/auth/passkeys/login/begin", loginByIP(http.HandlerFunc(authHandler.BeginPasskeyLogin))).Methods("POST", "OPTIONS")
+	r.Handle("/api/auth/passkeys/login/finish", loginByIP(http.HandlerFunc(authHandler.FinishPasskeyLogin))).Methods("POST", "OPTIONS")
+
+	protected := r.PathPrefix("/api").Subrouter()
+	protected.Use(middleware.AuthMiddleware(env.Service, appMetrics, env.Logger))
+	protected.HandleFunc("/profile", userHandler.Profile).Methods("GET", "OPTIONS")
+	protected.HandleFunc("/profile/logins", userHandler.Logins).Methods("GET", "OPTIONS")
+	protected.HandleFunc("/auth/mfa", authHandler.MFAStatus).Methods("GET", "OPTIONS")
+	protected.HandleFunc("/auth/mfa/totp/enroll", authHandler.EnrollTOTP).Methods("POST", "OPTIONS")
+	protected.HandleFunc("/auth/mfa/totp/confirm", authHandler.ConfirmTOTP).Methods("POST", "OPTIONS")
+	protected.Handle("/auth/mfa/totp/disable", loginByIP(http.HandlerFunc(authHandler.DisableTOTP))).Methods("POST", "OPTIONS")
+	protected.Handle("/auth/mfa/recovery-codes", loginByIP(http.HandlerFunc(authHandler.RegenerateRecoveryCodes))).Methods("POST", "OPTIONS")
+	protected.HandleFunc("/auth/passkeys", authHandler.ListPasskeys).Methods("GET", "OPTIONS")
+	protected.HandleFunc("/auth/passkeys/register/begin", authHandler.BeginPasskeyRegistration).Methods("POST", "OPTIONS")
+	protected.HandleFunc("/auth/passkeys/register/finish", authHandler.FinishPasskeyRegistration).Methods("POST", "OPTIONS")
+	protected.HandleFunc("/auth/passkeys/{id}", authHandler.DeletePasskey).Methods("DELETE", "OPTIONS")
+	protected.HandleFunc("/sessions", authHandler.ListSessions).Methods("GET", "OPTIONS")
+	protected.HandleFunc("/sessions/revoke-all", authHandler.RevokeOtherSessions).Methods("POST", "OPTIONS")
+	protected.HandleFunc("/sessions/{id}", authHandler.RevokeSession).Methods("DELETE", "OPTIONS")
+	protected.Handle("/auth/password/change", loginByIP(http.HandlerFunc(authHandler.ChangePassword))).Methods("POST", "OPTIONS")
+
+	admin := protected.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.RequireRole(models.RoleAdmin, env.Logger))
+	admin.HandleFunc("/users/{id}/revoke-sessions", adminHandler.RevokeUserSessions).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/audit", adminHandler.ListAudit).Methods("GET", "OPTIONS")
+
+	s.handler = r
+	return s
+}
+
+// request describes a call to the API, only Method and Path are needed
+type request struct {
+	Method string
+	Path   string
+	// Body is encoded as JSON unless it's a string, which is sent as is
+	Body         any
+	Token        string
+	RefreshToken string
+	Header       http.Header
+}
+
+// do sends a request through the router and returns the recorded response
+func (s *server) do(t *testing.T, req request) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	switch b := req.Body.(type) {
+	case nil:
+	case string:
+		body.WriteString(b)
+	default:
+		if err := json.NewEncoder(&body).Encode(b); err != nil {
+			t.Fatalf("encode body: %v", err)
+		}
+	}
+
+	r := httptest.NewRequest(req.Method, req.Path, &body)
+	r.RemoteAddr = "192.0.2.1:1234"
+	if req.Body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if req.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+req.Token)
+	}
+	if req.RefreshToken != "" {
+		r.AddCookie(&http.Cookie{Name: "refresh_token", Value: req.RefreshToken})
+	}
+	for name, values := range req.Header {
+		r.Header[name] = values
+	}
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, r)
+	return rec
+}
+
+// login logs a user in through the service and returns their access token
+func (s *server) login(t *testing.T, email string) string {
+	t.Helper()
+	return s.Login(t, email).AccessToken
+}
+
+// admin creates a user with the admin role and returns their access token
+func (s *server) admin(t *testing.T, email string) string {
+	t.Helper()
+	s.CreateUser(t, email)
+	if err := s.Users.SetRole(t.Context(), email, models.RoleAdmin); err != nil {
+		t.Fatalf("make %s an admin: %v", email, err)
+	}
+	return s.login(t, email)
+}
+
+// decode reads a JSON response body into v
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+	}
+}
+
+// wantStatus checks the status of a response. When code is set the body has to be a
+// problem with that code.
+func wantStatus(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d, body %s", rec.Code, status, rec.Body.String())
+	}
+	if code == "" {
+		return
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != problem.ContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, problem.ContentType)
+	}
+	var p problem.Problem
+	decode(t, rec, &p)
+	if p.Code != code || p.Status != status {
+		t.Errorf("problem = %+v, want code %q and status %d", p, code, status)
+	}
+	if p.RequestID == "" || p.RequestID != rec.Header().Get("X-Request-ID") {
+		t.Errorf("problem request id = %q, want the X-Request-ID header %q", p.RequestID, rec.Header().Get("X-Request-ID"))
+	}
+}
+
+// refreshCookie returns the refresh token cookie a response set, failing if there isn't one
+func refreshCookie(t *testing.T, rec *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "refresh_token" {
+			return c
+		}
+	}
+	t.Fatal("no refresh_token cookie set")
+	return nil
+}
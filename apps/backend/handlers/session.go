@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pjontop/placer/backend/audit"
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/middleware"
+	"github.com/pjontop/placer/backend/problem"
+)
+
+// SessionResponse describes one of the user's signed in devices
+type SessionResponse struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// RevokeSessionsResponse reports how many sessions were ended
+type RevokeSessionsResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// ListSessions returns the authenticated user's active sessions
+func (h *AuthHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+	currentID, _ := middleware.GetSessionID(r)
+
+	sessions, err := h.authService.ListSessions(r.Context(), userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "error listing sessions", "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	response := make([]SessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		response = append(response, SessionResponse{
+			ID:         s.ID.String(),
+			Device:     s.Client.DeviceLabel,
+			UserAgent:  s.Client.UserAgent,
+			IPAddress:  s.Client.IPAddress,
+			CreatedAt:  s.CreatedAt,
+			LastUsedAt: s.LastUsedAt,
+			ExpiresAt:  s.ExpiresAt,
+			Current:    s.ID == currentID,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RevokeSession signs one of the authenticated user's devices out
+func (h *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	sessionID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		problem.Write(w, r, problem.NotFound("Session not found"))
+		return
+	}
+
+	if err := h.authService.RevokeSession(r.Context(), userID, sessionID); err != nil {
+		if errors.Is(err, auth.ErrSessionNotFound) {
+			problem.Write(w, r, problem.NotFound("Session not found"))
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "error revoking session", "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "session revoked", "session_id", sessionID, "user_id", userID)
+	event := success(audit.EventSessionRevoke, userID)
+	event.Metadata = map[string]string{"session_id": sessionID.String()}
+	h.record(r, event)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeOtherSessions signs the authenticated user out everywhere except this device
+func (h *AuthHandler) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+	currentID, ok := middleware.GetSessionID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	count, err := h.authService.RevokeOtherSessions(r.Context(), userID, currentID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "error revoking sessions", "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "other sessions revoked", "count", count, "user_id", userID)
+	event := success(audit.EventSessionRevoke, userID)
+	event.Metadata = map[string]string{"scope": "others", "count": strconv.Itoa(count)}
+	h.record(r, event)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RevokeSessionsResponse{Revoked: count})
+}
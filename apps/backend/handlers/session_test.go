@@ -0,0 +1,95 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/handlers"
+	"github.com/pjontop/placer/backend/problem"
+)
+
+func TestListSessions(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	s.login(t, email)
+	token := s.login(t, email)
+
+	rec := s.do(t, request{Method: "GET", Path: "/api/sessions", Token: token})
+	wantStatus(t, rec, http.StatusOK, "")
+	var sessions []handlers.SessionResponse
+	decode(t, rec, &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+	current := 0
+	for _, session := range sessions {
+		if session.Current {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Errorf("%d sessions marked current, want 1", current)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	s.CreateUser(t, "grace@example.com")
+	token := s.login(t, email)
+	other := s.Login(t, email)
+	theirs := s.Login(t, "grace@example.com")
+
+	tests := []struct {
+		name   string
+		id     string
+		status int
+		code   string
+	}{
+		{name: "not a session id", id: "bogus", status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "unknown session", id: uuid.NewString(), status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "someone else's session", id: sessionOf(t, s, theirs.AccessToken), status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "own session", id: sessionOf(t, s, other.AccessToken), status: http.StatusNoContent},
+		{name: "already revoked", id: sessionOf(t, s, other.AccessToken), status: http.StatusNotFound, code: problem.CodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "DELETE", Path: "/api/sessions/" + tt.id, Token: token})
+			wantStatus(t, rec, tt.status, tt.code)
+		})
+	}
+
+	wantStatus(t, s.do(t, request{Method: "GET", Path: "/api/profile", Token: other.AccessToken}), http.StatusUnauthorized, problem.CodeTokenRevoked)
+	wantStatus(t, s.do(t, request{Method: "GET", Path: "/api/profile", Token: theirs.AccessToken}), http.StatusOK, "")
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	token := s.login(t, email)
+	others := []string{s.login(t, email), s.login(t, email)}
+
+	rec := s.do(t, request{Method: "POST", Path: "/api/sessions/revoke-all", Token: token})
+	wantStatus(t, rec, http.StatusOK, "")
+	var resp handlers.RevokeSessionsResponse
+	decode(t, rec, &resp)
+	if resp.Revoked != 2 {
+		t.Errorf("revoked %d sessions, want 2", resp.Revoked)
+	}
+
+	wantStatus(t, s.do(t, request{Method: "GET", Path: "/api/profile", Token: token}), http.StatusOK, "")
+	for _, other := range others {
+		wantStatus(t, s.do(t, request{Method: "GET", Path: "/api/profile", Token: other}), http.StatusUnauthorized, problem.CodeTokenRevoked)
+	}
+}
+
+// sessionOf returns the session ID an access token was issued for
+func sessionOf(t *testing.T, s *server, token string) string {
+	t.Helper()
+	claims, err := s.Service.ValidateToken(t.Context(), token)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	return claims.Session().String()
+}
@@ -1,64 +1,137 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/pjontop/placer/backend/middleware"
 	"github.com/pjontop/placer/backend/models"
+	"github.com/pjontop/placer/backend/problem"
+)
+
+// Page sizes for the login history listing
+const (
+	defaultLoginPageSize = 20
+	maxLoginPageSize     = 100
 )
 
 // UserHandler contains HTTP handlers for user-related endpoints
 type UserHandler struct {
-	userRepo *models.UserRepository
+	userRepo     models.UserStore
+	loginHistory models.LoginHistoryStore
+	logger       *slog.Logger
 }
 
 // NewUserHandler creates a new user handler
-func NewUserHandler(userRepo *models.UserRepository) *UserHandler {
+func NewUserHandler(userRepo models.UserStore, loginHistory models.LoginHistoryStore, logger *slog.Logger) *UserHandler {
 	return &UserHandler{
-		userRepo: userRepo,
+		userRepo:     userRepo,
+		loginHistory: loginHistory,
+		logger:       logger,
 	}
 }
 
 // UserResponse represents the user data returned to clients
 type UserResponse struct {
-	ID    string `json:"id"`
-	Email string `json:"email"`
-	Name  string `json:"name"`
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastLogin *time.Time `json:"last_login"`
+}
+
+// LoginRecordResponse describes one login attempt against the user's account
+type LoginRecordResponse struct {
+	Method    string    `json:"method"`
+	Outcome   string    `json:"outcome"`
+	IPAddress string    `json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 // Profile returns the authenticated user's profile
 func (h *UserHandler) Profile(w http.ResponseWriter, r *http.Request) {
-	log.Println("profile request received")
+	h.logger.DebugContext(r.Context(), "profile request received")
 
 	// Get user ID from request context (set by auth middleware)
 	userID, ok := middleware.GetUserID(r)
 	if !ok {
-		log.Println("no userid in context")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		h.logger.InfoContext(r.Context(), "no user id in context")
+		problem.Write(w, r, problem.Unauthorized())
 		return
 	}
 
-	log.Printf("fetching profile for: %s", userID)
+	h.logger.DebugContext(r.Context(), "fetching profile", "user_id", userID)
 
 	// Get user from database
-	user, err := h.userRepo.GetUserByID(userID)
+	user, err := h.userRepo.GetUserByID(r.Context(), userID)
 	if err != nil {
-		log.Printf("user not found: %v", err)
-		http.Error(w, "User not found", http.StatusNotFound)
+		if errors.Is(err, sql.ErrNoRows) {
+			h.logger.InfoContext(r.Context(), "user not found", "user_id", userID)
+			problem.Write(w, r, problem.NotFound("User not found"))
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "error fetching profile", "err", err)
+		problem.Error(w, r, err)
 		return
 	}
 
-	log.Printf("profile fetched for: %s", user.Email)
+	h.logger.InfoContext(r.Context(), "profile fetched", "email", user.Email)
 
 	// Return user profile (excluding sensitive data)
 	response := UserResponse{
-		ID:    user.ID.String(),
-		Email: user.Email,
-		Name:  user.Name,
+		ID:        user.ID.String(),
+		Email:     user.Email,
+		Name:      user.Name,
+		CreatedAt: user.CreatedAt,
+		LastLogin: user.LastLogin,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Logins returns the authenticated user's most recent login attempts, newest first. The
+// limit query parameter sets how many.
+func (h *UserHandler) Logins(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		problem.Write(w, r, problem.Unauthorized())
+		return
+	}
+
+	limit := defaultLoginPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLoginPageSize {
+			problem.Write(w, r, problem.Invalid(problem.InvalidField("limit", "must be between 1 and "+strconv.Itoa(maxLoginPageSize))))
+			return
+		}
+		limit = n
 	}
 
+	records, err := h.loginHistory.ListLogins(r.Context(), userID, limit)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "error listing logins", "err", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	response := make([]LoginRecordResponse, 0, len(records))
+	for _, record := range records {
+		response = append(response, LoginRecordResponse{
+			Method:    record.Method,
+			Outcome:   record.Outcome,
+			IPAddress: record.IPAddress,
+			UserAgent: record.UserAgent,
+			CreatedAt: record.CreatedAt,
+		})
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,135 @@
+package handlers_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/handlers"
+	"github.com/pjontop/placer/backend/models"
+	"github.com/pjontop/placer/backend/problem"
+)
+
+func TestProfile(t *testing.T) {
+	s := newServer(t)
+	user := s.CreateUser(t, email)
+	token := s.login(t, email)
+
+	expired := newServer(t, withAuthConfig(func(cfg *auth.Config) { cfg.AccessTokenTTL = -time.Minute }))
+	expired.CreateUser(t, email)
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+		code   string
+	}{
+		{name: "valid token", header: "Bearer " + token, status: http.StatusOK},
+		{name: "no header", status: http.StatusUnauthorized, code: problem.CodeUnauthorized},
+		{name: "not a bearer token", header: "Basic " + token, status: http.StatusUnauthorized, code: problem.CodeUnauthorized},
+		{name: "garbage token", header: "Bearer not.a.jwt", status: http.StatusUnauthorized, code: problem.CodeInvalidToken},
+		{name: "expired token", header: "Bearer " + expired.login(t, email), status: http.StatusUnauthorized, code: problem.CodeTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := request{Method: "GET", Path: "/api/profile"}
+			if tt.header != "" {
+				req.Header = http.Header{"Authorization": {tt.header}}
+			}
+			rec := s.do(t, req)
+			wantStatus(t, rec, tt.status, tt.code)
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp handlers.UserResponse
+			decode(t, rec, &resp)
+			if resp.ID != user.ID.String() || resp.Email != email {
+				t.Errorf("profile = %+v, want %s", resp, email)
+			}
+			if resp.CreatedAt.IsZero() || resp.LastLogin == nil {
+				t.Errorf("profile created at %v, last login %v, want both set", resp.CreatedAt, resp.LastLogin)
+			}
+		})
+	}
+}
+
+// failingUsers fails every profile lookup with err
+type failingUsers struct {
+	models.UserStore
+	err error
+}
+
+func (f failingUsers) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return nil, f.err
+}
+
+func TestProfileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{name: "user gone", err: sql.ErrNoRows, status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "database down", err: errors.New("connection refused"), status: http.StatusInternalServerError, code: problem.CodeInternal},
+		{name: "query timeout", err: context.DeadlineExceeded, status: http.StatusInternalServerError, code: problem.CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t, withUserStore(func(users models.UserStore) models.UserStore {
+				return failingUsers{UserStore: users, err: tt.err}
+			}))
+			s.CreateUser(t, email)
+			rec := s.do(t, request{Method: "GET", Path: "/api/profile", Token: s.login(t, email)})
+			wantStatus(t, rec, tt.status, tt.code)
+		})
+	}
+}
+
+func TestProfileLogins(t *testing.T) {
+	s := newServer(t)
+	s.CreateUser(t, email)
+	s.CreateUser(t, "grace@example.com")
+	s.login(t, email)
+	s.login(t, "grace@example.com")
+	token := s.login(t, email)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		code   string
+		want   int
+	}{
+		{name: "default limit", status: http.StatusOK, want: 2},
+		{name: "limit", query: "?limit=1", status: http.StatusOK, want: 1},
+		{name: "limit too large", query: "?limit=1000", status: http.StatusBadRequest, code: problem.CodeValidationFailed},
+		{name: "limit not a number", query: "?limit=ten", status: http.StatusBadRequest, code: problem.CodeValidationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(t, request{Method: "GET", Path: "/api/profile/logins" + tt.query, Token: token})
+			wantStatus(t, rec, tt.status, tt.code)
+			if tt.status != http.StatusOK {
+				return
+			}
+			var logins []handlers.LoginRecordResponse
+			decode(t, rec, &logins)
+			if len(logins) != tt.want {
+				t.Fatalf("got %d logins, want %d: %+v", len(logins), tt.want, logins)
+			}
+			for _, login := range logins {
+				if login.Method != models.LoginMethodPassword || login.Outcome != models.LoginOutcomeSuccess || login.CreatedAt.IsZero() {
+					t.Errorf("login = %+v, want a successful password login", login)
+				}
+			}
+		})
+	}
+
+	wantStatus(t, s.do(t, request{Method: "GET", Path: "/api/profile/logins"}), http.StatusUnauthorized, problem.CodeUnauthorized)
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/pjontop/placer/backend/problem"
+)
+
+// field is a request body field that has to be set
+type field struct {
+	name  string
+	value string
+}
+
+// checkRequired writes a validation problem naming every empty field, returning false if
+// there were any
+func checkRequired(w http.ResponseWriter, r *http.Request, fields ...field) bool {
+	var missing []problem.FieldError
+	for _, f := range fields {
+		if f.value == "" {
+			missing = append(missing, problem.Required(f.name))
+		}
+	}
+	if len(missing) > 0 {
+		problem.Write(w, r, problem.Invalid(missing...))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pjontop/placer/backend/config"
+)
+
+// runKeys handles the keys subcommand, which creates signing keys for rotation
+func runKeys(args []string) {
+	if len(args) == 0 || args[0] != "generate" {
+		log.Fatal("usage: backend keys generate [-alg EdDSA|RS256] [-dir keys]")
+	}
+
+	keysDir, err := config.LoadKeysDir()
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+
+	fs := flag.NewFlagSet("keys generate", flag.ExitOnError)
+	alg := fs.String("alg", "EdDSA", "signing algorithm, EdDSA or RS256")
+	dir := fs.String("dir", keysDir, "directory to write the key to")
+	fs.Parse(args[1:])
+
+	var signer crypto.Signer
+	switch *alg {
+	case "EdDSA":
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case "RS256":
+		signer, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		log.Fatalf("unsupported algorithm %q", *alg)
+	}
+	if err != nil {
+		log.Fatalf("failed to generate key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		log.Fatalf("failed to encode key: %v", err)
+	}
+
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		log.Fatalf("failed to create %s: %v", *dir, err)
+	}
+	// Date-prefixed kids sort in creation order, which is how the newest key becomes active
+	kid := time.Now().UTC().Format("20060102-150405")
+	path := filepath.Join(*dir, kid+".pem")
+	// O_EXCL so a second key generated in the same second can't overwrite the first
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		log.Fatalf("failed to create key file: %v", err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		log.Fatalf("failed to write key: %v", err)
+	}
+	fmt.Println(path)
+}
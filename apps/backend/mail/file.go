@@ -0,0 +1,30 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileSender writes each email to its own .eml file in a directory, for local development
+type FileSender struct {
+	dir  string
+	from string
+}
+
+// NewFileSender creates a sender that drops emails into dir, creating it if needed
+func NewFileSender(dir, from string) (*FileSender, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileSender{dir: dir, from: from}, nil
+}
+
+// Send writes the message to a new file
+func (s *FileSender) Send(msg Message) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), uuid.NewString())
+	return os.WriteFile(filepath.Join(s.dir, name), formatMessage(s.from, msg), 0o644)
+}
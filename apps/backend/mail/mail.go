@@ -0,0 +1,31 @@
+package mail
+
+import (
+	"log/slog"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers emails, swap implementations per environment
+type Sender interface {
+	Send(msg Message) error
+}
+
+// LogSender writes emails to the log instead of delivering them, for local development
+type LogSender struct{}
+
+// NewLogSender creates a sender that only logs
+func NewLogSender() *LogSender {
+	return &LogSender{}
+}
+
+// Send logs the message
+func (s *LogSender) Send(msg Message) error {
+	slog.Info("email logged", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
@@ -1,91 +1,323 @@
 package main
 
 import (
+	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/audit"
 	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/config"
 	"github.com/pjontop/placer/backend/db"
 	"github.com/pjontop/placer/backend/handlers"
+	"github.com/pjontop/placer/backend/logging"
+	"github.com/pjontop/placer/backend/mail"
+	"github.com/pjontop/placer/backend/metrics"
 	"github.com/pjontop/placer/backend/middleware"
 	"github.com/pjontop/placer/backend/models"
+	"github.com/pjontop/placer/backend/ratelimit"
+	"github.com/pjontop/placer/backend/revocation"
+	"github.com/pjontop/placer/backend/tracing"
+	"github.com/pjontop/placer/backend/webauthn"
 )
 
-// loadEnv loads environment variables from .env file
-func loadEnv() {
-	// Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using environment variables")
+// loadConfig loads the configuration, exiting with every problem listed if it's invalid
+func loadConfig() *config.Config {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	return cfg
+}
+
+// newLogger builds the application logger, logging JSON in production
+func newLogger(cfg config.LogConfig) *slog.Logger {
+	logger, err := logging.New(os.Stdout, cfg.Format, cfg.Level)
+	if err != nil {
+		log.Fatalf("failed to configure logging: %v", err)
 	}
+	return logger
+}
 
-	// Check required variables
-	requiredVars := []string{"DATABASE_URL", "JWT_SECRET", "FRONTEND_URL"}
-	for _, v := range requiredVars {
-		if os.Getenv(v) == "" {
-			log.Fatalf("Required environment variable %s is not set", v)
+// newMailer builds the configured email sender
+func newMailer(cfg config.MailConfig) mail.Sender {
+	switch cfg.Sender {
+	case "file":
+		sender, err := mail.NewFileSender(cfg.FileDir, cfg.From)
+		if err != nil {
+			log.Fatalf("failed to create file mailer: %v", err)
 		}
+		return sender
+	case "smtp":
+		sender, err := mail.NewSMTPSender(cfg.SMTPAddr, cfg.SMTPUsername, cfg.SMTPPassword, cfg.From)
+		if err != nil {
+			log.Fatalf("failed to create smtp mailer: %v", err)
+		}
+		return sender
+	default:
+		return mail.NewLogSender()
 	}
 }
 
+// loadKeySet loads the access token signing keys, falling back to HS256 with the JWT secret
+func loadKeySet(cfg config.JWTConfig) *auth.KeySet {
+	keys, err := auth.LoadKeySet(cfg.KeysDir, cfg.ActiveKID)
+	if err != nil {
+		log.Fatalf("failed to load signing keys: %v", err)
+	}
+	keys.WithHS256(cfg.Secret, cfg.HS256AcceptUntil)
+
+	if active := keys.Active(); active != nil {
+		slog.Info("signing access tokens", "alg", active.Algorithm, "kid", active.ID)
+	} else {
+		slog.Warn("no signing keys found, signing access tokens with HS256")
+	}
+	return keys
+}
+
+// newRevocationStore builds the configured access token denylist
+func newRevocationStore(database *pgxpool.Pool, timeouts db.Timeouts, cfg config.RevocationConfig) revocation.Store {
+	if cfg.Store == "memory" {
+		return revocation.NewMemoryStore(cfg.MemorySize)
+	}
+	return revocation.NewPostgresStore(database, timeouts)
+}
+
+// newLoginLimiter builds a rate limiter for login attempts in the configured store, along
+// with the function that stops its pruner
+func newLoginLimiter(database *pgxpool.Pool, timeouts db.Timeouts, store, name string, rate ratelimit.Rate) (ratelimit.Limiter, func()) {
+	var limiter ratelimit.Limiter = ratelimit.NewMemoryLimiter(rate)
+	if store == "postgres" {
+		limiter = ratelimit.NewPostgresLimiter(database, timeouts, name, rate)
+	}
+	return limiter, ratelimit.StartPruner(limiter, rate.Period)
+}
+
 func main() {
-	log.Println("starting backend")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "keys":
+			runKeys(os.Args[2:])
+			return
+		case "users":
+			runUsers(os.Args[2:])
+			return
+		}
+	}
 
-	// Load environment variables
-	loadEnv()
-	log.Println("vars loaded")
+	cfg := loadConfig()
+	logger := newLogger(cfg.Log)
+	slog.SetDefault(logger)
+	logger.Info("starting backend", "config", cfg)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Exporter, cfg.Tracing.ServiceName)
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
 
 	// Connect to the database
-	log.Println("connecting to db")
-	database, err := db.Connect(os.Getenv("DATABASE_URL"))
+	logger.Info("connecting to db")
+	database, err := db.Connect(context.Background(), cfg.DatabaseURL, cfg.DB.Pool)
 	if err != nil {
 		log.Fatalf("failed db connection with: %v", err)
 	}
-	log.Println("db connected")
+	logger.Info("db connected")
+
+	migrator, err := db.NewMigrator(database)
+	if err != nil {
+		log.Fatalf("failed to load migrations: %v", err)
+	}
+	// Bring the schema up to date unless migrations are run as a separate step
+	if cfg.AutoMigrate {
+		count, err := migrator.Up(context.Background())
+		if err != nil {
+			log.Fatalf("failed to migrate db: %v", err)
+		}
+		logger.Info("db migrated", "applied", count)
+	}
+
+	appMetrics := metrics.New(database)
 
 	r := mux.NewRouter()
 
-	frontendURL := os.Getenv("FRONTEND_URL")
-	log.Printf("configuring cors for: %s", frontendURL)
-	r.Use(middleware.CORSMiddleware(frontendURL))
+	logger.Info("configuring cors", "origin", cfg.FrontendURL)
+	r.Use(middleware.RealIP(cfg.TrustProxy), middleware.RequestID, middleware.Tracing, middleware.Logging(logger), middleware.Metrics(appMetrics), middleware.CORSMiddleware(cfg.FrontendURL))
 
-	log.Println("creating repo's")
-	userRepo := models.NewUserRepository(database)
-	refreshTokenRepo := models.NewRefreshTokenRepository(database)
+	logger.Info("creating repos")
+	userRepo := models.NewUserRepository(database, cfg.DB.Timeouts)
+	refreshTokenRepo := models.NewRefreshTokenRepository(database, cfg.DB.Timeouts)
+	userTokenRepo := models.NewUserTokenRepository(database, cfg.DB.Timeouts)
+	mfaRepo := models.NewMFARepository(database, cfg.DB.Timeouts)
+	webAuthnRepo := models.NewWebAuthnRepository(database, cfg.DB.Timeouts)
+	loginHistoryRepo := models.NewLoginHistoryRepository(database, cfg.DB.Timeouts)
+	txManager := models.NewTxManager(database, cfg.DB.Timeouts)
 
-	log.Println("starting services")
-	authService := auth.NewAuthService(userRepo, refreshTokenRepo, os.Getenv("JWT_SECRET"), 15*time.Minute)
+	logger.Info("starting services")
+	keys := loadKeySet(cfg.JWT)
+	revoked := newRevocationStore(database, cfg.DB.Timeouts, cfg.Revocation)
+	stopRevocationPruner := revocation.StartPruner(revoked, cfg.Revocation.PruneInterval)
+	passkeys, err := webauthn.NewService(userRepo, webAuthnRepo, webauthn.Config{
+		RPID:          cfg.WebAuthn.RPID,
+		RPDisplayName: cfg.WebAuthn.RPName,
+		RPOrigins:     cfg.WebAuthn.RPOrigins,
+		SessionTTL:    cfg.WebAuthn.SessionTTL,
+	}, logger)
+	if err != nil {
+		log.Fatalf("failed to configure webauthn: %v", err)
+	}
+	authService, err := auth.NewAuthService(userRepo, refreshTokenRepo, userTokenRepo, mfaRepo, txManager, passkeys, keys, revoked, newMailer(cfg.Mail), auth.Config{
+		JWTSecret:            cfg.JWT.Secret,
+		AccessTokenTTL:       cfg.JWT.AccessTokenTTL,
+		Issuer:               cfg.JWT.Issuer,
+		Audience:             cfg.JWT.Audience,
+		Leeway:               cfg.JWT.Leeway,
+		AppURL:               cfg.FrontendURL,
+		RequireVerifiedEmail: cfg.Email.RequireVerification,
+		VerificationTokenTTL: cfg.Email.VerificationTTL,
+		PasswordResetTTL:     cfg.Email.PasswordResetTTL,
+		EmailCooldown:        cfg.Email.Cooldown,
+		EmailMaxPerHour:      cfg.Email.MaxPerHour,
+		MFAIssuer:            cfg.MFA.Issuer,
+		MFAEncryptionKey:     cfg.MFA.EncryptionKey,
+		MFAChallengeTTL:      cfg.MFA.ChallengeTTL,
+		LockoutThreshold:     cfg.Login.LockoutThreshold,
+		LockoutBase:          cfg.Login.LockoutBase,
+		LockoutMax:           cfg.Login.LockoutMax,
+	}, logger)
+	if err != nil {
+		log.Fatalf("failed to start auth service: %v", err)
+	}
 
-	log.Println("starting handlers")
-	authHandler := handlers.NewAuthHandler(authService)
-	userHandler := handlers.NewUserHandler(userRepo)
+	logger.Info("starting handlers")
+	auditLog := audit.NewLogger(database, cfg.DB.Timeouts)
+	authHandler := handlers.NewAuthHandler(authService, auditLog, appMetrics, cfg.Cookie, logger)
+	userHandler := handlers.NewUserHandler(userRepo, loginHistoryRepo, logger)
+	healthHandler := handlers.NewHealthHandler(database, migrator, keys, cfg.HTTP.ReadinessTimeout, logger)
+	adminHandler := handlers.NewAdminHandler(authService, auditLog, logger)
 
-	log.Println("configuring public routes")
+	logger.Info("configuring public routes")
+	r.HandleFunc("/healthz", healthHandler.Live).Methods("GET")
+	logger.Debug("route registered", "method", "GET", "path", "/healthz")
+	r.HandleFunc("/readyz", healthHandler.Ready).Methods("GET")
+	logger.Debug("route registered", "method", "GET", "path", "/readyz")
+	r.HandleFunc("/.well-known/jwks.json", authHandler.JWKS).Methods("GET")
+	logger.Debug("route registered", "method", "GET", "path", "/.well-known/jwks.json")
 	r.HandleFunc("/api/auth/register", authHandler.Register).Methods("POST", "OPTIONS")
-	log.Println("  - POST /api/auth/register")
-	r.HandleFunc("/api/auth/login", authHandler.Login).Methods("POST", "OPTIONS")
-	log.Println("  - POST /api/auth/login")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/register")
+	ipLimiter, stopIPPruner := newLoginLimiter(database, cfg.DB.Timeouts, cfg.Login.RateLimitStore, "login_ip", cfg.Login.RateLimitIP)
+	emailLimiter, stopEmailPruner := newLoginLimiter(database, cfg.DB.Timeouts, cfg.Login.RateLimitStore, "login_email", cfg.Login.RateLimitEmail)
+	loginByIP := middleware.RateLimit(ipLimiter, middleware.IPKey, logger)
+	loginByEmail := middleware.RateLimit(emailLimiter, middleware.EmailKey, logger)
+	r.Handle("/api/auth/login", loginByIP(loginByEmail(http.HandlerFunc(authHandler.Login)))).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/login")
 	r.HandleFunc("/api/auth/refresh", authHandler.RefreshToken).Methods("POST", "OPTIONS")
-	log.Println("  - POST /api/auth/refresh")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/refresh")
 	r.HandleFunc("/api/auth/logout", authHandler.Logout).Methods("POST", "OPTIONS")
-	log.Println("  - POST /api/auth/logout")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/logout")
+	r.HandleFunc("/api/auth/verify-email", authHandler.VerifyEmail).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/verify-email")
+	r.HandleFunc("/api/auth/verify-email/resend", authHandler.ResendVerification).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/verify-email/resend")
+	r.HandleFunc("/api/auth/password/forgot", authHandler.ForgotPassword).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/password/forgot")
+	r.HandleFunc("/api/auth/password/reset", authHandler.ResetPassword).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/password/reset")
+	r.Handle("/api/auth/mfa/verify", loginByIP(http.HandlerFunc(authHandler.VerifyMFA))).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/mfa/verify")
+	r.Handle("/api/auth/mfa/passkey/begin", loginByIP(http.HandlerFunc(authHandler.BeginMFAPasskey))).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/mfa/passkey/begin")
+	r.Handle("/api/auth/mfa/passkey/finish", loginByIP(http.HandlerFunc(authHandler.FinishMFAPasskey))).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/mfa/passkey/finish")
+	r.Handle("/api/auth/passkeys/login/begin", loginByIP(http.HandlerFunc(authHandler.BeginPasskeyLogin))).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/passkeys/login/begin")
+	r.Handle("/api/auth/passkeys/login/finish", loginByIP(http.HandlerFunc(authHandler.FinishPasskeyLogin))).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/passkeys/login/finish")
 
-	log.Println("configuring private routes")
+	logger.Info("configuring private routes")
 	protected := r.PathPrefix("/api").Subrouter()
-	protected.Use(middleware.AuthMiddleware(authService))
+	protected.Use(middleware.AuthMiddleware(authService, appMetrics, logger))
+
+	protected.HandleFunc("/profile", userHandler.Profile).Methods("GET", "OPTIONS")
+	logger.Debug("route registered", "method", "GET", "path", "/api/profile")
+	protected.HandleFunc("/profile/logins", userHandler.Logins).Methods("GET", "OPTIONS")
+	logger.Debug("route registered", "method", "GET", "path", "/api/profile/logins")
+	protected.HandleFunc("/auth/mfa", authHandler.MFAStatus).Methods("GET", "OPTIONS")
+	logger.Debug("route registered", "method", "GET", "path", "/api/auth/mfa")
+	protected.HandleFunc("/auth/mfa/totp/enroll", authHandler.EnrollTOTP).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/mfa/totp/enroll")
+	protected.HandleFunc("/auth/mfa/totp/confirm", authHandler.ConfirmTOTP).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/mfa/totp/confirm")
+	protected.Handle("/auth/mfa/totp/disable", loginByIP(http.HandlerFunc(authHandler.DisableTOTP))).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/mfa/totp/disable")
+	protected.Handle("/auth/mfa/recovery-codes", loginByIP(http.HandlerFunc(authHandler.RegenerateRecoveryCodes))).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/mfa/recovery-codes")
+	protected.HandleFunc("/auth/passkeys", authHandler.ListPasskeys).Methods("GET", "OPTIONS")
+	logger.Debug("route registered", "method", "GET", "path", "/api/auth/passkeys")
+	protected.HandleFunc("/auth/passkeys/register/begin", authHandler.BeginPasskeyRegistration).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/passkeys/register/begin")
+	protected.HandleFunc("/auth/passkeys/register/finish", authHandler.FinishPasskeyRegistration).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/passkeys/register/finish")
+	protected.HandleFunc("/auth/passkeys/{id}", authHandler.DeletePasskey).Methods("DELETE", "OPTIONS")
+	logger.Debug("route registered", "method", "DELETE", "path", "/api/auth/passkeys/{id}")
+	protected.HandleFunc("/sessions", authHandler.ListSessions).Methods("GET", "OPTIONS")
+	logger.Debug("route registered", "method", "GET", "path", "/api/sessions")
+	protected.HandleFunc("/sessions/revoke-all", authHandler.RevokeOtherSessions).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/sessions/revoke-all")
+	protected.HandleFunc("/sessions/{id}", authHandler.RevokeSession).Methods("DELETE", "OPTIONS")
+	logger.Debug("route registered", "method", "DELETE", "path", "/api/sessions/{id}")
+	protected.Handle("/auth/password/change", loginByIP(http.HandlerFunc(authHandler.ChangePassword))).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/auth/password/change")
+
+	logger.Info("configuring admin routes")
+	admin := protected.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.RequireRole(models.RoleAdmin, logger))
+	admin.HandleFunc("/users/{id}/revoke-sessions", adminHandler.RevokeUserSessions).Methods("POST", "OPTIONS")
+	logger.Debug("route registered", "method", "POST", "path", "/api/admin/users/{id}/revoke-sessions")
+	admin.HandleFunc("/audit", adminHandler.ListAudit).Methods("GET", "OPTIONS")
+	logger.Debug("route registered", "method", "GET", "path", "/api/admin/audit")
 
-	protected.HandleFunc("/profile", userHandler.Profile).Methods("GET")
-	log.Println("  - GET /api/profile")
+	// Metrics are served on their own listener so they're never exposed with the API
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/metrics", appMetrics.Handler())
+
+	// SIGTERM during a deploy drains in-flight requests instead of dropping them
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("server ready", "addr", "http://localhost:"+cfg.Port)
+	drain := func() {
+		// Fail readiness first and give the load balancer time to notice before connections close
+		healthHandler.Drain()
+		time.Sleep(cfg.HTTP.DrainDelay)
+	}
+	serveErr := runServers(ctx, logger, cfg.HTTP.ShutdownTimeout, drain,
+		newServer(":"+cfg.Port, r, cfg.HTTP),
+		newServer(cfg.HTTP.MetricsAddr, adminMux, cfg.HTTP),
+	)
+
+	// Nothing is serving requests anymore, so the workers and the database can go
+	stopRevocationPruner()
+	stopIPPruner()
+	stopEmailPruner()
+	database.Close()
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.Error("failed to flush traces", "err", err)
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if serveErr != nil {
+		log.Fatalf("server failed: %v", serveErr)
 	}
-	log.Println("")
-	log.Printf("server ready and on http://localhost:%s", port)
-	log.Println("")
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	logger.Info("shutdown complete")
 }
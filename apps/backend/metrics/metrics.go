@@ -0,0 +1,124 @@
+// Package metrics collects the Prometheus metrics the backend exposes: HTTP traffic by route,
+// authentication outcomes and database pool stats. They live in their own registry and are
+// served from a separate listener, so they're never reachable through the public API.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "placer"
+
+// Metrics holds the registry and every collector in it
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests     *prometheus.CounterVec
+	httpDuration     *prometheus.HistogramVec
+	logins           *prometheus.CounterVec
+	loginFailures    *prometheus.CounterVec
+	refreshes        *prometheus.CounterVec
+	validationErrors *prometheus.CounterVec
+}
+
+// New creates the collectors and registers them along with the Go runtime, process and
+// database pool collectors. pool may be nil, then it isn't reported.
+func New(pool *pgxpool.Pool) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests handled, by route template, method and status class.",
+		}, []string{"route", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle HTTP requests, by route template and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "auth",
+			Name:      "logins_total",
+			Help:      "Login attempts, by method (password, mfa, passkey) and outcome.",
+		}, []string{"method", "outcome"}),
+		loginFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "auth",
+			Name:      "login_failures_total",
+			Help:      "Failed login attempts, by method and reason.",
+		}, []string{"method", "reason"}),
+		refreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "auth",
+			Name:      "refreshes_total",
+			Help:      "Access token refreshes, by outcome.",
+		}, []string{"outcome"}),
+		validationErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "auth",
+			Name:      "token_validation_errors_total",
+			Help:      "Requests to protected routes rejected because of their access token, by reason.",
+		}, []string{"reason"}),
+	}
+
+	m.registry.MustRegister(
+		m.httpRequests,
+		m.httpDuration,
+		m.logins,
+		m.loginFailures,
+		m.refreshes,
+		m.validationErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	if pool != nil {
+		m.registry.MustRegister(newPoolCollector(pool))
+	}
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveRequest records a handled HTTP request. Route is the route template, not the
+// raw path, so IDs in URLs don't blow up the number of series.
+func (m *Metrics) ObserveRequest(route, method string, status int, duration time.Duration) {
+	m.httpRequests.WithLabelValues(route, method, statusClass(status)).Inc()
+	m.httpDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+// ObserveLogin records a login attempt, with the reason if it failed
+func (m *Metrics) ObserveLogin(method, outcome, reason string) {
+	m.logins.WithLabelValues(method, outcome).Inc()
+	if reason != "" {
+		m.loginFailures.WithLabelValues(method, reason).Inc()
+	}
+}
+
+// ObserveRefresh records an access token refresh
+func (m *Metrics) ObserveRefresh(outcome string) {
+	m.refreshes.WithLabelValues(outcome).Inc()
+}
+
+// ObserveTokenValidationError records a request rejected for its access token
+func (m *Metrics) ObserveTokenValidationError(reason string) {
+	m.validationErrors.WithLabelValues(reason).Inc()
+}
+
+// statusClass turns a status code into its class, 404 becomes "4xx"
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
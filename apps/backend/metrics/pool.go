@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector reports the connection pool's stats, read fresh from the pool on every scrape
+type poolCollector struct {
+	pool *pgxpool.Pool
+
+	maxConns          *prometheus.Desc
+	totalConns        *prometheus.Desc
+	idleConns         *prometheus.Desc
+	acquiredConns     *prometheus.Desc
+	constructingConns *prometheus.Desc
+	acquires          *prometheus.Desc
+	acquireDuration   *prometheus.Desc
+	emptyAcquires     *prometheus.Desc
+	canceledAcquires  *prometheus.Desc
+	newConns          *prometheus.Desc
+	lifetimeCloses    *prometheus.Desc
+	idleCloses        *prometheus.Desc
+}
+
+func newPoolCollector(pool *pgxpool.Pool) *poolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+	}
+	return &poolCollector{
+		pool:              pool,
+		maxConns:          desc("max_connections", "Most connections the pool will open."),
+		totalConns:        desc("connections", "Connections open, idle, in use or being opened."),
+		idleConns:         desc("idle_connections", "Connections open and waiting to be used."),
+		acquiredConns:     desc("acquired_connections", "Connections in use."),
+		constructingConns: desc("constructing_connections", "Connections being opened."),
+		acquires:          desc("acquires_total", "Connections handed out by the pool."),
+		acquireDuration:   desc("acquire_duration_seconds_total", "Time spent waiting for a connection."),
+		emptyAcquires:     desc("empty_acquires_total", "Acquires that had to wait because no connection was idle."),
+		canceledAcquires:  desc("canceled_acquires_total", "Acquires given up on because their context ended."),
+		newConns:          desc("new_connections_total", "Connections opened."),
+		lifetimeCloses:    desc("max_lifetime_closed_total", "Connections closed for reaching their maximum lifetime."),
+		idleCloses:        desc("max_idle_closed_total", "Connections closed for sitting idle too long."),
+	}
+}
+
+// Describe sends the descriptors of every pool metric
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect sends the pool's current stats
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+	gauge := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+	}
+	counter := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value)
+	}
+
+	gauge(c.maxConns, float64(stat.MaxConns()))
+	gauge(c.totalConns, float64(stat.TotalConns()))
+	gauge(c.idleConns, float64(stat.IdleConns()))
+	gauge(c.acquiredConns, float64(stat.AcquiredConns()))
+	gauge(c.constructingConns, float64(stat.ConstructingConns()))
+	counter(c.acquires, float64(stat.AcquireCount()))
+	counter(c.acquireDuration, stat.AcquireDuration().Seconds())
+	counter(c.emptyAcquires, float64(stat.EmptyAcquireCount()))
+	counter(c.canceledAcquires, float64(stat.CanceledAcquireCount()))
+	counter(c.newConns, float64(stat.NewConnsCount()))
+	counter(c.lifetimeCloses, float64(stat.MaxLifetimeDestroyCount()))
+	counter(c.idleCloses, float64(stat.MaxIdleDestroyCount()))
+}
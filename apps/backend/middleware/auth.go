@@ -2,12 +2,15 @@ package middleware
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strings"
 
 	"github.com/google/uuid"
 	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/metrics"
+	"github.com/pjontop/placer/backend/problem"
 )
 
 // Key type for context valuess
@@ -16,59 +19,62 @@ type contextKey string
 const (
 	// UserIDKey is the key for user ID in the request context
 	UserIDKey contextKey = "userID"
+	// SessionIDKey is the key for the session the access token belongs to
+	SessionIDKey contextKey = "sessionID"
+	// RoleKey is the key for the user's role in the request context
+	RoleKey contextKey = "role"
 )
 
 // AuthMiddleware checks JWT tokens and adds user info to the request context
-func AuthMiddleware(authService *auth.AuthService) func(http.Handler) http.Handler {
+func AuthMiddleware(authService *auth.AuthService, m *metrics.Metrics, logger *slog.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("validating request to: %s", r.URL.Path)
+			ctx := r.Context()
+			logger.DebugContext(ctx, "validating request", "path", r.URL.Path)
 
 			// Extract token from Authorization header
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
-				log.Println("missing Authorization header")
-				http.Error(w, "Authorization header required", http.StatusUnauthorized)
+				logger.InfoContext(ctx, "missing authorization header")
+				m.ObserveTokenValidationError("missing")
+				problem.Write(w, r, problem.Unauthorized().WithDetail("Authorization header required"))
 				return
 			}
 
 			// Check Bearer token format
 			parts := strings.Split(authHeader, " ")
 			if len(parts) != 2 || parts[0] != "Bearer" {
-				log.Println("invalid authorization format")
-				http.Error(w, "Invalid authorization format", http.StatusUnauthorized)
+				logger.InfoContext(ctx, "invalid authorization format")
+				m.ObserveTokenValidationError("malformed")
+				problem.Write(w, r, problem.Unauthorized().WithDetail("Invalid authorization format"))
 				return
 			}
 
 			tokenString := parts[1]
 
 			// Validate the token
-			claims, err := authService.ValidateToken(tokenString)
+			claims, err := authService.ValidateToken(ctx, tokenString)
 			if err != nil {
-				log.Printf("token validation failed: %v", err)
-				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				m.ObserveTokenValidationError(validationErrorReason(err))
+				if errors.Is(err, auth.ErrTokenRevoked) {
+					logger.InfoContext(ctx, "token has been revoked")
+				} else if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrExpiredToken) {
+					logger.InfoContext(ctx, "token validation failed", "err", err)
+				} else {
+					logger.ErrorContext(ctx, "error validating token", "err", err)
+				}
+				problem.Error(w, r, err)
 				return
 			}
 
-			// Extract user ID from claims
-			userIDStr, ok := claims["sub"].(string)
-			if !ok {
-				log.Println("invalid token claims - no sub")
-				http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-				return
-			}
-
-			userID, err := uuid.Parse(userIDStr)
-			if err != nil {
-				log.Printf("invalid user ID format: %v", err)
-				http.Error(w, "Invalid user ID in token", http.StatusUnauthorized)
-				return
-			}
+			userID := claims.UserID()
 
-			log.Printf("authentication successful for: %s", userID)
+			logger.DebugContext(ctx, "authentication successful", "user_id", userID)
 
-			// Add user ID to request context
-			ctx := context.WithValue(r.Context(), UserIDKey, userID)
+			// Add user ID and session ID to request context
+			ctx = context.WithValue(ctx, UserIDKey, userID)
+			ctx = context.WithValue(ctx, SessionIDKey, claims.Session())
+			ctx = context.WithValue(ctx, RoleKey, claims.Role)
 
 			// Call the next handler with the enhanced context
 			next.ServeHTTP(w, r.WithContext(ctx))
@@ -76,8 +82,42 @@ func AuthMiddleware(authService *auth.AuthService) func(http.Handler) http.Handl
 	}
 }
 
+// validationErrorReason names a token validation error for the metrics
+func validationErrorReason(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrTokenRevoked):
+		return "revoked"
+	case errors.Is(err, auth.ErrExpiredToken):
+		return "expired"
+	case errors.Is(err, auth.ErrInvalidToken):
+		return "invalid"
+	}
+	return "error"
+}
+
 // GetUserID retrieves the user ID from the request context
 func GetUserID(r *http.Request) (uuid.UUID, bool) {
 	userID, ok := r.Context().Value(UserIDKey).(uuid.UUID)
 	return userID, ok
 }
+
+// GetSessionID retrieves the current session ID from the request context
+func GetSessionID(r *http.Request) (uuid.UUID, bool) {
+	sessionID, ok := r.Context().Value(SessionIDKey).(uuid.UUID)
+	return sessionID, ok
+}
+
+// RequireRole only lets through requests whose access token carries the given role,
+// it must run after AuthMiddleware
+func RequireRole(role string, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if userRole, _ := r.Context().Value(RoleKey).(string); userRole != role {
+				logger.InfoContext(r.Context(), "request refused, role required", "path", r.URL.Path, "role", role)
+				problem.Write(w, r, problem.Forbidden())
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPKey is the context key for the client's address
+type clientIPKey struct{}
+
+// RealIP works out the address of the client that made the request and stores it for
+// ClientIP. X-Forwarded-For is only trusted when trustProxy is set, and then only its last
+// entry, which is the one our own proxy appended; anything before it came from the client
+// and can be forged. It should run before every other middleware.
+func RealIP(trustProxy bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := remoteIP(r)
+			if trustProxy {
+				if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+					parts := strings.Split(forwarded, ",")
+					if parsed := net.ParseIP(strings.TrimSpace(parts[len(parts)-1])); parsed != nil {
+						ip = parsed.String()
+					}
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+		})
+	}
+}
+
+// ClientIP returns the address of the client that made the request, as worked out by
+// RealIP, or the address of the connection if RealIP didn't run
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the address the connection came from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
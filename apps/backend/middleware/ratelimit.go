@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/pjontop/placer/backend/problem"
+	"github.com/pjontop/placer/backend/ratelimit"
+)
+
+// maxKeyBodySize caps how much of a request body EmailKey reads
+const maxKeyBodySize = 64 << 10
+
+// RateLimit refuses requests with 429 and Retry-After once the key picked by keyFunc runs out
+// of tokens. Requests without a key aren't limited. If the limiter itself fails the request is
+// let through, so a broken rate limit store doesn't take logins down with it.
+func RateLimit(limiter ratelimit.Limiter, keyFunc func(r *http.Request) string, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keyFunc(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			allowed, retryAfter, err := limiter.Allow(r.Context(), key)
+			if err != nil {
+				logger.ErrorContext(r.Context(), "rate limiter failed, allowing request", "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !allowed {
+				logger.InfoContext(r.Context(), "request rate limited", "path", r.URL.Path, "retry_after", retryAfter)
+				problem.Write(w, r, problem.RateLimited(retryAfter))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IPKey keys rate limits by client address
+func IPKey(r *http.Request) string {
+	return ClientIP(r)
+}
+
+// EmailKey keys rate limits by the normalized email in a JSON body, so spreading attempts
+// on one account over many addresses doesn't get around the limit. The body is put back
+// for the handler to read.
+func EmailKey(r *http.Request) string {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxKeyBodySize))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(payload.Email))
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// How a login was attempted
+const (
+	LoginMethodPassword = "password"
+	LoginMethodPasskey  = "passkey"
+	// LoginMethodOAuth is a login through an external OAuth provider
+	LoginMethodOAuth = "oauth"
+)
+
+// How a login attempt ended
+const (
+	LoginOutcomeSuccess = "success"
+	LoginOutcomeFailure = "failure"
+)
+
+// LoginRecord is one login attempt against an account
+type LoginRecord struct {
+	ID        int64
+	UserID    uuid.UUID
+	Method    string
+	Outcome   string
+	IPAddress string
+	UserAgent string
+	CreatedAt time.Time
+}
+
+// LoginHistoryStore stores the login attempts against each account. LoginHistoryRepository
+// keeps them in Postgres and MemoryLoginHistoryStore in memory.
+type LoginHistoryStore interface {
+	RecordLogin(ctx context.Context, userID uuid.UUID, method, outcome string, client ClientInfo) error
+	ListLogins(ctx context.Context, userID uuid.UUID, limit int) ([]LoginRecord, error)
+}
+
+// LoginHistoryRepository handles database operations for login history
+type LoginHistoryRepository struct {
+	db       db.Querier
+	timeouts db.Timeouts
+}
+
+// NewLoginHistoryRepository creates a new login history repository
+func NewLoginHistoryRepository(database *pgxpool.Pool, timeouts db.Timeouts) *LoginHistoryRepository {
+	return &LoginHistoryRepository{db: database, timeouts: timeouts}
+}
+
+// RecordLogin records a login attempt by the given method from the given client
+func (r *LoginHistoryRepository) RecordLogin(ctx context.Context, userID uuid.UUID, method, outcome string, client ClientInfo) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        INSERT INTO login_history (user_id, method, outcome, ip_address, user_agent, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+    `
+	_, err := r.db.Exec(ctx, query, userID, method, outcome, client.IPAddress, client.UserAgent, time.Now())
+	return err
+}
+
+// ListLogins returns up to limit of the user's most recent login attempts, newest first
+func (r *LoginHistoryRepository) ListLogins(ctx context.Context, userID uuid.UUID, limit int) ([]LoginRecord, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	query := `
+        SELECT id, user_id, method, outcome, ip_address, user_agent, created_at
+        FROM login_history
+        WHERE user_id = $1
+        ORDER BY id DESC
+        LIMIT $2
+    `
+	rows, err := r.db.Query(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []LoginRecord
+	for rows.Next() {
+		var record LoginRecord
+		if err := rows.Scan(
+			&record.ID,
+			&record.UserID,
+			&record.Method,
+			&record.Outcome,
+			&record.IPAddress,
+			&record.UserAgent,
+			&record.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	_ LoginHistoryStore = (*LoginHistoryRepository)(nil)
+	_ LoginHistoryStore = (*MemoryLoginHistoryStore)(nil)
+)
+
+// MemoryLoginHistoryStore keeps login history in memory, for tests and trying things out
+// without a database
+type MemoryLoginHistoryStore struct {
+	mu      sync.Mutex
+	records []LoginRecord // in the order they were recorded
+}
+
+// NewMemoryLoginHistoryStore creates an empty in-memory login history store
+func NewMemoryLoginHistoryStore() *MemoryLoginHistoryStore {
+	return &MemoryLoginHistoryStore{}
+}
+
+// RecordLogin records a login attempt by the given method from the given client
+func (s *MemoryLoginHistoryStore) RecordLogin(ctx context.Context, userID uuid.UUID, method, outcome string, client ClientInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, LoginRecord{
+		ID:        int64(len(s.records) + 1),
+		UserID:    userID,
+		Method:    method,
+		Outcome:   outcome,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		CreatedAt: time.Now(),
+	})
+	return nil
+}
+
+// ListLogins returns up to limit of the user's most recent login attempts, newest first
+func (s *MemoryLoginHistoryStore) ListLogins(ctx context.Context, userID uuid.UUID, limit int) ([]LoginRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []LoginRecord
+	for i := len(s.records) - 1; i >= 0 && len(records) < limit; i-- {
+		if s.records[i].UserID == userID {
+			records = append(records, s.records[i])
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	_ MFAStore = (*MFARepository)(nil)
+	_ MFAStore = (*MemoryMFAStore)(nil)
+)
+
+// MemoryMFAStore keeps TOTP enrollments and recovery codes in memory, for tests and trying
+// things out without a database
+type MemoryMFAStore struct {
+	mu    sync.Mutex
+	totp  map[uuid.UUID]*TOTPCredential
+	codes map[uuid.UUID]map[string]bool // code digest to whether it's been used
+}
+
+// NewMemoryMFAStore creates an empty in-memory MFA store
+func NewMemoryMFAStore() *MemoryMFAStore {
+	return &MemoryMFAStore{
+		totp:  map[uuid.UUID]*TOTPCredential{},
+		codes: map[uuid.UUID]map[string]bool{},
+	}
+}
+
+// SaveTOTP stores a new unconfirmed TOTP secret for a user, replacing any earlier unconfirmed one.
+// It returns sql.ErrNoRows if the user already has a confirmed enrollment.
+func (s *MemoryMFAStore) SaveTOTP(ctx context.Context, userID uuid.UUID, secretEncrypted string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cred, ok := s.totp[userID]; ok && cred.ConfirmedAt != nil {
+		return sql.ErrNoRows
+	}
+	s.totp[userID] = &TOTPCredential{UserID: userID, SecretEncrypted: secretEncrypted, CreatedAt: time.Now()}
+	return nil
+}
+
+// GetTOTP retrieves a user's TOTP enrollment
+func (s *MemoryMFAStore) GetTOTP(ctx context.Context, userID uuid.UUID) (*TOTPCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cred, ok := s.totp[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *cred
+	return &copied, nil
+}
+
+// ConfirmTOTP activates a user's enrollment
+func (s *MemoryMFAStore) ConfirmTOTP(ctx context.Context, userID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cred, ok := s.totp[userID]; ok {
+		now := time.Now()
+		cred.ConfirmedAt = &now
+	}
+	return nil
+}
+
+// UseTOTPStep records that a time step was used to log in, reporting false if that step
+// or a later one was already used
+func (s *MemoryMFAStore) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cred, ok := s.totp[userID]
+	if !ok || cred.LastUsedStep >= step {
+		return false, nil
+	}
+	cred.LastUsedStep = step
+	return true, nil
+}
+
+// DeleteTOTP removes a user's enrollment along with their recovery codes
+func (s *MemoryMFAStore) DeleteTOTP(ctx context.Context, userID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.totp, userID)
+	delete(s.codes, userID)
+	return nil
+}
+
+// ReplaceRecoveryCodes swaps a user's recovery codes for a new set of digests
+func (s *MemoryMFAStore) ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	codes := make(map[string]bool, len(codeHashes))
+	for _, codeHash := range codeHashes {
+		codes[codeHash] = false
+	}
+	s.codes[userID] = codes
+	return nil
+}
+
+// UseRecoveryCode marks an unused recovery code as used, reporting false if there was none
+func (s *MemoryMFAStore) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used, ok := s.codes[userID][codeHash]
+	if !ok || used {
+		return false, nil
+	}
+	s.codes[userID][codeHash] = true
+	return true, nil
+}
+
+// CountRecoveryCodes counts a user's unused recovery codes
+func (s *MemoryMFAStore) CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, used := range s.codes[userID] {
+		if !used {
+			count++
+		}
+	}
+	return count, nil
+}
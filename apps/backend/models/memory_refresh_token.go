@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	_ RefreshTokenStore = (*RefreshTokenRepository)(nil)
+	_ RefreshTokenStore = (*MemoryRefreshTokenStore)(nil)
+)
+
+// MemoryRefreshTokenStore keeps refresh tokens in memory, for tests and trying things out
+// without a database
+type MemoryRefreshTokenStore struct {
+	mu     sync.Mutex
+	tokens []*RefreshToken // in the order they were created
+}
+
+// NewMemoryRefreshTokenStore creates an empty in-memory refresh token store
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{}
+}
+
+// CreateRefreshToken stores the digest of a new refresh token for a user in the given token family
+func (s *MemoryRefreshTokenStore) CreateRefreshToken(ctx context.Context, userID, familyID uuid.UUID, tokenHash string, ttl time.Duration, client ClientInfo, accessToken AccessTokenRef) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	token := &RefreshToken{
+		ID:          uuid.New(),
+		UserID:      userID,
+		FamilyID:    familyID,
+		TokenHash:   tokenHash,
+		ExpiresAt:   now.Add(ttl),
+		CreatedAt:   now,
+		Client:      client,
+		AccessToken: accessToken,
+	}
+	s.tokens = append(s.tokens, token)
+	copied := *token
+	return &copied, nil
+}
+
+// GetRefreshToken retrieves a refresh token by the digest of its token string
+func (s *MemoryRefreshTokenStore) GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.tokens {
+		if token.TokenHash == tokenHash {
+			copied := *token
+			return &copied, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// ConsumeRefreshToken revokes an active refresh token so it can't be used again,
+// reporting false if it was already revoked
+func (s *MemoryRefreshTokenStore) ConsumeRefreshToken(ctx context.Context, id uuid.UUID) (bool, error) {
+	now := time.Now()
+	consumed := s.revoke(func(token *RefreshToken) bool { return token.ID == id }, func(token *RefreshToken) {
+		token.LastUsedAt = &now
+	})
+	return len(consumed) == 1, nil
+}
+
+// RevokeRefreshToken marks the refresh token with the given digest as revoked
+func (s *MemoryRefreshTokenStore) RevokeRefreshToken(ctx context.Context, tokenHash string) error {
+	s.revoke(func(token *RefreshToken) bool { return token.TokenHash == tokenHash }, nil)
+	return nil
+}
+
+// RevokeTokenFamily marks every refresh token in a family as revoked
+func (s *MemoryRefreshTokenStore) RevokeTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	s.revoke(func(token *RefreshToken) bool { return token.FamilyID == familyID }, nil)
+	return nil
+}
+
+// RevokeUserRefreshTokens marks every refresh token belonging to a user as revoked
+func (s *MemoryRefreshTokenStore) RevokeUserRefreshTokens(ctx context.Context, userID uuid.UUID) error {
+	s.revoke(func(token *RefreshToken) bool { return token.UserID == userID }, nil)
+	return nil
+}
+
+// ListSessions returns the user's active token families, most recently used first
+func (s *MemoryRefreshTokenStore) ListSessions(ctx context.Context, userID uuid.UUID) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	started := map[uuid.UUID]time.Time{}
+	for _, token := range s.tokens {
+		if token.UserID != userID {
+			continue
+		}
+		if first, ok := started[token.FamilyID]; !ok || token.CreatedAt.Before(first) {
+			started[token.FamilyID] = token.CreatedAt
+		}
+	}
+
+	now := time.Now()
+	var sessions []Session
+	for _, token := range s.tokens {
+		if token.UserID != userID || token.Revoked || !token.ExpiresAt.After(now) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			ID:         token.FamilyID,
+			Client:     token.Client,
+			CreatedAt:  started[token.FamilyID],
+			LastUsedAt: token.CreatedAt,
+			ExpiresAt:  token.ExpiresAt,
+		})
+	}
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+// RevokeUserTokenFamily revokes a token family if it belongs to the user and is still active,
+// reporting false if there was nothing to revoke
+func (s *MemoryRefreshTokenStore) RevokeUserTokenFamily(ctx context.Context, userID, familyID uuid.UUID) (bool, error) {
+	revoked := s.revoke(func(token *RefreshToken) bool {
+		return token.UserID == userID && token.FamilyID == familyID
+	}, nil)
+	return len(revoked) > 0, nil
+}
+
+// RevokeOtherTokenFamilies revokes all of the user's refresh tokens except those in the given family,
+// returning how many sessions were ended
+func (s *MemoryRefreshTokenStore) RevokeOtherTokenFamilies(ctx context.Context, userID, keepFamilyID uuid.UUID) (int, error) {
+	revoked := s.revoke(func(token *RefreshToken) bool {
+		return token.UserID == userID && token.FamilyID != keepFamilyID
+	}, nil)
+	families := map[uuid.UUID]bool{}
+	for _, token := range revoked {
+		families[token.FamilyID] = true
+	}
+	return len(families), nil
+}
+
+// FamilyAccessTokens returns the unexpired access tokens issued in a token family
+func (s *MemoryRefreshTokenStore) FamilyAccessTokens(ctx context.Context, familyID uuid.UUID) ([]AccessTokenRef, error) {
+	return s.accessTokens(func(token *RefreshToken) bool { return token.FamilyID == familyID }), nil
+}
+
+// UserAccessTokens returns the user's unexpired access tokens outside the given family,
+// pass uuid.Nil to include every family
+func (s *MemoryRefreshTokenStore) UserAccessTokens(ctx context.Context, userID, exceptFamilyID uuid.UUID) ([]AccessTokenRef, error) {
+	return s.accessTokens(func(token *RefreshToken) bool {
+		return token.UserID == userID && token.FamilyID != exceptFamilyID
+	}), nil
+}
+
+// revoke revokes the active tokens matching match, calling update on each, and returns them
+func (s *MemoryRefreshTokenStore) revoke(match func(token *RefreshToken) bool, update func(token *RefreshToken)) []*RefreshToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var revoked []*RefreshToken
+	for _, token := range s.tokens {
+		if token.Revoked || !match(token) {
+			continue
+		}
+		token.Revoked = true
+		if update != nil {
+			update(token)
+		}
+		revoked = append(revoked, token)
+	}
+	return revoked
+}
+
+// accessTokens returns the unexpired access tokens issued with the refresh tokens matching match
+func (s *MemoryRefreshTokenStore) accessTokens(match func(token *RefreshToken) bool) []AccessTokenRef {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var refs []AccessTokenRef
+	for _, token := range s.tokens {
+		if match(token) && token.AccessToken.JTI != "" && token.AccessToken.ExpiresAt.After(now) {
+			refs = append(refs, token.AccessToken)
+		}
+	}
+	return refs
+}
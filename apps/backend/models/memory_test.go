@@ -0,0 +1,29 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/pjontop/placer/backend/models"
+)
+
+func TestMemoryStores(t *testing.T) {
+	testStores(t, func(t *testing.T) stores {
+		s := models.Stores{
+			Users:         models.NewMemoryUserStore(),
+			RefreshTokens: models.NewMemoryRefreshTokenStore(),
+			UserTokens:    models.NewMemoryUserTokenStore(),
+			MFA:           models.NewMemoryMFAStore(),
+			WebAuthn:      models.NewMemoryWebAuthnStore(),
+			LoginHistory:  models.NewMemoryLoginHistoryStore(),
+		}
+		return stores{
+			Users:         s.Users,
+			RefreshTokens: s.RefreshTokens,
+			UserTokens:    s.UserTokens,
+			MFA:           s.MFA,
+			WebAuthn:      s.WebAuthn,
+			LoginHistory:  s.LoginHistory,
+			Tx:            models.NewMemoryTransactor(s),
+		}
+	})
+}
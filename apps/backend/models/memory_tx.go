@@ -0,0 +1,28 @@
+package models
+
+import (
+	"context"
+	"sync"
+)
+
+var _ Transactor = (*MemoryTransactor)(nil)
+
+// MemoryTransactor runs units of work on in-memory stores one at a time, so they don't
+// interleave with each other. Nothing is rolled back when one fails.
+type MemoryTransactor struct {
+	mu     sync.Mutex
+	stores Stores
+}
+
+// NewMemoryTransactor creates a transactor handing out the given stores
+func NewMemoryTransactor(stores Stores) *MemoryTransactor {
+	return &MemoryTransactor{stores: stores}
+}
+
+// WithTx runs fn with the stores once no other unit of work is running
+func (t *MemoryTransactor) WithTx(ctx context.Context, fn func(ctx context.Context, stores Stores) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return fn(ctx, t.stores)
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	_ UserStore = (*UserRepository)(nil)
+	_ UserStore = (*MemoryUserStore)(nil)
+)
+
+// MemoryUserStore keeps users in memory, for tests and trying things out without a database
+type MemoryUserStore struct {
+	mu    sync.Mutex
+	users map[uuid.UUID]*User
+}
+
+// NewMemoryUserStore creates an empty in-memory user store
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: map[uuid.UUID]*User{}}
+}
+
+// CreateUser adds a new user, returning ErrEmailInUse if the email is taken like the unique index would
+func (s *MemoryUserStore) CreateUser(ctx context.Context, email, name, passwordHash string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.byEmail(email) != nil {
+		return nil, ErrEmailInUse
+	}
+	user := &User{
+		ID:           uuid.New(),
+		Email:        email,
+		Name:         name,
+		PasswordHash: passwordHash,
+		CreatedAt:    time.Now(),
+		Role:         RoleUser,
+	}
+	s.users[user.ID] = user
+	copied := *user
+	return &copied, nil
+}
+
+// GetUserByEmail retrieves a user by their email address
+func (s *MemoryUserStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.byEmail(email)
+	if user == nil {
+		return nil, sql.ErrNoRows
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// GetUserByID retrieves a user by their ID
+func (s *MemoryUserStore) GetUserByID(ctx context.Context, id uuid.UUID) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// MarkEmailVerified records that the user proved they own their email address
+func (s *MemoryUserStore) MarkEmailVerified(ctx context.Context, id uuid.UUID) error {
+	s.update(id, func(user *User) {
+		if user.EmailVerifiedAt == nil {
+			now := time.Now()
+			user.EmailVerifiedAt = &now
+		}
+	})
+	return nil
+}
+
+// UpdatePassword replaces the user's password hash
+func (s *MemoryUserStore) UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	s.update(id, func(user *User) { user.PasswordHash = passwordHash })
+	return nil
+}
+
+// SetRole changes the role of the user with the given email, returning sql.ErrNoRows if there's no such user
+func (s *MemoryUserStore) SetRole(ctx context.Context, email, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.byEmail(email)
+	if user == nil {
+		return sql.ErrNoRows
+	}
+	user.Role = role
+	return nil
+}
+
+// RecordFailedLogin counts a wrong password against the user and returns the new count
+func (s *MemoryUserStore) RecordFailedLogin(ctx context.Context, id uuid.UUID) (int, error) {
+	count := 0
+	if !s.update(id, func(user *User) {
+		user.FailedLoginCount++
+		count = user.FailedLoginCount
+	}) {
+		return 0, sql.ErrNoRows
+	}
+	return count, nil
+}
+
+// LockUser refuses logins for the user until the given time
+func (s *MemoryUserStore) LockUser(ctx context.Context, id uuid.UUID, until time.Time) error {
+	s.update(id, func(user *User) { user.LockedUntil = &until })
+	return nil
+}
+
+// ResetFailedLogins clears the failed login count and any lockout after a successful login
+func (s *MemoryUserStore) ResetFailedLogins(ctx context.Context, id uuid.UUID) error {
+	s.update(id, func(user *User) {
+		user.FailedLoginCount = 0
+		user.LockedUntil = nil
+	})
+	return nil
+}
+
+// UpdateLastLogin records that the user just logged in or refreshed their session
+func (s *MemoryUserStore) UpdateLastLogin(ctx context.Context, id uuid.UUID) error {
+	now := time.Now()
+	s.update(id, func(user *User) { user.LastLogin = &now })
+	return nil
+}
+
+// byEmail finds a user by email, the caller holds the lock
+func (s *MemoryUserStore) byEmail(email string) *User {
+	for _, user := range s.users {
+		if user.Email == email {
+			return user
+		}
+	}
+	return nil
+}
+
+// update changes a user in place, reporting false if there's no such user
+func (s *MemoryUserStore) update(id uuid.UUID, fn func(user *User)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if ok {
+		fn(user)
+	}
+	return ok
+}
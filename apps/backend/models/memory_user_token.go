@@ -0,0 +1,148 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	_ UserTokenStore = (*UserTokenRepository)(nil)
+	_ UserTokenStore = (*MemoryUserTokenStore)(nil)
+)
+
+// MemoryUserTokenStore keeps single-use user tokens in memory, for tests and trying things
+// out without a database
+type MemoryUserTokenStore struct {
+	mu     sync.Mutex
+	tokens map[uuid.UUID]*UserToken
+}
+
+// NewMemoryUserTokenStore creates an empty in-memory user token store
+func NewMemoryUserTokenStore() *MemoryUserTokenStore {
+	return &MemoryUserTokenStore{tokens: map[uuid.UUID]*UserToken{}}
+}
+
+// CreateUserToken stores the digest of a new token for a user
+func (s *MemoryUserTokenStore) CreateUserToken(ctx context.Context, userID uuid.UUID, purpose, tokenHash string, ttl time.Duration) (*UserToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	token := &UserToken{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: tokenHash,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	s.tokens[token.ID] = token
+	copied := *token
+	return &copied, nil
+}
+
+// ConsumeUserToken marks an unexpired, unused token as used and returns it,
+// or sql.ErrNoRows if there's no such token
+func (s *MemoryUserTokenStore) ConsumeUserToken(ctx context.Context, purpose, tokenHash string) (*UserToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := s.usable(purpose, tokenHash)
+	if token == nil {
+		return nil, sql.ErrNoRows
+	}
+	now := time.Now()
+	token.ConsumedAt = &now
+	copied := *token
+	return &copied, nil
+}
+
+// GetUserToken retrieves an unexpired, unused token without consuming it
+func (s *MemoryUserTokenStore) GetUserToken(ctx context.Context, purpose, tokenHash string) (*UserToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := s.usable(purpose, tokenHash)
+	if token == nil {
+		return nil, sql.ErrNoRows
+	}
+	copied := *token
+	return &copied, nil
+}
+
+// IncrementUserTokenAttempts records a failed attempt against a token and returns the new count
+func (s *MemoryUserTokenStore) IncrementUserTokenAttempts(ctx context.Context, id uuid.UUID) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	token.Attempts++
+	return token.Attempts, nil
+}
+
+// ConsumeUserTokenByID marks a specific token as used, reporting false if it already was
+func (s *MemoryUserTokenStore) ConsumeUserTokenByID(ctx context.Context, id uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok || token.ConsumedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	token.ConsumedAt = &now
+	return true, nil
+}
+
+// CountUserTokensSince counts the tokens issued to a user for a purpose since a point in time,
+// and returns when the latest one was issued
+func (s *MemoryUserTokenStore) CountUserTokensSince(ctx context.Context, userID uuid.UUID, purpose string, since time.Time) (int, *time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	var latest *time.Time
+	for _, token := range s.tokens {
+		if token.UserID != userID || token.Purpose != purpose || !token.CreatedAt.After(since) {
+			continue
+		}
+		count++
+		if latest == nil || token.CreatedAt.After(*latest) {
+			createdAt := token.CreatedAt
+			latest = &createdAt
+		}
+	}
+	return count, latest, nil
+}
+
+// ConsumeUserTokens marks every outstanding token a user has for a purpose as used
+func (s *MemoryUserTokenStore) ConsumeUserTokens(ctx context.Context, userID uuid.UUID, purpose string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, token := range s.tokens {
+		if token.UserID == userID && token.Purpose == purpose && token.ConsumedAt == nil {
+			token.ConsumedAt = &now
+		}
+	}
+	return nil
+}
+
+// usable finds an unexpired, unused token, the caller holds the lock
+func (s *MemoryUserTokenStore) usable(purpose, tokenHash string) *UserToken {
+	now := time.Now()
+	for _, token := range s.tokens {
+		if token.TokenHash == tokenHash && token.Purpose == purpose && token.ConsumedAt == nil && token.ExpiresAt.After(now) {
+			return token
+		}
+	}
+	return nil
+}
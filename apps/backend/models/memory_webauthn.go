@@ -0,0 +1,140 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	_ WebAuthnStore = (*WebAuthnRepository)(nil)
+	_ WebAuthnStore = (*MemoryWebAuthnStore)(nil)
+)
+
+// MemoryWebAuthnStore keeps passkeys and ceremony state in memory, for tests and trying
+// things out without a database
+type MemoryWebAuthnStore struct {
+	mu       sync.Mutex
+	creds    []*WebAuthnCredential // in the order they were registered
+	sessions map[uuid.UUID]*WebAuthnSession
+}
+
+// NewMemoryWebAuthnStore creates an empty in-memory WebAuthn store
+func NewMemoryWebAuthnStore() *MemoryWebAuthnStore {
+	return &MemoryWebAuthnStore{sessions: map[uuid.UUID]*WebAuthnSession{}}
+}
+
+// CreateCredential stores a newly registered passkey
+func (s *MemoryWebAuthnStore) CreateCredential(ctx context.Context, cred *WebAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cred.CreatedAt = time.Now()
+	copied := *cred
+	s.creds = append(s.creds, &copied)
+	return nil
+}
+
+// ListCredentials returns every passkey a user has registered
+func (s *MemoryWebAuthnStore) ListCredentials(ctx context.Context, userID uuid.UUID) ([]*WebAuthnCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var creds []*WebAuthnCredential
+	for _, cred := range s.creds {
+		if cred.UserID == userID {
+			copied := *cred
+			creds = append(creds, &copied)
+		}
+	}
+	return creds, nil
+}
+
+// RecordCredentialUse stores the sign count and flags seen on a successful assertion
+func (s *MemoryWebAuthnStore) RecordCredentialUse(ctx context.Context, id []byte, signCount uint32, userVerified, backupState bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cred := s.byID(id); cred != nil {
+		now := time.Now()
+		cred.SignCount = signCount
+		cred.UserVerified = cred.UserVerified || userVerified
+		cred.BackupState = backupState
+		cred.LastUsedAt = &now
+	}
+	return nil
+}
+
+// FlagCredentialCloned marks a passkey whose sign counter went backwards
+func (s *MemoryWebAuthnStore) FlagCredentialCloned(ctx context.Context, id []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cred := s.byID(id); cred != nil {
+		cred.CloneWarning = true
+	}
+	return nil
+}
+
+// DeleteCredential removes one of a user's passkeys, returning sql.ErrNoRows if they don't own it
+func (s *MemoryWebAuthnStore) DeleteCredential(ctx context.Context, userID uuid.UUID, id []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.creds, func(cred *WebAuthnCredential) bool {
+		return cred.UserID == userID && bytes.Equal(cred.ID, id)
+	})
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	s.creds = slices.Delete(s.creds, i, i+1)
+	return nil
+}
+
+// CreateSession stores ceremony state and returns its ID, abandoned ceremonies are cleared out on the way
+func (s *MemoryWebAuthnStore) CreateSession(ctx context.Context, userID *uuid.UUID, purpose string, data []byte, ttl time.Duration) (uuid.UUID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, session := range s.sessions {
+		if session.ExpiresAt.Before(now) {
+			delete(s.sessions, id)
+		}
+	}
+	session := &WebAuthnSession{ID: uuid.New(), UserID: userID, Purpose: purpose, Data: data, ExpiresAt: now.Add(ttl)}
+	s.sessions[session.ID] = session
+	return session.ID, nil
+}
+
+// TakeSession deletes and returns an unexpired ceremony so each one can only be finished once.
+// It returns sql.ErrNoRows if there's no such session.
+func (s *MemoryWebAuthnStore) TakeSession(ctx context.Context, id uuid.UUID, purpose string) (*WebAuthnSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.Purpose != purpose {
+		return nil, sql.ErrNoRows
+	}
+	delete(s.sessions, id)
+	if time.Now().After(session.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return session, nil
+}
+
+// byID finds a passkey by its credential ID, the caller holds the lock
+func (s *MemoryWebAuthnStore) byID(id []byte) *WebAuthnCredential {
+	for _, cred := range s.creds {
+		if bytes.Equal(cred.ID, id) {
+			return cred
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// TOTPCredential is a user's authenticator app enrollment
+type TOTPCredential struct {
+	UserID          uuid.UUID
+	SecretEncrypted string
+	ConfirmedAt     *time.Time
+	LastUsedStep    int64
+	CreatedAt       time.Time
+}
+
+// MFAStore stores TOTP enrollments and recovery codes. MFARepository keeps them in Postgres
+// and MemoryMFAStore in memory.
+type MFAStore interface {
+	SaveTOTP(ctx context.Context, userID uuid.UUID, secretEncrypted string) error
+	GetTOTP(ctx context.Context, userID uuid.UUID) (*TOTPCredential, error)
+	ConfirmTOTP(ctx context.Context, userID uuid.UUID) error
+	UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error)
+	DeleteTOTP(ctx context.Context, userID uuid.UUID) error
+	ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes []string) error
+	UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error)
+	CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error)
+}
+
+// MFARepository handles database operations for TOTP enrollments and recovery codes
+type MFARepository struct {
+	db       db.Querier
+	timeouts db.Timeouts
+}
+
+// NewMFARepository creates a new MFA repository
+func NewMFARepository(database *pgxpool.Pool, timeouts db.Timeouts) *MFARepository {
+	return &MFARepository{db: database, timeouts: timeouts}
+}
+
+// SaveTOTP stores a new unconfirmed TOTP secret for a user, replacing any earlier unconfirmed one.
+// It returns sql.ErrNoRows if the user already has a confirmed enrollment.
+func (r *MFARepository) SaveTOTP(ctx context.Context, userID uuid.UUID, secretEncrypted string) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        INSERT INTO user_totp (user_id, secret_encrypted, created_at)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (user_id) DO UPDATE
+        SET secret_encrypted = EXCLUDED.secret_encrypted, created_at = EXCLUDED.created_at, last_used_step = 0
+        WHERE user_totp.confirmed_at IS NULL
+    `
+
+	result, err := r.db.Exec(ctx, query, userID, secretEncrypted, time.Now())
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetTOTP retrieves a user's TOTP enrollment
+func (r *MFARepository) GetTOTP(ctx context.Context, userID uuid.UUID) (*TOTPCredential, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	query := `
+        SELECT user_id, secret_encrypted, confirmed_at, last_used_step, created_at
+        FROM user_totp
+        WHERE user_id = $1
+    `
+
+	var cred TOTPCredential
+	err := r.db.QueryRow(ctx, query, userID).Scan(
+		&cred.UserID,
+		&cred.SecretEncrypted,
+		&cred.ConfirmedAt,
+		&cred.LastUsedStep,
+		&cred.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+// ConfirmTOTP activates a user's enrollment
+func (r *MFARepository) ConfirmTOTP(ctx context.Context, userID uuid.UUID) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `UPDATE user_totp SET confirmed_at = $2 WHERE user_id = $1`
+	_, err := r.db.Exec(ctx, query, userID, time.Now())
+	return err
+}
+
+// UseTOTPStep records that a time step was used to log in. It reports false if that step
+// or a later one was already used, which stops a code from being replayed.
+func (r *MFARepository) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE user_totp
+        SET last_used_step = $2
+        WHERE user_id = $1 AND last_used_step < $2
+    `
+
+	result, err := r.db.Exec(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// DeleteTOTP removes a user's enrollment along with their recovery codes
+func (r *MFARepository) DeleteTOTP(ctx context.Context, userID uuid.UUID) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ReplaceRecoveryCodes swaps a user's recovery codes for a new set of digests
+func (r *MFARepository) ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes []string) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, codeHash := range codeHashes {
+		query := `
+            INSERT INTO mfa_recovery_codes (id, user_id, code_hash, created_at)
+            VALUES ($1, $2, $3, $4)
+        `
+		if _, err := tx.Exec(ctx, query, uuid.New(), userID, codeHash, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// UseRecoveryCode marks an unused recovery code as used, reporting false if there was none
+func (r *MFARepository) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE mfa_recovery_codes
+        SET used_at = $3
+        WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+    `
+
+	result, err := r.db.Exec(ctx, query, userID, codeHash, time.Now())
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// CountRecoveryCodes counts a user's unused recovery codes
+func (r *MFARepository) CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	query := `SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL`
+	var count int
+	err := r.db.QueryRow(ctx, query, userID).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,235 @@
+package models_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+	"github.com/pjontop/placer/backend/models"
+)
+
+// TestPostgresStores runs the store contract against the Postgres repositories. It uses the
+// database in TEST_DATABASE_URL, or starts a throwaway cluster if initdb is on the PATH, and
+// is skipped when neither is available.
+func TestPostgresStores(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping Postgres tests in short mode")
+	}
+	database := openTestDatabase(t)
+	timeouts := db.Timeouts{Read: 5 * time.Second, Write: 5 * time.Second}
+
+	testStores(t, func(t *testing.T) stores {
+		// Every table hangs off users apart from the ceremony sessions
+		if _, err := database.Exec(t.Context(), `TRUNCATE users, webauthn_sessions CASCADE`); err != nil {
+			t.Fatalf("clear tables: %v", err)
+		}
+		return stores{
+			Users:         models.NewUserRepository(database, timeouts),
+			RefreshTokens: models.NewRefreshTokenRepository(database, timeouts),
+			UserTokens:    models.NewUserTokenRepository(database, timeouts),
+			MFA:           models.NewMFARepository(database, timeouts),
+			WebAuthn:      models.NewWebAuthnRepository(database, timeouts),
+			LoginHistory:  models.NewLoginHistoryRepository(database, timeouts),
+			Tx:            models.NewTxManager(database, timeouts),
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		ctx := context.Background()
+		users := models.NewUserRepository(database, timeouts)
+		errFailed := errors.New("failed")
+		err := models.NewTxManager(database, timeouts).WithTx(ctx, func(ctx context.Context, tx models.Stores) error {
+			if _, err := tx.Users.CreateUser(ctx, "rollback@example.com", "Test User", "hash"); err != nil {
+				return err
+			}
+			return errFailed
+		})
+		if !errors.Is(err, errFailed) {
+			t.Fatalf("WithTx() error = %v, want %v", err, errFailed)
+		}
+		if _, err := users.GetUserByEmail(ctx, "rollback@example.com"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("user created in a rolled back transaction: GetUserByEmail() error = %v, want %v", err, sql.ErrNoRows)
+		}
+	})
+
+	t.Run("prepared statements after reconnecting", func(t *testing.T) {
+		ctx := context.Background()
+		users := models.NewUserRepository(database, timeouts)
+		refreshTokens := models.NewRefreshTokenRepository(database, timeouts)
+		user, err := users.CreateUser(ctx, "prepared@example.com", "Test User", "hash")
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		if _, err := refreshTokens.CreateRefreshToken(ctx, user.ID, uuid.New(), "prepared-hash", time.Hour, models.ClientInfo{}, models.AccessTokenRef{}); err != nil {
+			t.Fatalf("CreateRefreshToken() error = %v", err)
+		}
+
+		lookup := func(t *testing.T, users models.UserStore, refreshTokens models.RefreshTokenStore) {
+			t.Helper()
+			if got, err := users.GetUserByEmail(ctx, user.Email); err != nil || got.ID != user.ID {
+				t.Errorf("GetUserByEmail() = %v, %v, want %s", got, err, user.ID)
+			}
+			if got, err := refreshTokens.GetRefreshToken(ctx, "prepared-hash"); err != nil || got.UserID != user.ID {
+				t.Errorf("GetRefreshToken() = %v, %v, want a token for %s", got, err, user.ID)
+			}
+		}
+		// Prepares the statements on the pool's connections, which are then all replaced
+		for i := 0; i < 3; i++ {
+			lookup(t, users, refreshTokens)
+		}
+		database.Reset()
+		for i := 0; i < 3; i++ {
+			lookup(t, users, refreshTokens)
+		}
+		// And on the connection of a transaction
+		err = models.NewTxManager(database, timeouts).WithTx(ctx, func(ctx context.Context, tx models.Stores) error {
+			lookup(t, tx.Users, tx.RefreshTokens)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("WithTx() error = %v", err)
+		}
+	})
+
+	t.Run("query timeouts", func(t *testing.T) {
+		ctx := context.Background()
+		user, err := models.NewUserRepository(database, timeouts).CreateUser(ctx, "timeouts@example.com", "Test User", "hash")
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+
+		// Hold a lock that every query on users has to wait behind
+		tx, err := database.Begin(ctx)
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+		defer tx.Rollback(ctx)
+		if _, err := tx.Exec(ctx, `LOCK TABLE users IN ACCESS EXCLUSIVE MODE`); err != nil {
+			t.Fatalf("lock users: %v", err)
+		}
+
+		users := models.NewUserRepository(database, db.Timeouts{Read: 100 * time.Millisecond, Write: 100 * time.Millisecond})
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		tests := []struct {
+			name    string
+			run     func() error
+			wantErr error
+		}{
+			{name: "read", run: func() error { _, err := users.GetUserByID(ctx, user.ID); return err }, wantErr: context.DeadlineExceeded},
+			{name: "prepared read", run: func() error { _, err := users.GetUserByEmail(ctx, user.Email); return err }, wantErr: context.DeadlineExceeded},
+			{name: "write", run: func() error { return users.UpdatePassword(ctx, user.ID, "new hash") }, wantErr: context.DeadlineExceeded},
+			{name: "cancelled", run: func() error { _, err := users.GetUserByID(cancelled, user.ID); return err }, wantErr: context.Canceled},
+		}
+		for _, tt := range tests {
+			start := time.Now()
+			err := tt.run()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("%s: took %v, want it stopped at the timeout", tt.name, elapsed)
+			}
+		}
+	})
+}
+
+// openTestDatabase connects to a Postgres for the test and migrates a schema of its own,
+// which is dropped again when the test finishes
+func openTestDatabase(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		url = startPostgres(t)
+	}
+
+	admin, err := db.Connect(context.Background(), url, db.PoolConfig{})
+	if err != nil {
+		t.Fatalf("connect to test database: %v", err)
+	}
+	t.Cleanup(admin.Close)
+
+	schema := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if _, err := admin.Exec(context.Background(), `CREATE SCHEMA `+schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(context.Background(), `DROP SCHEMA `+schema+` CASCADE`); err != nil {
+			t.Errorf("drop schema: %v", err)
+		}
+	})
+
+	database, err := db.Connect(context.Background(), withSearchPath(url, schema), db.PoolConfig{})
+	if err != nil {
+		t.Fatalf("connect to test schema: %v", err)
+	}
+	t.Cleanup(database.Close)
+
+	migrator, err := db.NewMigrator(database)
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return database
+}
+
+// withSearchPath points a connection string at a schema, in either URL or key=value form
+func withSearchPath(url, schema string) string {
+	if !strings.Contains(url, "://") {
+		return url + " search_path=" + schema
+	}
+	if strings.Contains(url, "?") {
+		return url + "&search_path=" + schema
+	}
+	return url + "?search_path=" + schema
+}
+
+// startPostgres initialises a cluster in a temporary directory and starts it listening only
+// on a socket there, returning its connection string. It skips the test if there's no
+// Postgres installed.
+func startPostgres(t *testing.T) string {
+	t.Helper()
+
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		t.Skip("no TEST_DATABASE_URL and no initdb on the PATH")
+	}
+	pgCtl := filepath.Join(filepath.Dir(initdb), "pg_ctl")
+
+	// Kept short, the socket path has to fit in a sockaddr
+	dir, err := os.MkdirTemp("", "pg")
+	if err != nil {
+		t.Fatalf("create cluster directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	data := filepath.Join(dir, "data")
+
+	if out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "-A", "trust", "-E", "UTF8").CombinedOutput(); err != nil {
+		// initdb won't run as root, among other things
+		t.Skipf("initdb failed: %v\n%s", err, out)
+	}
+	options := fmt.Sprintf("-k %s -c listen_addresses=''", dir)
+	if out, err := exec.Command(pgCtl, "-D", data, "-o", options, "-l", filepath.Join(dir, "log"), "-w", "start").CombinedOutput(); err != nil {
+		t.Fatalf("start postgres: %v\n%s", err, out)
+	}
+	t.Cleanup(func() {
+		if out, err := exec.Command(pgCtl, "-D", data, "-m", "immediate", "-w", "stop").CombinedOutput(); err != nil {
+			t.Errorf("stop postgres: %v\n%s", err, out)
+		}
+	})
+
+	return fmt.Sprintf("host=%s user=postgres dbname=postgres sslmode=disable", dir)
+}
@@ -1,53 +1,109 @@
 package models
 
 import (
-	"database/sql"
+	"context"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
 )
 
 // RefreshToken represents a refresh token in the system
 type RefreshToken struct {
 	ID        uuid.UUID
 	UserID    uuid.UUID
-	Token     string
+	FamilyID  uuid.UUID
+	TokenHash string
 	ExpiresAt time.Time
 	CreatedAt time.Time
 	Revoked   bool
+	// Client is where the token was issued, every rotation records the client that refreshed
+	Client ClientInfo
+	// LastUsedAt is when the token was exchanged for its replacement
+	LastUsedAt *time.Time
+	// AccessToken is the access token issued alongside this refresh token
+	AccessToken AccessTokenRef
+}
+
+// AccessTokenRef identifies an issued access token by its jti and expiry
+type AccessTokenRef struct {
+	JTI       string
+	ExpiresAt time.Time
+}
+
+// Session is a token family as shown to its user: the client of its newest token,
+// when it was started and when it was last refreshed
+type Session struct {
+	ID         uuid.UUID
+	Client     ClientInfo
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+}
+
+// ClientInfo describes the device a refresh token was issued to
+type ClientInfo struct {
+	UserAgent   string
+	IPAddress   string
+	DeviceLabel string
+}
+
+// RefreshTokenStore stores refresh tokens and the sessions they make up. RefreshTokenRepository
+// keeps them in Postgres and MemoryRefreshTokenStore in memory.
+type RefreshTokenStore interface {
+	CreateRefreshToken(ctx context.Context, userID, familyID uuid.UUID, tokenHash string, ttl time.Duration, client ClientInfo, accessToken AccessTokenRef) (*RefreshToken, error)
+	GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	ConsumeRefreshToken(ctx context.Context, id uuid.UUID) (bool, error)
+	RevokeRefreshToken(ctx context.Context, tokenHash string) error
+	RevokeTokenFamily(ctx context.Context, familyID uuid.UUID) error
+	RevokeUserRefreshTokens(ctx context.Context, userID uuid.UUID) error
+	ListSessions(ctx context.Context, userID uuid.UUID) ([]Session, error)
+	RevokeUserTokenFamily(ctx context.Context, userID, familyID uuid.UUID) (bool, error)
+	RevokeOtherTokenFamilies(ctx context.Context, userID, keepFamilyID uuid.UUID) (int, error)
+	FamilyAccessTokens(ctx context.Context, familyID uuid.UUID) ([]AccessTokenRef, error)
+	UserAccessTokens(ctx context.Context, userID, exceptFamilyID uuid.UUID) ([]AccessTokenRef, error)
 }
 
 // RefreshTokenRepository handles database operations for refresh tokens
 type RefreshTokenRepository struct {
-	db *sql.DB
+	db       db.Querier
+	timeouts db.Timeouts
 }
 
 // NewRefreshTokenRepository creates a new refresh token repository
-func NewRefreshTokenRepository(db *sql.DB) *RefreshTokenRepository {
-	return &RefreshTokenRepository{db: db}
+func NewRefreshTokenRepository(database *pgxpool.Pool, timeouts db.Timeouts) *RefreshTokenRepository {
+	return &RefreshTokenRepository{db: database, timeouts: timeouts}
 }
 
-// CreateRefreshToken creates a new refresh token for a user
-func (r *RefreshTokenRepository) CreateRefreshToken(userID uuid.UUID, ttl time.Duration) (*RefreshToken, error) {
-	// Generate a unique token identifier
-	tokenID := uuid.New()
+// CreateRefreshToken stores the digest of a new refresh token for a user in the given token family.
+// A family groups every token issued by rotating the one created at login.
+func (r *RefreshTokenRepository) CreateRefreshToken(ctx context.Context, userID, familyID uuid.UUID, tokenHash string, ttl time.Duration, client ClientInfo, accessToken AccessTokenRef) (*RefreshToken, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
 	expiresAt := time.Now().Add(ttl)
 
 	token := &RefreshToken{
-		ID:        tokenID,
-		UserID:    userID,
-		Token:     tokenID.String(), // Use the UUID as the token
-		ExpiresAt: expiresAt,
-		CreatedAt: time.Now(),
-		Revoked:   false,
+		ID:          uuid.New(),
+		UserID:      userID,
+		FamilyID:    familyID,
+		TokenHash:   tokenHash,
+		ExpiresAt:   expiresAt,
+		CreatedAt:   time.Now(),
+		Revoked:     false,
+		Client:      client,
+		AccessToken: accessToken,
 	}
 
 	query := `
-        INSERT INTO refresh_tokens (id, user_id, token, expires_at, created_at, revoked)
-        VALUES ($1, $2, $3, $4, $5, $6)
+        INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at, created_at, revoked,
+                                    user_agent, ip_address, device_label, access_jti, access_expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
     `
 
-	_, err := r.db.Exec(query, token.ID, token.UserID, token.Token, token.ExpiresAt, token.CreatedAt, token.Revoked)
+	_, err := r.db.Exec(ctx, query, token.ID, token.UserID, token.FamilyID, token.TokenHash, token.ExpiresAt, token.CreatedAt, token.Revoked,
+		client.UserAgent, client.IPAddress, client.DeviceLabel, accessToken.JTI, accessToken.ExpiresAt)
 	if err != nil {
 		return nil, err
 	}
@@ -55,39 +111,232 @@ func (r *RefreshTokenRepository) CreateRefreshToken(userID uuid.UUID, ttl time.D
 	return token, nil
 }
 
-// GetRefreshToken retrieves a refresh token by its token string
-func (r *RefreshTokenRepository) GetRefreshToken(tokenString string) (*RefreshToken, error) {
-	query := `
-        SELECT id, user_id, token, expires_at, created_at, revoked
-        FROM refresh_tokens
-        WHERE token = $1
-    `
+// GetRefreshToken retrieves a refresh token by the digest of its token string
+func (r *RefreshTokenRepository) GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
 
 	var token RefreshToken
-	err := r.db.QueryRow(query, tokenString).Scan(
+	var accessJTI *string
+	var accessExpiresAt *time.Time
+	err := queryRowPrepared(ctx, r.db, stmtGetRefreshToken, tokenHash).Scan(
 		&token.ID,
 		&token.UserID,
-		&token.Token,
+		&token.FamilyID,
+		&token.TokenHash,
 		&token.ExpiresAt,
 		&token.CreatedAt,
 		&token.Revoked,
+		&token.Client.UserAgent,
+		&token.Client.IPAddress,
+		&token.Client.DeviceLabel,
+		&token.LastUsedAt,
+		&accessJTI,
+		&accessExpiresAt,
 	)
 
 	if err != nil {
 		return nil, err
 	}
+	if accessJTI != nil && accessExpiresAt != nil {
+		token.AccessToken = AccessTokenRef{JTI: *accessJTI, ExpiresAt: *accessExpiresAt}
+	}
 
 	return &token, nil
 }
 
-// RevokeRefreshToken marks a refresh token as revoked
-func (r *RefreshTokenRepository) RevokeRefreshToken(tokenString string) error {
+// ConsumeRefreshToken revokes an active refresh token so it can't be used again.
+// It reports false if the token was already revoked, which means someone else got there first.
+func (r *RefreshTokenRepository) ConsumeRefreshToken(ctx context.Context, id uuid.UUID) (bool, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE refresh_tokens
+        SET revoked = true, last_used_at = $2
+        WHERE id = $1 AND revoked = false
+    `
+
+	result, err := r.db.Exec(ctx, query, id, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	return result.RowsAffected() == 1, nil
+}
+
+// RevokeRefreshToken marks the refresh token with the given digest as revoked
+func (r *RefreshTokenRepository) RevokeRefreshToken(ctx context.Context, tokenHash string) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE refresh_tokens
+        SET revoked = true
+        WHERE token_hash = $1
+    `
+
+	_, err := r.db.Exec(ctx, query, tokenHash)
+	return err
+}
+
+// RevokeTokenFamily marks every refresh token in a family as revoked
+func (r *RefreshTokenRepository) RevokeTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
 	query := `
         UPDATE refresh_tokens
         SET revoked = true
-        WHERE token = $1
+        WHERE family_id = $1 AND revoked = false
     `
 
-	_, err := r.db.Exec(query, tokenString)
+	_, err := r.db.Exec(ctx, query, familyID)
 	return err
 }
+
+// RevokeUserRefreshTokens marks every refresh token belonging to a user as revoked
+func (r *RefreshTokenRepository) RevokeUserRefreshTokens(ctx context.Context, userID uuid.UUID) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE refresh_tokens
+        SET revoked = true
+        WHERE user_id = $1 AND revoked = false
+    `
+
+	_, err := r.db.Exec(ctx, query, userID)
+	return err
+}
+
+// ListSessions returns the user's active token families, most recently used first
+func (r *RefreshTokenRepository) ListSessions(ctx context.Context, userID uuid.UUID) ([]Session, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	// The live token of a family is its only unrevoked one, the family started with its oldest token
+	query := `
+        SELECT t.family_id, t.user_agent, t.ip_address, t.device_label, f.started_at, t.created_at, t.expires_at
+        FROM refresh_tokens t
+        JOIN (
+            SELECT family_id, MIN(created_at) AS started_at
+            FROM refresh_tokens
+            WHERE user_id = $1
+            GROUP BY family_id
+        ) f ON f.family_id = t.family_id
+        WHERE t.user_id = $1 AND t.revoked = false AND t.expires_at > $2
+        ORDER BY t.created_at DESC
+    `
+
+	rows, err := r.db.Query(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(
+			&session.ID,
+			&session.Client.UserAgent,
+			&session.Client.IPAddress,
+			&session.Client.DeviceLabel,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeUserTokenFamily revokes a token family if it belongs to the user and is still active.
+// It reports false if there was nothing to revoke.
+func (r *RefreshTokenRepository) RevokeUserTokenFamily(ctx context.Context, userID, familyID uuid.UUID) (bool, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE refresh_tokens
+        SET revoked = true
+        WHERE user_id = $1 AND family_id = $2 AND revoked = false
+    `
+
+	result, err := r.db.Exec(ctx, query, userID, familyID)
+	if err != nil {
+		return false, err
+	}
+
+	return result.RowsAffected() > 0, nil
+}
+
+// RevokeOtherTokenFamilies revokes all of the user's refresh tokens except those in the given family,
+// returning how many sessions were ended
+func (r *RefreshTokenRepository) RevokeOtherTokenFamilies(ctx context.Context, userID, keepFamilyID uuid.UUID) (int, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        WITH revoked AS (
+            UPDATE refresh_tokens
+            SET revoked = true
+            WHERE user_id = $1 AND family_id <> $2 AND revoked = false
+            RETURNING family_id
+        )
+        SELECT COUNT(DISTINCT family_id) FROM revoked
+    `
+
+	var count int
+	err := r.db.QueryRow(ctx, query, userID, keepFamilyID).Scan(&count)
+	return count, err
+}
+
+// FamilyAccessTokens returns the unexpired access tokens issued in a token family
+func (r *RefreshTokenRepository) FamilyAccessTokens(ctx context.Context, familyID uuid.UUID) ([]AccessTokenRef, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	query := `
+        SELECT access_jti, access_expires_at
+        FROM refresh_tokens
+        WHERE family_id = $1 AND access_jti IS NOT NULL AND access_expires_at > $2
+    `
+	return r.queryAccessTokens(ctx, query, familyID, time.Now())
+}
+
+// UserAccessTokens returns the user's unexpired access tokens outside the given family,
+// pass uuid.Nil to include every family
+func (r *RefreshTokenRepository) UserAccessTokens(ctx context.Context, userID, exceptFamilyID uuid.UUID) ([]AccessTokenRef, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	query := `
+        SELECT access_jti, access_expires_at
+        FROM refresh_tokens
+        WHERE user_id = $1 AND family_id <> $2 AND access_jti IS NOT NULL AND access_expires_at > $3
+    `
+	return r.queryAccessTokens(ctx, query, userID, exceptFamilyID, time.Now())
+}
+
+// queryAccessTokens scans the jti and expiry pairs selected by query
+func (r *RefreshTokenRepository) queryAccessTokens(ctx context.Context, query string, args ...any) ([]AccessTokenRef, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []AccessTokenRef
+	for rows.Next() {
+		var ref AccessTokenRef
+		if err := rows.Scan(&ref.JTI, &ref.ExpiresAt); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// Names of the prepared statements for the lookups every login and refresh makes
+const (
+	stmtGetUserByEmail  = "get_user_by_email"
+	stmtGetRefreshToken = "get_refresh_token"
+)
+
+// statements is the SQL behind each named statement
+var statements = map[string]string{
+	stmtGetUserByEmail: `SELECT ` + userColumns + ` FROM users WHERE email = $1`,
+	stmtGetRefreshToken: `
+        SELECT id, user_id, family_id, token_hash, expires_at, created_at, revoked,
+               user_agent, ip_address, device_label, last_used_at, access_jti, access_expires_at
+        FROM refresh_tokens
+        WHERE token_hash = $1
+    `,
+}
+
+// queryRowPrepared runs a named statement that returns at most one row. The statement is
+// prepared on whichever connection runs it the first time that connection does, rather than
+// when the pool opens it, so connecting works before the tables have been migrated.
+func queryRowPrepared(ctx context.Context, q db.Querier, name string, args ...any) pgx.Row {
+	return preparedRow{ctx: ctx, q: q, name: name, args: args}
+}
+
+// preparedRow runs its statement when it's scanned, like the row QueryRow returns
+type preparedRow struct {
+	ctx  context.Context
+	q    db.Querier
+	name string
+	args []any
+}
+
+// Scan prepares the statement if needed, runs it and reads the row into dest
+func (r preparedRow) Scan(dest ...any) error {
+	switch q := r.q.(type) {
+	case *pgxpool.Pool:
+		conn, err := q.Acquire(r.ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+		return r.scan(conn.Conn(), dest)
+	case pgx.Tx:
+		// Queries on the transaction's connection are part of the transaction
+		return r.scan(q.Conn(), dest)
+	default:
+		return fmt.Errorf("can't prepare statements on %T", r.q)
+	}
+}
+
+func (r preparedRow) scan(conn *pgx.Conn, dest []any) error {
+	// Prepare is a no-op when the connection already has the statement
+	if _, err := conn.Prepare(r.ctx, r.name, statements[r.name]); err != nil {
+		return err
+	}
+	return conn.QueryRow(r.ctx, r.name, r.args...).Scan(dest...)
+}
@@ -0,0 +1,699 @@
+package models_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/models"
+)
+
+// stores is one implementation of every store, the contract tests below run against each
+type stores struct {
+	Users         models.UserStore
+	RefreshTokens models.RefreshTokenStore
+	UserTokens    models.UserTokenStore
+	MFA           models.MFAStore
+	WebAuthn      models.WebAuthnStore
+	LoginHistory  models.LoginHistoryStore
+	Tx            models.Transactor
+}
+
+// testStores runs the store contract against the stores open returns, open is called once
+// per subtest so each starts from its own state
+func testStores(t *testing.T, open func(t *testing.T) stores) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s stores)
+	}{
+		{"users", testUsers},
+		{"failed logins", testFailedLogins},
+		{"login history", testLoginHistory},
+		{"refresh tokens", testRefreshTokens},
+		{"sessions", testSessions},
+		{"access tokens", testAccessTokens},
+		{"user tokens", testUserTokens},
+		{"user token rate", testUserTokenRate},
+		{"totp", testTOTP},
+		{"recovery codes", testRecoveryCodes},
+		{"webauthn credentials", testWebAuthnCredentials},
+		{"webauthn sessions", testWebAuthnSessions},
+		{"transactions", testTransactions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, open(t))
+		})
+	}
+}
+
+// createUser adds a user with a unique email
+func createUser(t *testing.T, s stores) *models.User {
+	t.Helper()
+	user, err := s.Users.CreateUser(context.Background(), uuid.NewString()+"@example.com", "Test User", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	return user
+}
+
+func testUsers(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+	if user.Role != models.RoleUser || user.EmailVerifiedAt != nil || user.CreatedAt.IsZero() {
+		t.Errorf("CreateUser() = %+v, want an unverified user with the default role", user)
+	}
+
+	if _, err := s.Users.CreateUser(ctx, user.Email, "Someone Else", "hash"); !errors.Is(err, models.ErrEmailInUse) {
+		t.Errorf("CreateUser() with a taken email error = %v, want %v", err, models.ErrEmailInUse)
+	}
+
+	lookups := []struct {
+		name    string
+		get     func() (*models.User, error)
+		wantErr error
+	}{
+		{name: "by email", get: func() (*models.User, error) { return s.Users.GetUserByEmail(ctx, user.Email) }},
+		{name: "by id", get: func() (*models.User, error) { return s.Users.GetUserByID(ctx, user.ID) }},
+		{name: "unknown email", get: func() (*models.User, error) { return s.Users.GetUserByEmail(ctx, "nobody@example.com") }, wantErr: sql.ErrNoRows},
+		{name: "unknown id", get: func() (*models.User, error) { return s.Users.GetUserByID(ctx, uuid.New()) }, wantErr: sql.ErrNoRows},
+	}
+	for _, tt := range lookups {
+		got, err := tt.get()
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.ID != user.ID {
+			t.Errorf("%s: found %s, want %s", tt.name, got.ID, user.ID)
+		}
+	}
+
+	if err := s.Users.MarkEmailVerified(ctx, user.ID); err != nil {
+		t.Fatalf("MarkEmailVerified() error = %v", err)
+	}
+	if err := s.Users.UpdatePassword(ctx, user.ID, "new hash"); err != nil {
+		t.Fatalf("UpdatePassword() error = %v", err)
+	}
+	if err := s.Users.SetRole(ctx, user.Email, models.RoleAdmin); err != nil {
+		t.Fatalf("SetRole() error = %v", err)
+	}
+	if err := s.Users.SetRole(ctx, "nobody@example.com", models.RoleAdmin); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SetRole() for an unknown email error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	got, err := s.Users.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID() error = %v", err)
+	}
+	if got.EmailVerifiedAt == nil || got.PasswordHash != "new hash" || got.Role != models.RoleAdmin {
+		t.Errorf("after updates got %+v, want a verified admin with the new hash", got)
+	}
+}
+
+func testFailedLogins(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+
+	for want := 1; want <= 3; want++ {
+		count, err := s.Users.RecordFailedLogin(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("RecordFailedLogin() error = %v", err)
+		}
+		if count != want {
+			t.Errorf("RecordFailedLogin() = %d, want %d", count, want)
+		}
+	}
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := s.Users.LockUser(ctx, user.ID, until); err != nil {
+		t.Fatalf("LockUser() error = %v", err)
+	}
+	got, _ := s.Users.GetUserByID(ctx, user.ID)
+	if got.LockedUntil == nil || !got.LockedUntil.Equal(until) {
+		t.Errorf("LockedUntil = %v, want %v", got.LockedUntil, until)
+	}
+
+	if err := s.Users.ResetFailedLogins(ctx, user.ID); err != nil {
+		t.Fatalf("ResetFailedLogins() error = %v", err)
+	}
+	got, _ = s.Users.GetUserByID(ctx, user.ID)
+	if got.FailedLoginCount != 0 || got.LockedUntil != nil {
+		t.Errorf("after reset failed count = %d, locked until = %v, want both cleared", got.FailedLoginCount, got.LockedUntil)
+	}
+}
+
+func testLoginHistory(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+	other := createUser(t, s)
+
+	if user.LastLogin != nil {
+		t.Errorf("new user LastLogin = %v, want nil", user.LastLogin)
+	}
+	if err := s.Users.UpdateLastLogin(ctx, user.ID); err != nil {
+		t.Fatalf("UpdateLastLogin() error = %v", err)
+	}
+	if got, _ := s.Users.GetUserByID(ctx, user.ID); got.LastLogin == nil {
+		t.Error("after UpdateLastLogin() LastLogin = nil, want it set")
+	}
+
+	client := models.ClientInfo{UserAgent: "Firefox", IPAddress: "192.0.2.1"}
+	attempts := []struct {
+		userID  uuid.UUID
+		method  string
+		outcome string
+	}{
+		{user.ID, models.LoginMethodPassword, models.LoginOutcomeFailure},
+		{user.ID, models.LoginMethodPassword, models.LoginOutcomeSuccess},
+		{other.ID, models.LoginMethodPassword, models.LoginOutcomeSuccess},
+		{user.ID, models.LoginMethodPasskey, models.LoginOutcomeSuccess},
+	}
+	for _, a := range attempts {
+		if err := s.LoginHistory.RecordLogin(ctx, a.userID, a.method, a.outcome, client); err != nil {
+			t.Fatalf("RecordLogin() error = %v", err)
+		}
+	}
+
+	records, err := s.LoginHistory.ListLogins(ctx, user.ID, 10)
+	if err != nil {
+		t.Fatalf("ListLogins() error = %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("ListLogins() returned %d records, want 3: %+v", len(records), records)
+	}
+	if records[0].Method != models.LoginMethodPasskey || records[2].Outcome != models.LoginOutcomeFailure {
+		t.Errorf("ListLogins() = %+v, want the passkey login first and the failure last", records)
+	}
+	if records[0].UserID != user.ID || records[0].UserAgent != "Firefox" || records[0].IPAddress != "192.0.2.1" || records[0].CreatedAt.IsZero() {
+		t.Errorf("ListLogins()[0] = %+v, want the user's client and a timestamp", records[0])
+	}
+
+	if records, _ := s.LoginHistory.ListLogins(ctx, user.ID, 2); len(records) != 2 || records[0].Method != models.LoginMethodPasskey {
+		t.Errorf("ListLogins() with limit 2 = %+v, want the two most recent", records)
+	}
+}
+
+func testRefreshTokens(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+	family := uuid.New()
+	client := models.ClientInfo{UserAgent: "test", IPAddress: "192.0.2.1", DeviceLabel: "Laptop"}
+
+	token, err := s.RefreshTokens.CreateRefreshToken(ctx, user.ID, family, "hash-1", time.Hour, client, models.AccessTokenRef{})
+	if err != nil {
+		t.Fatalf("CreateRefreshToken() error = %v", err)
+	}
+	got, err := s.RefreshTokens.GetRefreshToken(ctx, "hash-1")
+	if err != nil {
+		t.Fatalf("GetRefreshToken() error = %v", err)
+	}
+	if got.ID != token.ID || got.FamilyID != family || got.Client != client || got.Revoked {
+		t.Errorf("GetRefreshToken() = %+v, want the active token just created", got)
+	}
+	if _, err := s.RefreshTokens.GetRefreshToken(ctx, "unknown"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetRefreshToken() for an unknown hash error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	for i, want := range []bool{true, false} {
+		consumed, err := s.RefreshTokens.ConsumeRefreshToken(ctx, token.ID)
+		if err != nil {
+			t.Fatalf("ConsumeRefreshToken() error = %v", err)
+		}
+		if consumed != want {
+			t.Errorf("ConsumeRefreshToken() call %d = %v, want %v", i+1, consumed, want)
+		}
+	}
+	got, _ = s.RefreshTokens.GetRefreshToken(ctx, "hash-1")
+	if !got.Revoked || got.LastUsedAt == nil {
+		t.Errorf("consumed token = %+v, want it revoked with a last use", got)
+	}
+
+	revocations := []struct {
+		name   string
+		revoke func(hash string) error
+	}{
+		{name: "by hash", revoke: func(hash string) error { return s.RefreshTokens.RevokeRefreshToken(ctx, hash) }},
+		{name: "by family", revoke: func(string) error { return s.RefreshTokens.RevokeTokenFamily(ctx, family) }},
+		{name: "by user", revoke: func(string) error { return s.RefreshTokens.RevokeUserRefreshTokens(ctx, user.ID) }},
+	}
+	for _, tt := range revocations {
+		hash := "hash-" + tt.name
+		if _, err := s.RefreshTokens.CreateRefreshToken(ctx, user.ID, family, hash, time.Hour, client, models.AccessTokenRef{}); err != nil {
+			t.Fatalf("%s: CreateRefreshToken() error = %v", tt.name, err)
+		}
+		if err := tt.revoke(hash); err != nil {
+			t.Fatalf("%s: revoke error = %v", tt.name, err)
+		}
+		if got, _ := s.RefreshTokens.GetRefreshToken(ctx, hash); !got.Revoked {
+			t.Errorf("%s: token not revoked", tt.name)
+		}
+	}
+}
+
+func testSessions(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+	other := createUser(t, s)
+	laptop, phone, tablet := uuid.New(), uuid.New(), uuid.New()
+
+	create := func(userID, family uuid.UUID, hash string, ttl time.Duration, label string) {
+		t.Helper()
+		client := models.ClientInfo{DeviceLabel: label}
+		if _, err := s.RefreshTokens.CreateRefreshToken(ctx, userID, family, hash, ttl, client, models.AccessTokenRef{}); err != nil {
+			t.Fatalf("CreateRefreshToken() error = %v", err)
+		}
+	}
+	create(user.ID, laptop, "laptop-1", time.Hour, "Laptop")
+	time.Sleep(10 * time.Millisecond)
+	create(user.ID, phone, "phone-1", time.Hour, "Phone")
+	time.Sleep(10 * time.Millisecond)
+	// Rotating the laptop's token makes it the most recently used session
+	s.RefreshTokens.RevokeRefreshToken(ctx, "laptop-1")
+	create(user.ID, laptop, "laptop-2", time.Hour, "Laptop, refreshed")
+	create(user.ID, tablet, "tablet-1", -time.Minute, "Tablet")
+	create(other.ID, uuid.New(), "other-1", time.Hour, "Other")
+
+	sessions, err := s.RefreshTokens.ListSessions(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("ListSessions() error = %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("ListSessions() returned %d sessions, want 2: %+v", len(sessions), sessions)
+	}
+	if sessions[0].ID != laptop || sessions[0].Client.DeviceLabel != "Laptop, refreshed" || sessions[1].ID != phone {
+		t.Errorf("ListSessions() = %+v, want the refreshed laptop then the phone", sessions)
+	}
+	if !sessions[0].CreatedAt.Before(sessions[0].LastUsedAt) {
+		t.Errorf("laptop session created %v, last used %v, want it started before its refresh", sessions[0].CreatedAt, sessions[0].LastUsedAt)
+	}
+
+	revoked, err := s.RefreshTokens.RevokeUserTokenFamily(ctx, other.ID, phone)
+	if err != nil || revoked {
+		t.Errorf("RevokeUserTokenFamily() for someone else's session = %v, %v, want false", revoked, err)
+	}
+	revoked, err = s.RefreshTokens.RevokeUserTokenFamily(ctx, user.ID, phone)
+	if err != nil || !revoked {
+		t.Errorf("RevokeUserTokenFamily() = %v, %v, want true", revoked, err)
+	}
+
+	create(user.ID, tablet, "tablet-2", time.Hour, "Tablet")
+	count, err := s.RefreshTokens.RevokeOtherTokenFamilies(ctx, user.ID, laptop)
+	if err != nil {
+		t.Fatalf("RevokeOtherTokenFamilies() error = %v", err)
+	}
+	if count != 1 {
+		t.Errorf("RevokeOtherTokenFamilies() = %d, want 1", count)
+	}
+	if sessions, _ := s.RefreshTokens.ListSessions(ctx, user.ID); len(sessions) != 1 || sessions[0].ID != laptop {
+		t.Errorf("after revoking the others ListSessions() = %+v, want only the laptop", sessions)
+	}
+	if sessions, _ := s.RefreshTokens.ListSessions(ctx, other.ID); len(sessions) != 1 {
+		t.Errorf("other user's sessions = %+v, want theirs untouched", sessions)
+	}
+}
+
+func testAccessTokens(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+	laptop, phone := uuid.New(), uuid.New()
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	create := func(family uuid.UUID, hash string, ref models.AccessTokenRef) {
+		t.Helper()
+		if _, err := s.RefreshTokens.CreateRefreshToken(ctx, user.ID, family, hash, time.Hour, models.ClientInfo{}, ref); err != nil {
+			t.Fatalf("CreateRefreshToken() error = %v", err)
+		}
+	}
+	create(laptop, "laptop-1", models.AccessTokenRef{JTI: "laptop-jti", ExpiresAt: later})
+	create(laptop, "laptop-2", models.AccessTokenRef{JTI: "expired-jti", ExpiresAt: time.Now().Add(-time.Minute)})
+	create(phone, "phone-1", models.AccessTokenRef{JTI: "phone-jti", ExpiresAt: later})
+
+	tests := []struct {
+		name string
+		get  func() ([]models.AccessTokenRef, error)
+		want []string
+	}{
+		{name: "family", get: func() ([]models.AccessTokenRef, error) { return s.RefreshTokens.FamilyAccessTokens(ctx, laptop) }, want: []string{"laptop-jti"}},
+		{name: "user except family", get: func() ([]models.AccessTokenRef, error) { return s.RefreshTokens.UserAccessTokens(ctx, user.ID, laptop) }, want: []string{"phone-jti"}},
+		{name: "whole user", get: func() ([]models.AccessTokenRef, error) {
+			return s.RefreshTokens.UserAccessTokens(ctx, user.ID, uuid.Nil)
+		}, want: []string{"laptop-jti", "phone-jti"}},
+	}
+	for _, tt := range tests {
+		refs, err := tt.get()
+		if err != nil {
+			t.Fatalf("%s: error = %v", tt.name, err)
+		}
+		got := map[string]bool{}
+		for _, ref := range refs {
+			got[ref.JTI] = true
+			if !ref.ExpiresAt.Equal(later) {
+				t.Errorf("%s: %s expires %v, want %v", tt.name, ref.JTI, ref.ExpiresAt, later)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, refs, tt.want)
+			continue
+		}
+		for _, jti := range tt.want {
+			if !got[jti] {
+				t.Errorf("%s: missing %s in %v", tt.name, jti, refs)
+			}
+		}
+	}
+}
+
+func testUserTokens(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+	purpose := models.TokenPurposePasswordReset
+
+	token, err := s.UserTokens.CreateUserToken(ctx, user.ID, purpose, "reset", time.Hour)
+	if err != nil {
+		t.Fatalf("CreateUserToken() error = %v", err)
+	}
+	if _, err := s.UserTokens.CreateUserToken(ctx, user.ID, purpose, "expired", -time.Minute); err != nil {
+		t.Fatalf("CreateUserToken() error = %v", err)
+	}
+
+	lookups := []struct {
+		name    string
+		purpose string
+		hash    string
+		wantErr error
+	}{
+		{name: "usable", purpose: purpose, hash: "reset"},
+		{name: "other purpose", purpose: models.TokenPurposeEmailVerification, hash: "reset", wantErr: sql.ErrNoRows},
+		{name: "expired", purpose: purpose, hash: "expired", wantErr: sql.ErrNoRows},
+		{name: "unknown", purpose: purpose, hash: "unknown", wantErr: sql.ErrNoRows},
+	}
+	for _, tt := range lookups {
+		if _, err := s.UserTokens.GetUserToken(ctx, tt.purpose, tt.hash); !errors.Is(err, tt.wantErr) {
+			t.Errorf("GetUserToken() %s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	for want := 1; want <= 2; want++ {
+		attempts, err := s.UserTokens.IncrementUserTokenAttempts(ctx, token.ID)
+		if err != nil || attempts != want {
+			t.Errorf("IncrementUserTokenAttempts() = %d, %v, want %d", attempts, err, want)
+		}
+	}
+
+	consumed, err := s.UserTokens.ConsumeUserToken(ctx, purpose, "reset")
+	if err != nil {
+		t.Fatalf("ConsumeUserToken() error = %v", err)
+	}
+	if consumed.ID != token.ID || consumed.ConsumedAt == nil || consumed.UserID != user.ID {
+		t.Errorf("ConsumeUserToken() = %+v, want the token marked used", consumed)
+	}
+	if _, err := s.UserTokens.ConsumeUserToken(ctx, purpose, "reset"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ConsumeUserToken() again error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	challenge, _ := s.UserTokens.CreateUserToken(ctx, user.ID, models.TokenPurposeMFAChallenge, "challenge", time.Hour)
+	for i, want := range []bool{true, false} {
+		ok, err := s.UserTokens.ConsumeUserTokenByID(ctx, challenge.ID)
+		if err != nil || ok != want {
+			t.Errorf("ConsumeUserTokenByID() call %d = %v, %v, want %v", i+1, ok, err, want)
+		}
+	}
+
+	s.UserTokens.CreateUserToken(ctx, user.ID, purpose, "reset-2", time.Hour)
+	s.UserTokens.CreateUserToken(ctx, user.ID, purpose, "reset-3", time.Hour)
+	if err := s.UserTokens.ConsumeUserTokens(ctx, user.ID, purpose); err != nil {
+		t.Fatalf("ConsumeUserTokens() error = %v", err)
+	}
+	for _, hash := range []string{"reset-2", "reset-3"} {
+		if _, err := s.UserTokens.GetUserToken(ctx, purpose, hash); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("%s after ConsumeUserTokens(): error = %v, want %v", hash, err, sql.ErrNoRows)
+		}
+	}
+}
+
+func testUserTokenRate(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+	purpose := models.TokenPurposeEmailVerification
+	before := time.Now().Add(-time.Second)
+
+	count, latest, err := s.UserTokens.CountUserTokensSince(ctx, user.ID, purpose, before)
+	if err != nil || count != 0 || latest != nil {
+		t.Fatalf("CountUserTokensSince() with no tokens = %d, %v, %v, want 0, nil", count, latest, err)
+	}
+
+	var last *models.UserToken
+	for _, hash := range []string{"one", "two"} {
+		last, err = s.UserTokens.CreateUserToken(ctx, user.ID, purpose, hash, time.Hour)
+		if err != nil {
+			t.Fatalf("CreateUserToken() error = %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.UserTokens.CreateUserToken(ctx, user.ID, models.TokenPurposePasswordReset, "other", time.Hour)
+
+	count, latest, err = s.UserTokens.CountUserTokensSince(ctx, user.ID, purpose, before)
+	if err != nil {
+		t.Fatalf("CountUserTokensSince() error = %v", err)
+	}
+	if count != 2 {
+		t.Errorf("CountUserTokensSince() = %d, want 2", count)
+	}
+	if latest == nil || latest.Sub(last.CreatedAt).Abs() > time.Millisecond {
+		t.Errorf("latest = %v, want %v", latest, last.CreatedAt)
+	}
+	if count, _, _ := s.UserTokens.CountUserTokensSince(ctx, user.ID, purpose, time.Now().Add(time.Second)); count != 0 {
+		t.Errorf("CountUserTokensSince() from the future = %d, want 0", count)
+	}
+}
+
+func testTOTP(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+
+	if _, err := s.MFA.GetTOTP(ctx, user.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetTOTP() before enrolling error = %v, want %v", err, sql.ErrNoRows)
+	}
+	if err := s.MFA.SaveTOTP(ctx, user.ID, "first"); err != nil {
+		t.Fatalf("SaveTOTP() error = %v", err)
+	}
+	if err := s.MFA.SaveTOTP(ctx, user.ID, "second"); err != nil {
+		t.Fatalf("SaveTOTP() over an unconfirmed secret error = %v", err)
+	}
+	cred, err := s.MFA.GetTOTP(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetTOTP() error = %v", err)
+	}
+	if cred.SecretEncrypted != "second" || cred.ConfirmedAt != nil {
+		t.Errorf("GetTOTP() = %+v, want the unconfirmed second secret", cred)
+	}
+
+	if err := s.MFA.ConfirmTOTP(ctx, user.ID); err != nil {
+		t.Fatalf("ConfirmTOTP() error = %v", err)
+	}
+	if err := s.MFA.SaveTOTP(ctx, user.ID, "third"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SaveTOTP() over a confirmed secret error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	steps := []struct {
+		step int64
+		want bool
+	}{
+		{step: 100, want: true},
+		{step: 100, want: false},
+		{step: 99, want: false},
+		{step: 101, want: true},
+	}
+	for _, tt := range steps {
+		ok, err := s.MFA.UseTOTPStep(ctx, user.ID, tt.step)
+		if err != nil || ok != tt.want {
+			t.Errorf("UseTOTPStep(%d) = %v, %v, want %v", tt.step, ok, err, tt.want)
+		}
+	}
+
+	s.MFA.ReplaceRecoveryCodes(ctx, user.ID, []string{"code"})
+	if err := s.MFA.DeleteTOTP(ctx, user.ID); err != nil {
+		t.Fatalf("DeleteTOTP() error = %v", err)
+	}
+	if _, err := s.MFA.GetTOTP(ctx, user.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetTOTP() after DeleteTOTP() error = %v, want %v", err, sql.ErrNoRows)
+	}
+	if count, _ := s.MFA.CountRecoveryCodes(ctx, user.ID); count != 0 {
+		t.Errorf("%d recovery codes left after DeleteTOTP(), want 0", count)
+	}
+}
+
+func testRecoveryCodes(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+
+	if err := s.MFA.ReplaceRecoveryCodes(ctx, user.ID, []string{"a", "b", "c"}); err != nil {
+		t.Fatalf("ReplaceRecoveryCodes() error = %v", err)
+	}
+	uses := []struct {
+		code string
+		want bool
+	}{
+		{code: "a", want: true},
+		{code: "a", want: false},
+		{code: "unknown", want: false},
+	}
+	for _, tt := range uses {
+		ok, err := s.MFA.UseRecoveryCode(ctx, user.ID, tt.code)
+		if err != nil || ok != tt.want {
+			t.Errorf("UseRecoveryCode(%q) = %v, %v, want %v", tt.code, ok, err, tt.want)
+		}
+	}
+	if count, err := s.MFA.CountRecoveryCodes(ctx, user.ID); err != nil || count != 2 {
+		t.Errorf("CountRecoveryCodes() = %d, %v, want 2", count, err)
+	}
+
+	s.MFA.ReplaceRecoveryCodes(ctx, user.ID, []string{"d"})
+	if ok, _ := s.MFA.UseRecoveryCode(ctx, user.ID, "b"); ok {
+		t.Error("a replaced recovery code still works")
+	}
+	if count, _ := s.MFA.CountRecoveryCodes(ctx, user.ID); count != 1 {
+		t.Errorf("CountRecoveryCodes() after replacing = %d, want 1", count)
+	}
+}
+
+func testWebAuthnCredentials(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+	other := createUser(t, s)
+
+	for _, cred := range []*models.WebAuthnCredential{
+		{ID: []byte("key-1"), UserID: user.ID, PublicKey: []byte("pk-1"), Name: "Laptop", Transports: []string{"internal"}},
+		{ID: []byte("key-2"), UserID: user.ID, PublicKey: []byte("pk-2"), Name: "Security key", Transports: []string{"usb", "nfc"}},
+		{ID: []byte("key-3"), UserID: other.ID, PublicKey: []byte("pk-3"), Name: "Phone"},
+	} {
+		if err := s.WebAuthn.CreateCredential(ctx, cred); err != nil {
+			t.Fatalf("CreateCredential() error = %v", err)
+		}
+	}
+
+	creds, err := s.WebAuthn.ListCredentials(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("ListCredentials() error = %v", err)
+	}
+	if len(creds) != 2 || creds[0].Name != "Laptop" || len(creds[1].Transports) != 2 {
+		t.Fatalf("ListCredentials() = %+v, want the laptop then the security key", creds)
+	}
+
+	if err := s.WebAuthn.RecordCredentialUse(ctx, []byte("key-1"), 7, true, true); err != nil {
+		t.Fatalf("RecordCredentialUse() error = %v", err)
+	}
+	if err := s.WebAuthn.FlagCredentialCloned(ctx, []byte("key-2")); err != nil {
+		t.Fatalf("FlagCredentialCloned() error = %v", err)
+	}
+	creds, _ = s.WebAuthn.ListCredentials(ctx, user.ID)
+	if creds[0].SignCount != 7 || !creds[0].UserVerified || !creds[0].BackupState || creds[0].LastUsedAt == nil {
+		t.Errorf("used credential = %+v, want the new sign count, flags and last use", creds[0])
+	}
+	if !creds[1].CloneWarning {
+		t.Errorf("flagged credential = %+v, want a clone warning", creds[1])
+	}
+
+	deletes := []struct {
+		name    string
+		userID  uuid.UUID
+		id      string
+		wantErr error
+	}{
+		{name: "someone else's", userID: other.ID, id: "key-1", wantErr: sql.ErrNoRows},
+		{name: "own", userID: user.ID, id: "key-1"},
+		{name: "already deleted", userID: user.ID, id: "key-1", wantErr: sql.ErrNoRows},
+	}
+	for _, tt := range deletes {
+		if err := s.WebAuthn.DeleteCredential(ctx, tt.userID, []byte(tt.id)); !errors.Is(err, tt.wantErr) {
+			t.Errorf("DeleteCredential() %s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if creds, _ := s.WebAuthn.ListCredentials(ctx, user.ID); len(creds) != 1 {
+		t.Errorf("after deleting ListCredentials() = %+v, want one left", creds)
+	}
+}
+
+func testWebAuthnSessions(t *testing.T, s stores) {
+	ctx := context.Background()
+	user := createUser(t, s)
+
+	registration, err := s.WebAuthn.CreateSession(ctx, &user.ID, "registration", []byte(`{"challenge":"abc"}`), time.Minute)
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+	login, _ := s.WebAuthn.CreateSession(ctx, nil, "login", []byte(`{}`), time.Minute)
+	expired, _ := s.WebAuthn.CreateSession(ctx, nil, "login", []byte(`{}`), -time.Minute)
+
+	if _, err := s.WebAuthn.TakeSession(ctx, registration, "login"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("TakeSession() for the wrong purpose error = %v, want %v", err, sql.ErrNoRows)
+	}
+	session, err := s.WebAuthn.TakeSession(ctx, registration, "registration")
+	if err != nil {
+		t.Fatalf("TakeSession() error = %v", err)
+	}
+	if session.UserID == nil || *session.UserID != user.ID || string(session.Data) != `{"challenge":"abc"}` {
+		t.Errorf("TakeSession() = %+v, want the registration for %s", session, user.ID)
+	}
+
+	takes := []struct {
+		name string
+		id   uuid.UUID
+		want error
+	}{
+		{name: "taken twice", id: registration, want: sql.ErrNoRows},
+		{name: "expired", id: expired, want: sql.ErrNoRows},
+		{name: "unknown", id: uuid.New(), want: sql.ErrNoRows},
+		{name: "login without a user", id: login},
+	}
+	for _, tt := range takes {
+		purpose := "login"
+		if tt.id == registration {
+			purpose = "registration"
+		}
+		if _, err := s.WebAuthn.TakeSession(ctx, tt.id, purpose); !errors.Is(err, tt.want) {
+			t.Errorf("TakeSession() %s: error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func testTransactions(t *testing.T, s stores) {
+	ctx := context.Background()
+
+	var created *models.User
+	err := s.Tx.WithTx(ctx, func(ctx context.Context, tx models.Stores) error {
+		var err error
+		created, err = tx.Users.CreateUser(ctx, "tx@example.com", "Test User", "hash")
+		if err != nil {
+			return err
+		}
+		_, err = tx.RefreshTokens.CreateRefreshToken(ctx, created.ID, uuid.New(), "tx-hash", time.Hour, models.ClientInfo{}, models.AccessTokenRef{})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTx() error = %v", err)
+	}
+	if _, err := s.Users.GetUserByEmail(ctx, "tx@example.com"); err != nil {
+		t.Errorf("user created in a committed transaction: GetUserByEmail() error = %v", err)
+	}
+	if _, err := s.RefreshTokens.GetRefreshToken(ctx, "tx-hash"); err != nil {
+		t.Errorf("token created in a committed transaction: GetRefreshToken() error = %v", err)
+	}
+
+	errFailed := errors.New("failed")
+	if err := s.Tx.WithTx(ctx, func(ctx context.Context, tx models.Stores) error { return errFailed }); !errors.Is(err, errFailed) {
+		t.Errorf("WithTx() error = %v, want the error fn returned", err)
+	}
+
+	err = s.Tx.WithTx(ctx, func(ctx context.Context, tx models.Stores) error {
+		_, err := tx.Users.CreateUser(ctx, created.Email, "Someone Else", "hash")
+		return err
+	})
+	if !errors.Is(err, models.ErrEmailInUse) {
+		t.Errorf("WithTx() creating a taken email error = %v, want %v", err, models.ErrEmailInUse)
+	}
+}
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// Stores are the stores a unit of work can use, every one of them inside the same transaction
+type Stores struct {
+	Users         UserStore
+	RefreshTokens RefreshTokenStore
+	UserTokens    UserTokenStore
+	MFA           MFAStore
+	WebAuthn      WebAuthnStore
+	LoginHistory  LoginHistoryStore
+}
+
+// Transactor runs units of work that span several stores. TxManager runs them in a Postgres
+// transaction and MemoryTransactor one at a time in memory.
+type Transactor interface {
+	// WithTx runs fn with stores sharing one transaction, committing if fn returns nil and
+	// rolling back if it returns an error. fn may be run again when the transaction conflicts
+	// with another, so it shouldn't do anything outside the stores it's given.
+	WithTx(ctx context.Context, fn func(ctx context.Context, stores Stores) error) error
+}
+
+var _ Transactor = (*TxManager)(nil)
+
+// SQLSTATEs Postgres aborts a transaction with when retrying it may well succeed
+const (
+	serializationFailure = "40001"
+	deadlockDetected     = "40P01"
+)
+
+// maxTxAttempts is how many times a unit of work is tried before the conflict is returned
+const maxTxAttempts = 5
+
+// TxManager runs units of work in serializable transactions, so they behave as if nothing
+// else ran at the same time. Conflicts that Postgres detects are retried.
+type TxManager struct {
+	db       *pgxpool.Pool
+	timeouts db.Timeouts
+}
+
+// NewTxManager creates a transaction manager, the stores it hands out use the given timeouts
+func NewTxManager(database *pgxpool.Pool, timeouts db.Timeouts) *TxManager {
+	return &TxManager{db: database, timeouts: timeouts}
+}
+
+// WithTx runs fn in a serializable transaction, retrying it with a short jittered backoff
+// when it fails on a serialization failure or a deadlock
+func (m *TxManager) WithTx(ctx context.Context, fn func(ctx context.Context, stores Stores) error) error {
+	for attempt := 1; ; attempt++ {
+		err := m.run(ctx, fn)
+		if err == nil || !retryable(err) || attempt == maxTxAttempts {
+			return err
+		}
+		backoff := time.Duration(attempt)*10*time.Millisecond + rand.N(10*time.Millisecond)
+		slog.DebugContext(ctx, "transaction conflicted, retrying", "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// run makes one attempt at a unit of work
+func (m *TxManager) run(ctx context.Context, fn func(ctx context.Context, stores Stores) error) error {
+	tx, err := m.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	stores := Stores{
+		Users:         &UserRepository{db: tx, timeouts: m.timeouts},
+		RefreshTokens: &RefreshTokenRepository{db: tx, timeouts: m.timeouts},
+		UserTokens:    &UserTokenRepository{db: tx, timeouts: m.timeouts},
+		MFA:           &MFARepository{db: tx, timeouts: m.timeouts},
+		WebAuthn:      &WebAuthnRepository{db: tx, timeouts: m.timeouts},
+		LoginHistory:  &LoginHistoryRepository{db: tx, timeouts: m.timeouts},
+	}
+	if err := fn(ctx, stores); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// retryable reports whether a transaction failed only because it conflicted with another
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == serializationFailure || pgErr.Code == deadlockDetected
+}
@@ -1,46 +1,121 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// Roles a user can have
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
 )
 
 // User represents a user in our system
 type User struct {
-	ID           uuid.UUID
-	Email        string
-	Name         string
-	PasswordHash string
-	CreatedAt    time.Time
-	LastLogin    *time.Time
+	ID              uuid.UUID
+	Email           string
+	Name            string
+	PasswordHash    string
+	CreatedAt       time.Time
+	LastLogin       *time.Time
+	EmailVerifiedAt *time.Time
+	Role            string
+	// FailedLoginCount counts wrong passwords since the last successful login
+	FailedLoginCount int
+	LockedUntil      *time.Time
+}
+
+// ErrEmailInUse is returned by CreateUser when another user already has the email
+var ErrEmailInUse = errors.New("email already in use")
+
+// uniqueViolation is the SQLSTATE Postgres fails an insert with when it breaks a unique
+// constraint, and usersEmailKey the constraint on users.email
+const (
+	uniqueViolation = "23505"
+	usersEmailKey   = "users_email_key"
+)
+
+// UserStore stores users. UserRepository keeps them in Postgres and MemoryUserStore in memory.
+// Lookups return sql.ErrNoRows when there's no such user.
+type UserStore interface {
+	CreateUser(ctx context.Context, email, name, passwordHash string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetUserByID(ctx context.Context, id uuid.UUID) (*User, error)
+	MarkEmailVerified(ctx context.Context, id uuid.UUID) error
+	UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error
+	SetRole(ctx context.Context, email, role string) error
+	RecordFailedLogin(ctx context.Context, id uuid.UUID) (int, error)
+	LockUser(ctx context.Context, id uuid.UUID, until time.Time) error
+	ResetFailedLogins(ctx context.Context, id uuid.UUID) error
+	UpdateLastLogin(ctx context.Context, id uuid.UUID) error
 }
 
 // UserRepository handles database operations for users
 type UserRepository struct {
-	db *sql.DB
+	db       db.Querier
+	timeouts db.Timeouts
 }
 
 // NewUserRepository creates a new user repository
-func NewUserRepository(db *sql.DB) *UserRepository {
-	return &UserRepository{db: db}
+func NewUserRepository(database *pgxpool.Pool, timeouts db.Timeouts) *UserRepository {
+	return &UserRepository{db: database, timeouts: timeouts}
 }
 
-// CreateUser adds a new user to the database
-func (r *UserRepository) CreateUser(email, name, passwordHash string) (*User, error) {
+// userColumns is the column list scanUser expects
+const userColumns = `id, email, name, password_hash, created_at, last_login, email_verified_at, role, failed_login_count, locked_until`
+
+// scanUser reads a row selected with userColumns
+func scanUser(row pgx.Row) (*User, error) {
+	var user User
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.Name,
+		&user.PasswordHash,
+		&user.CreatedAt,
+		&user.LastLogin,
+		&user.EmailVerifiedAt,
+		&user.Role,
+		&user.FailedLoginCount,
+		&user.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateUser adds a new user to the database, returning ErrEmailInUse if the email is taken
+func (r *UserRepository) CreateUser(ctx context.Context, email, name, passwordHash string) (*User, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
 	user := &User{
 		ID:           uuid.New(),
 		Email:        email,
 		Name:         name,
 		PasswordHash: passwordHash,
 		CreatedAt:    time.Now(),
+		Role:         RoleUser,
 	}
 	query := `
-        INSERT INTO users (id, email, name, password_hash, created_at)
-        VALUES ($1, $2, $3, $4, $5)
+        INSERT INTO users (id, email, name, password_hash, created_at, role)
+        VALUES ($1, $2, $3, $4, $5, $6)
     `
-	_, err := r.db.Exec(query, user.ID, user.Email, user.Name, user.PasswordHash, user.CreatedAt)
+	_, err := r.db.Exec(ctx, query, user.ID, user.Email, user.Name, user.PasswordHash, user.CreatedAt, user.Role)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation && pgErr.ConstraintName == usersEmailKey {
+		return nil, ErrEmailInUse
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -48,45 +123,105 @@ func (r *UserRepository) CreateUser(email, name, passwordHash string) (*User, er
 }
 
 // GetUserByEmail retrieves a user by their email address
-func (r *UserRepository) GetUserByEmail(email string) (*User, error) {
-	query := `SELECT id, email, name, password_hash, created_at, last_login FROM users WHERE email = $1`
-	var user User
-	var lastLogin sql.NullTime
-	err := r.db.QueryRow(query, email).Scan(
-		&user.ID,
-		&user.Email,
-		&user.Name,
-		&user.PasswordHash,
-		&user.CreatedAt,
-		&lastLogin,
-	)
-	if err != nil {
-		return nil, err
-	}
-	if lastLogin.Valid {
-		user.LastLogin = &lastLogin.Time
-	}
-	return &user, nil
+func (r *UserRepository) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	return scanUser(queryRowPrepared(ctx, r.db, stmtGetUserByEmail, email))
 }
 
 // GetUserByID retrieves a user by their ID
-func (r *UserRepository) GetUserByID(id uuid.UUID) (*User, error) {
-	query := `SELECT id, email, name, password_hash, created_at, last_login FROM users WHERE id = $1`
-	var user User
-	var lastLogin sql.NullTime
-	err := r.db.QueryRow(query, id).Scan(
-		&user.ID,
-		&user.Email,
-		&user.Name,
-		&user.PasswordHash,
-		&user.CreatedAt,
-		&lastLogin,
-	)
+func (r *UserRepository) GetUserByID(ctx context.Context, id uuid.UUID) (*User, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	return scanUser(r.db.QueryRow(ctx, query, id))
+}
+
+// MarkEmailVerified records that the user proved they own their email address
+func (r *UserRepository) MarkEmailVerified(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE users
+        SET email_verified_at = $2
+        WHERE id = $1 AND email_verified_at IS NULL
+    `
+	_, err := r.db.Exec(ctx, query, id, time.Now())
+	return err
+}
+
+// UpdatePassword replaces the user's password hash
+func (r *UserRepository) UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `UPDATE users SET password_hash = $2 WHERE id = $1`
+	_, err := r.db.Exec(ctx, query, id, passwordHash)
+	return err
+}
+
+// SetRole changes the role of the user with the given email, returning sql.ErrNoRows if there's no such user
+func (r *UserRepository) SetRole(ctx context.Context, email, role string) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	result, err := r.db.Exec(ctx, `UPDATE users SET role = $2 WHERE email = $1`, email, role)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if lastLogin.Valid {
-		user.LastLogin = &lastLogin.Time
+	if result.RowsAffected() == 0 {
+		return sql.ErrNoRows
 	}
-	return &user, nil
+	return nil
+}
+
+// RecordFailedLogin counts a wrong password against the user and returns the new count
+func (r *UserRepository) RecordFailedLogin(ctx context.Context, id uuid.UUID) (int, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE users
+        SET failed_login_count = failed_login_count + 1
+        WHERE id = $1
+        RETURNING failed_login_count
+    `
+	var count int
+	err := r.db.QueryRow(ctx, query, id).Scan(&count)
+	return count, err
+}
+
+// LockUser refuses logins for the user until the given time
+func (r *UserRepository) LockUser(ctx context.Context, id uuid.UUID, until time.Time) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	_, err := r.db.Exec(ctx, `UPDATE users SET locked_until = $2 WHERE id = $1`, id, until)
+	return err
+}
+
+// ResetFailedLogins clears the failed login count and any lockout after a successful login
+func (r *UserRepository) ResetFailedLogins(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE users
+        SET failed_login_count = 0, locked_until = NULL
+        WHERE id = $1 AND (failed_login_count > 0 OR locked_until IS NOT NULL)
+    `
+	_, err := r.db.Exec(ctx, query, id)
+	return err
+}
+
+// UpdateLastLogin records that the user just logged in or refreshed their session
+func (r *UserRepository) UpdateLastLogin(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	_, err := r.db.Exec(ctx, `UPDATE users SET last_login = $2 WHERE id = $1`, id, time.Now())
+	return err
 }
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// Purposes a UserToken can be issued for
+const (
+	TokenPurposeEmailVerification = "email_verification"
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeMFAChallenge      = "mfa_challenge"
+)
+
+// UserToken is a single-use token sent to a user, only its digest is stored
+type UserToken struct {
+	ID         uuid.UUID
+	UserID     uuid.UUID
+	Purpose    string
+	TokenHash  string
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+	ConsumedAt *time.Time
+	Attempts   int
+}
+
+// UserTokenStore stores single-use user tokens. UserTokenRepository keeps them in Postgres
+// and MemoryUserTokenStore in memory.
+type UserTokenStore interface {
+	CreateUserToken(ctx context.Context, userID uuid.UUID, purpose, tokenHash string, ttl time.Duration) (*UserToken, error)
+	ConsumeUserToken(ctx context.Context, purpose, tokenHash string) (*UserToken, error)
+	GetUserToken(ctx context.Context, purpose, tokenHash string) (*UserToken, error)
+	IncrementUserTokenAttempts(ctx context.Context, id uuid.UUID) (int, error)
+	ConsumeUserTokenByID(ctx context.Context, id uuid.UUID) (bool, error)
+	CountUserTokensSince(ctx context.Context, userID uuid.UUID, purpose string, since time.Time) (int, *time.Time, error)
+	ConsumeUserTokens(ctx context.Context, userID uuid.UUID, purpose string) error
+}
+
+// UserTokenRepository handles database operations for single-use user tokens
+type UserTokenRepository struct {
+	db       db.Querier
+	timeouts db.Timeouts
+}
+
+// NewUserTokenRepository creates a new user token repository
+func NewUserTokenRepository(database *pgxpool.Pool, timeouts db.Timeouts) *UserTokenRepository {
+	return &UserTokenRepository{db: database, timeouts: timeouts}
+}
+
+// userTokenColumns is the column list scanUserToken expects
+const userTokenColumns = `id, user_id, purpose, token_hash, expires_at, created_at, consumed_at, attempts`
+
+// scanUserToken reads a row selected with userTokenColumns
+func scanUserToken(row pgx.Row) (*UserToken, error) {
+	var token UserToken
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Purpose,
+		&token.TokenHash,
+		&token.ExpiresAt,
+		&token.CreatedAt,
+		&token.ConsumedAt,
+		&token.Attempts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// CreateUserToken stores the digest of a new token for a user
+func (r *UserTokenRepository) CreateUserToken(ctx context.Context, userID uuid.UUID, purpose, tokenHash string, ttl time.Duration) (*UserToken, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	token := &UserToken{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(ttl),
+		CreatedAt: time.Now(),
+	}
+
+	query := `
+        INSERT INTO user_tokens (id, user_id, purpose, token_hash, expires_at, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+    `
+
+	_, err := r.db.Exec(ctx, query, token.ID, token.UserID, token.Purpose, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// ConsumeUserToken marks an unexpired, unused token as used and returns it.
+// It returns sql.ErrNoRows if there's no such token, so each token works exactly once.
+func (r *UserTokenRepository) ConsumeUserToken(ctx context.Context, purpose, tokenHash string) (*UserToken, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE user_tokens
+        SET consumed_at = $3
+        WHERE token_hash = $1 AND purpose = $2 AND consumed_at IS NULL AND expires_at > $3
+        RETURNING ` + userTokenColumns + `
+    `
+	return scanUserToken(r.db.QueryRow(ctx, query, tokenHash, purpose, time.Now()))
+}
+
+// GetUserToken retrieves an unexpired, unused token without consuming it
+func (r *UserTokenRepository) GetUserToken(ctx context.Context, purpose, tokenHash string) (*UserToken, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	query := `
+        SELECT ` + userTokenColumns + `
+        FROM user_tokens
+        WHERE token_hash = $1 AND purpose = $2 AND consumed_at IS NULL AND expires_at > $3
+    `
+	return scanUserToken(r.db.QueryRow(ctx, query, tokenHash, purpose, time.Now()))
+}
+
+// IncrementUserTokenAttempts records a failed attempt against a token and returns the new count
+func (r *UserTokenRepository) IncrementUserTokenAttempts(ctx context.Context, id uuid.UUID) (int, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `UPDATE user_tokens SET attempts = attempts + 1 WHERE id = $1 RETURNING attempts`
+	var attempts int
+	err := r.db.QueryRow(ctx, query, id).Scan(&attempts)
+	return attempts, err
+}
+
+// ConsumeUserTokenByID marks a specific token as used, reporting false if it already was
+func (r *UserTokenRepository) ConsumeUserTokenByID(ctx context.Context, id uuid.UUID) (bool, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `UPDATE user_tokens SET consumed_at = $2 WHERE id = $1 AND consumed_at IS NULL`
+	result, err := r.db.Exec(ctx, query, id, time.Now())
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// CountUserTokensSince counts the tokens issued to a user for a purpose since a point in time,
+// and returns when the latest one was issued
+func (r *UserTokenRepository) CountUserTokensSince(ctx context.Context, userID uuid.UUID, purpose string, since time.Time) (int, *time.Time, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	query := `
+        SELECT COUNT(*), MAX(created_at)
+        FROM user_tokens
+        WHERE user_id = $1 AND purpose = $2 AND created_at > $3
+    `
+
+	var count int
+	var latest *time.Time
+	if err := r.db.QueryRow(ctx, query, userID, purpose, since).Scan(&count, &latest); err != nil {
+		return 0, nil, err
+	}
+	return count, latest, nil
+}
+
+// ConsumeUserTokens marks every outstanding token a user has for a purpose as used
+func (r *UserTokenRepository) ConsumeUserTokens(ctx context.Context, userID uuid.UUID, purpose string) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE user_tokens
+        SET consumed_at = $3
+        WHERE user_id = $1 AND purpose = $2 AND consumed_at IS NULL
+    `
+
+	_, err := r.db.Exec(ctx, query, userID, purpose, time.Now())
+	return err
+}
@@ -0,0 +1,16 @@
+package models
+
+import "strings"
+
+// joinList stores a short list of simple values in a text column
+func joinList(values []string) string {
+	return strings.Join(values, ",")
+}
+
+// splitList reverses joinList
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
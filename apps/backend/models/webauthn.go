@@ -0,0 +1,215 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// WebAuthnCredential is a passkey registered to a user
+type WebAuthnCredential struct {
+	ID              []byte
+	UserID          uuid.UUID
+	Name            string
+	PublicKey       []byte
+	AttestationType string
+	AAGUID          []byte
+	SignCount       uint32
+	Transports      []string
+	UserVerified    bool
+	BackupEligible  bool
+	BackupState     bool
+	CloneWarning    bool
+	CreatedAt       time.Time
+	LastUsedAt      *time.Time
+}
+
+// WebAuthnSession holds a ceremony's state between its begin and finish calls
+type WebAuthnSession struct {
+	ID        uuid.UUID
+	UserID    *uuid.UUID
+	Purpose   string
+	Data      []byte
+	ExpiresAt time.Time
+}
+
+// WebAuthnStore stores passkeys and ceremony state. WebAuthnRepository keeps them in Postgres
+// and MemoryWebAuthnStore in memory.
+type WebAuthnStore interface {
+	CreateCredential(ctx context.Context, cred *WebAuthnCredential) error
+	ListCredentials(ctx context.Context, userID uuid.UUID) ([]*WebAuthnCredential, error)
+	RecordCredentialUse(ctx context.Context, id []byte, signCount uint32, userVerified, backupState bool) error
+	FlagCredentialCloned(ctx context.Context, id []byte) error
+	DeleteCredential(ctx context.Context, userID uuid.UUID, id []byte) error
+	CreateSession(ctx context.Context, userID *uuid.UUID, purpose string, data []byte, ttl time.Duration) (uuid.UUID, error)
+	TakeSession(ctx context.Context, id uuid.UUID, purpose string) (*WebAuthnSession, error)
+}
+
+// WebAuthnRepository handles database operations for passkeys and their ceremonies
+type WebAuthnRepository struct {
+	db       db.Querier
+	timeouts db.Timeouts
+}
+
+// NewWebAuthnRepository creates a new WebAuthn repository
+func NewWebAuthnRepository(database *pgxpool.Pool, timeouts db.Timeouts) *WebAuthnRepository {
+	return &WebAuthnRepository{db: database, timeouts: timeouts}
+}
+
+// webAuthnCredentialColumns is the column list scanWebAuthnCredential expects
+const webAuthnCredentialColumns = `id, user_id, name, public_key, attestation_type, aaguid, sign_count, transports,
+        user_verified, backup_eligible, backup_state, clone_warning, created_at, last_used_at`
+
+// scanWebAuthnCredential reads a row selected with webAuthnCredentialColumns
+func scanWebAuthnCredential(scan func(dest ...any) error) (*WebAuthnCredential, error) {
+	var cred WebAuthnCredential
+	var signCount int64
+	var transports string
+	err := scan(
+		&cred.ID,
+		&cred.UserID,
+		&cred.Name,
+		&cred.PublicKey,
+		&cred.AttestationType,
+		&cred.AAGUID,
+		&signCount,
+		&transports,
+		&cred.UserVerified,
+		&cred.BackupEligible,
+		&cred.BackupState,
+		&cred.CloneWarning,
+		&cred.CreatedAt,
+		&cred.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	cred.SignCount = uint32(signCount)
+	cred.Transports = splitList(transports)
+	return &cred, nil
+}
+
+// CreateCredential stores a newly registered passkey
+func (r *WebAuthnRepository) CreateCredential(ctx context.Context, cred *WebAuthnCredential) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	cred.CreatedAt = time.Now()
+	query := `
+        INSERT INTO webauthn_credentials (id, user_id, name, public_key, attestation_type, aaguid, sign_count,
+            transports, user_verified, backup_eligible, backup_state, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+    `
+	_, err := r.db.Exec(ctx, query, cred.ID, cred.UserID, cred.Name, cred.PublicKey, cred.AttestationType, cred.AAGUID,
+		int64(cred.SignCount), joinList(cred.Transports), cred.UserVerified, cred.BackupEligible, cred.BackupState, cred.CreatedAt)
+	return err
+}
+
+// ListCredentials returns every passkey a user has registered
+func (r *WebAuthnRepository) ListCredentials(ctx context.Context, userID uuid.UUID) ([]*WebAuthnCredential, error) {
+	ctx, cancel := r.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + webAuthnCredentialColumns + ` FROM webauthn_credentials WHERE user_id = $1 ORDER BY created_at`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []*WebAuthnCredential
+	for rows.Next() {
+		cred, err := scanWebAuthnCredential(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+	return creds, rows.Err()
+}
+
+// RecordCredentialUse stores the sign count and flags seen on a successful assertion
+func (r *WebAuthnRepository) RecordCredentialUse(ctx context.Context, id []byte, signCount uint32, userVerified, backupState bool) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE webauthn_credentials
+        SET sign_count = $2, user_verified = user_verified OR $3, backup_state = $4, last_used_at = $5
+        WHERE id = $1
+    `
+	_, err := r.db.Exec(ctx, query, id, int64(signCount), userVerified, backupState, time.Now())
+	return err
+}
+
+// FlagCredentialCloned marks a passkey whose sign counter went backwards, it can't be used after this
+func (r *WebAuthnRepository) FlagCredentialCloned(ctx context.Context, id []byte) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `UPDATE webauthn_credentials SET clone_warning = true WHERE id = $1`
+	_, err := r.db.Exec(ctx, query, id)
+	return err
+}
+
+// DeleteCredential removes one of a user's passkeys, returning sql.ErrNoRows if they don't own it
+func (r *WebAuthnRepository) DeleteCredential(ctx context.Context, userID uuid.UUID, id []byte) error {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `DELETE FROM webauthn_credentials WHERE user_id = $1 AND id = $2`
+	result, err := r.db.Exec(ctx, query, userID, id)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateSession stores ceremony state and returns its ID, abandoned ceremonies are cleared out on the way
+func (r *WebAuthnRepository) CreateSession(ctx context.Context, userID *uuid.UUID, purpose string, data []byte, ttl time.Duration) (uuid.UUID, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	now := time.Now()
+	if _, err := r.db.Exec(ctx, `DELETE FROM webauthn_sessions WHERE expires_at < $1`, now); err != nil {
+		return uuid.Nil, err
+	}
+
+	id := uuid.New()
+	query := `
+        INSERT INTO webauthn_sessions (id, user_id, purpose, data, expires_at, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+    `
+	_, err := r.db.Exec(ctx, query, id, userID, purpose, data, now.Add(ttl), now)
+	return id, err
+}
+
+// TakeSession deletes and returns an unexpired ceremony so each one can only be finished once.
+// It returns sql.ErrNoRows if there's no such session.
+func (r *WebAuthnRepository) TakeSession(ctx context.Context, id uuid.UUID, purpose string) (*WebAuthnSession, error) {
+	ctx, cancel := r.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        DELETE FROM webauthn_sessions
+        WHERE id = $1 AND purpose = $2
+        RETURNING id, user_id, purpose, data, expires_at
+    `
+
+	var session WebAuthnSession
+	err := r.db.QueryRow(ctx, query, id, purpose).Scan(&session.ID, &session.UserID, &session.Purpose, &session.Data, &session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return &session, nil
+}
@@ -0,0 +1,205 @@
+// Package problem writes error responses as RFC 7807 problem details, so clients can switch
+// on a stable code instead of matching message text.
+package problem
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pjontop/placer/backend/auth"
+	"github.com/pjontop/placer/backend/logging"
+	"github.com/pjontop/placer/backend/webauthn"
+)
+
+// ContentType is the media type of every error response
+const ContentType = "application/problem+json"
+
+// typeBase prefixes the code to make a problem's type URI
+const typeBase = "urn:placer:problem:"
+
+// Codes identify a kind of problem. They're part of the API, don't change them.
+const (
+	CodeMalformedRequest   = "malformed_request"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeRateLimited        = "rate_limited"
+	CodeInternal           = "internal_error"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeEmailInUse         = "email_in_use"
+	CodeEmailNotVerified   = "email_not_verified"
+	CodeAccountLocked      = "account_locked"
+	CodeInvalidToken       = "invalid_token"
+	CodeTokenExpired       = "token_expired"
+	CodeTokenRevoked       = "token_revoked"
+	CodeInvalidMFACode     = "invalid_mfa_code"
+	CodeMFAAlreadyEnabled  = "mfa_already_enabled"
+	CodeMFANotEnabled      = "mfa_not_enabled"
+	CodePasskeyExpired     = "passkey_session_expired"
+	CodeNoPasskeys         = "no_passkeys"
+	CodePasskeyRejected    = "passkey_rejected"
+)
+
+// Problem is an RFC 7807 problem details document, with our code, the request ID and any
+// per-field validation errors as extension members
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+
+	// RetryAfter is sent as the Retry-After header when it's set
+	RetryAfter time.Duration `json:"-"`
+}
+
+// FieldError says what's wrong with one field of the request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// New creates a problem, title is a short summary that's the same every time the code occurs
+func New(status int, code, title string) *Problem {
+	return &Problem{Type: typeBase + code, Title: title, Status: status, Code: code}
+}
+
+// WithDetail adds an explanation specific to this occurrence
+func (p *Problem) WithDetail(detail string) *Problem {
+	p.Detail = detail
+	return p
+}
+
+// Malformed is the problem for a body that isn't the JSON we expect
+func Malformed() *Problem {
+	return New(http.StatusBadRequest, CodeMalformedRequest, "Invalid request payload")
+}
+
+// Invalid is the problem for a body that parsed but has bad fields
+func Invalid(errs ...FieldError) *Problem {
+	p := New(http.StatusBadRequest, CodeValidationFailed, "Request validation failed")
+	p.Errors = errs
+	return p
+}
+
+// Required is the field error for a missing field
+func Required(field string) FieldError {
+	return FieldError{Field: field, Code: "required", Message: field + " is required"}
+}
+
+// InvalidField is the field error for a value we can't use, message says what it must be
+func InvalidField(field, message string) FieldError {
+	return FieldError{Field: field, Code: "invalid", Message: field + " " + message}
+}
+
+// Unauthorized is the problem for a request without a usable access token
+func Unauthorized() *Problem {
+	return New(http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+}
+
+// Forbidden is the problem for a caller that isn't allowed to do this
+func Forbidden() *Problem {
+	return New(http.StatusForbidden, CodeForbidden, "Forbidden")
+}
+
+// NotFound is the problem for a missing resource, what names it like "Session not found"
+func NotFound(what string) *Problem {
+	return New(http.StatusNotFound, CodeNotFound, what)
+}
+
+// RateLimited is the problem for a client that has run out of requests
+func RateLimited(retryAfter time.Duration) *Problem {
+	p := New(http.StatusTooManyRequests, CodeRateLimited, "Too many requests")
+	p.RetryAfter = retryAfter
+	return p
+}
+
+// Internal is the problem for anything unexpected, it never says what went wrong
+func Internal() *Problem {
+	return New(http.StatusInternalServerError, CodeInternal, "Internal server error")
+}
+
+// FromError maps an error from the services to a problem. Anything it doesn't know is an
+// internal error, so callers should log err when Status is 500.
+func FromError(err error) *Problem {
+	var lockout *auth.LockoutError
+	switch {
+	case errors.As(err, &lockout):
+		p := New(http.StatusTooManyRequests, CodeAccountLocked, "Too many failed login attempts, try again later")
+		p.RetryAfter = lockout.RetryAfter()
+		return p
+	case errors.Is(err, auth.ErrAccountLocked):
+		return New(http.StatusTooManyRequests, CodeAccountLocked, "Too many failed login attempts, try again later")
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		return New(http.StatusUnauthorized, CodeInvalidCredentials, "Invalid credentials")
+	case errors.Is(err, auth.ErrEmailInUse):
+		return New(http.StatusConflict, CodeEmailInUse, "Email already in use")
+	case errors.Is(err, auth.ErrEmailNotVerified):
+		return New(http.StatusForbidden, CodeEmailNotVerified, "Email address not verified")
+	// A reused refresh token looks like any other bad one, so callers can't probe for reuse
+	case errors.Is(err, auth.ErrTokenReused), errors.Is(err, auth.ErrInvalidToken):
+		return New(http.StatusUnauthorized, CodeInvalidToken, "Invalid or expired token")
+	case errors.Is(err, auth.ErrExpiredToken):
+		return New(http.StatusUnauthorized, CodeTokenExpired, "Token has expired")
+	case errors.Is(err, auth.ErrTokenRevoked):
+		return New(http.StatusUnauthorized, CodeTokenRevoked, "Token has been revoked")
+	case errors.Is(err, auth.ErrInvalidMFACode):
+		return New(http.StatusUnauthorized, CodeInvalidMFACode, "Invalid code")
+	case errors.Is(err, auth.ErrMFAAlreadyEnabled):
+		return New(http.StatusConflict, CodeMFAAlreadyEnabled, "Two-factor authentication is already enabled")
+	case errors.Is(err, auth.ErrMFANotEnabled):
+		return New(http.StatusConflict, CodeMFANotEnabled, "Two-factor authentication is not enabled")
+	case errors.Is(err, auth.ErrSessionNotFound):
+		return NotFound("Session not found")
+	case errors.Is(err, webauthn.ErrSessionNotFound):
+		return New(http.StatusBadRequest, CodePasskeyExpired, "Passkey session expired, start again")
+	case errors.Is(err, webauthn.ErrNoCredentials):
+		return New(http.StatusBadRequest, CodeNoPasskeys, "No passkeys registered")
+	case errors.Is(err, webauthn.ErrCloneDetected), errors.Is(err, webauthn.ErrVerificationFailed):
+		return New(http.StatusUnauthorized, CodePasskeyRejected, "Passkey verification failed")
+	case errors.Is(err, sql.ErrNoRows):
+		return NotFound("Not found")
+	}
+	return Internal()
+}
+
+// Error writes the problem FromError picks for err
+func Error(w http.ResponseWriter, r *http.Request, err error) {
+	Write(w, r, FromError(err))
+}
+
+// Write sends p, filling in the request path and ID
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if p.Instance == "" {
+		p.Instance = r.URL.Path
+	}
+	if p.RequestID == "" {
+		p.RequestID = logging.RequestID(r.Context())
+	}
+	if p.RetryAfter > 0 {
+		WriteRetryAfter(w, p.RetryAfter)
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// WriteRetryAfter sets the Retry-After header in whole seconds, rounding up
+func WriteRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
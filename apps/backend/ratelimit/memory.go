@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryLimiter keeps buckets in process memory, each replica counts on its own
+type MemoryLimiter struct {
+	rate    Rate
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// NewMemoryLimiter creates an in-memory limiter allowing the given rate per key
+func NewMemoryLimiter(rate Rate) *MemoryLimiter {
+	return &MemoryLimiter{rate: rate, buckets: map[string]*bucket{}}
+}
+
+// Allow takes a token from the key's bucket, or reports how long until one is available
+func (l *MemoryLimiter) Allow(_ context.Context, key string) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate.Limit), updatedAt: now}
+		l.buckets[key] = b
+	}
+	tokens, allowed, retryAfter := refill(l.rate, b.tokens, b.updatedAt, now)
+	b.tokens, b.updatedAt = tokens, now
+	return allowed, retryAfter, nil
+}
+
+// Prune drops buckets that have refilled completely
+func (l *MemoryLimiter) Prune(_ context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, b := range l.buckets {
+		if now.Sub(b.updatedAt) >= l.rate.Period {
+			delete(l.buckets, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// PostgresLimiter keeps buckets in the rate_limit_buckets table so every replica shares them
+type PostgresLimiter struct {
+	db       *pgxpool.Pool
+	timeouts db.Timeouts
+	name     string
+	rate     Rate
+}
+
+// NewPostgresLimiter creates a limiter backed by the database. The name keeps the buckets of
+// limiters with different rates apart when they see the same key.
+func NewPostgresLimiter(database *pgxpool.Pool, timeouts db.Timeouts, name string, rate Rate) *PostgresLimiter {
+	return &PostgresLimiter{db: database, timeouts: timeouts, name: name, rate: rate}
+}
+
+// bucketKey hashes the key so emails and IPs aren't stored in the clear
+func (l *PostgresLimiter) bucketKey(key string) string {
+	sum := sha256.Sum256([]byte(l.name + ":" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Allow takes a token from the key's bucket, or reports how long until one is available
+func (l *PostgresLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	ctx, cancel := l.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	tx, err := l.db.Begin(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	bucketKey := l.bucketKey(key)
+	now := time.Now()
+	// Create the bucket full if it's new, then lock it so concurrent requests take turns
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO rate_limit_buckets (key, limiter, tokens, updated_at)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (key) DO NOTHING
+    `, bucketKey, l.name, float64(l.rate.Limit), now); err != nil {
+		return false, 0, err
+	}
+
+	var tokens float64
+	var updatedAt time.Time
+	if err := tx.QueryRow(ctx, `SELECT tokens, updated_at FROM rate_limit_buckets WHERE key = $1 FOR UPDATE`, bucketKey).
+		Scan(&tokens, &updatedAt); err != nil {
+		return false, 0, err
+	}
+
+	tokens, allowed, retryAfter := refill(l.rate, tokens, updatedAt, now)
+	if _, err := tx.Exec(ctx, `UPDATE rate_limit_buckets SET tokens = $2, updated_at = $3 WHERE key = $1`, bucketKey, tokens, now); err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, tx.Commit(ctx)
+}
+
+// Prune drops buckets that have refilled completely
+func (l *PostgresLimiter) Prune(ctx context.Context) error {
+	ctx, cancel := l.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	_, err := l.db.Exec(ctx, `DELETE FROM rate_limit_buckets WHERE limiter = $1 AND updated_at <= $2`, l.name, time.Now().Add(-l.rate.Period))
+	return err
+}
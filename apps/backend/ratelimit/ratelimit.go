@@ -0,0 +1,84 @@
+// Package ratelimit throttles requests with token buckets. Each key gets a bucket holding up
+// to Burst tokens that refills at Limit tokens per Period; a request takes one token and is
+// refused while the bucket is empty.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate is how many requests a key may make per period
+type Rate struct {
+	Limit  int
+	Period time.Duration
+}
+
+// ParseRate reads a rate written as "<limit>/<period>", e.g. "5/1m"
+func ParseRate(s string) (Rate, error) {
+	limit, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("rate %q must look like 5/1m", s)
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 1 {
+		return Rate{}, fmt.Errorf("invalid limit in rate %q", s)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("invalid period in rate %q", s)
+	}
+	return Rate{Limit: n, Period: d}, nil
+}
+
+// interval is how long it takes to refill a single token
+func (r Rate) interval() time.Duration {
+	return r.Period / time.Duration(r.Limit)
+}
+
+// Limiter decides whether a key may make another request
+type Limiter interface {
+	// Allow takes a token from the key's bucket, or reports how long until one is available
+	Allow(ctx context.Context, key string) (allowed bool, retryAfter time.Duration, err error)
+	// Prune drops buckets that have refilled completely, they're the same as no bucket
+	Prune(ctx context.Context) error
+}
+
+// refill tops up a bucket for the time since it was last updated and takes a token if there is one.
+// It returns the new token count, whether a token was taken, and how long until one is available.
+func refill(rate Rate, tokens float64, updatedAt, now time.Time) (float64, bool, time.Duration) {
+	elapsed := now.Sub(updatedAt)
+	if elapsed > 0 {
+		tokens = math.Min(float64(rate.Limit), tokens+float64(elapsed)/float64(rate.interval()))
+	}
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	wait := time.Duration((1 - tokens) * float64(rate.interval()))
+	return tokens, false, wait
+}
+
+// StartPruner prunes the limiter every interval until the returned stop function is called
+func StartPruner(limiter Limiter, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := limiter.Prune(context.Background()); err != nil {
+					slog.Error("failed to prune rate limit buckets", "err", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
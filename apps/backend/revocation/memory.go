@@ -0,0 +1,88 @@
+package revocation
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process LRU denylist, for single instance deployments. Once it's full
+// the least recently checked entry is evicted, which makes that token usable again, so the
+// capacity should cover every logout within one access token lifetime.
+type MemoryStore struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // front is most recently used
+}
+
+type memoryEntry struct {
+	jti       string
+	expiresAt time.Time
+}
+
+// NewMemoryStore creates an in-memory store holding at most capacity entries
+func NewMemoryStore(capacity int) *MemoryStore {
+	return &MemoryStore{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// Revoke denylists a token ID until expiresAt
+func (s *MemoryStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[jti]; ok {
+		el.Value.(*memoryEntry).expiresAt = expiresAt
+		s.order.MoveToFront(el)
+		return nil
+	}
+	s.entries[jti] = s.order.PushFront(&memoryEntry{jti: jti, expiresAt: expiresAt})
+	for s.order.Len() > s.capacity {
+		s.remove(s.order.Back())
+	}
+	return nil
+}
+
+// IsRevoked reports whether a token ID is denylisted
+func (s *MemoryStore) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[jti]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(el.Value.(*memoryEntry).expiresAt) {
+		s.remove(el)
+		return false, nil
+	}
+	s.order.MoveToFront(el)
+	return true, nil
+}
+
+// Prune drops entries for tokens that have expired
+func (s *MemoryStore) Prune(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for el := s.order.Front(); el != nil; {
+		next := el.Next()
+		if now.After(el.Value.(*memoryEntry).expiresAt) {
+			s.remove(el)
+		}
+		el = next
+	}
+	return nil
+}
+
+// remove deletes an entry, the caller holds the lock
+func (s *MemoryStore) remove(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.entries, el.Value.(*memoryEntry).jti)
+}
@@ -0,0 +1,54 @@
+package revocation
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pjontop/placer/backend/db"
+)
+
+// PostgresStore keeps the denylist in the revoked_access_tokens table, shared by every instance
+type PostgresStore struct {
+	db       *pgxpool.Pool
+	timeouts db.Timeouts
+}
+
+// NewPostgresStore creates a store backed by the database
+func NewPostgresStore(database *pgxpool.Pool, timeouts db.Timeouts) *PostgresStore {
+	return &PostgresStore{db: database, timeouts: timeouts}
+}
+
+// Revoke denylists a token ID until expiresAt
+func (s *PostgresStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	ctx, cancel := s.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	query := `
+        INSERT INTO revoked_access_tokens (jti, expires_at)
+        VALUES ($1, $2)
+        ON CONFLICT (jti) DO NOTHING
+    `
+	_, err := s.db.Exec(ctx, query, jti, expiresAt)
+	return err
+}
+
+// IsRevoked reports whether a token ID is denylisted
+func (s *PostgresStore) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	ctx, cancel := s.timeouts.ReadContext(ctx)
+	defer cancel()
+
+	query := `SELECT EXISTS (SELECT 1 FROM revoked_access_tokens WHERE jti = $1 AND expires_at > $2)`
+	var revoked bool
+	err := s.db.QueryRow(ctx, query, jti, time.Now()).Scan(&revoked)
+	return revoked, err
+}
+
+// Prune drops entries for tokens that have expired
+func (s *PostgresStore) Prune(ctx context.Context) error {
+	ctx, cancel := s.timeouts.WriteContext(ctx)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, `DELETE FROM revoked_access_tokens WHERE expires_at <= $1`, time.Now())
+	return err
+}
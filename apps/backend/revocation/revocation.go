@@ -0,0 +1,40 @@
+// Package revocation keeps a denylist of access tokens that were revoked before they expired.
+// Access tokens are checked by signature alone, so logging out or changing a password only
+// takes effect on them once their jti is in the store.
+package revocation
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Store records revoked token IDs until the tokens would have expired anyway
+type Store interface {
+	// Revoke denylists a token ID until expiresAt
+	Revoke(ctx context.Context, jti string, expiresAt time.Time) error
+	// IsRevoked reports whether a token ID is denylisted
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+	// Prune drops entries for tokens that have expired
+	Prune(ctx context.Context) error
+}
+
+// StartPruner prunes the store every interval until the returned stop function is called
+func StartPruner(store Store, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := store.Prune(context.Background()); err != nil {
+					slog.Error("failed to prune revoked tokens", "err", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
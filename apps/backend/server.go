@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pjontop/placer/backend/config"
+)
+
+// newServer creates an http.Server with timeouts on every phase of a request, so slow or idle
+// clients can't hold connections open forever
+func newServer(addr string, handler http.Handler, cfg config.HTTPConfig) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// runServers serves until ctx is cancelled or one of the servers fails, then calls drain and
+// shuts them all down, letting in-flight requests finish for up to timeout
+func runServers(ctx context.Context, logger *slog.Logger, timeout time.Duration, drain func(), servers ...*http.Server) error {
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			logger.Info("listening", "addr", server.Addr)
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}()
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		logger.Info("shutting down, draining connections", "timeout", timeout)
+	case serveErr = <-errs:
+		logger.Error("server failed, shutting down", "err", serveErr)
+	}
+	drain()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("failed to drain connections", "addr", server.Addr, "err", err)
+			server.Close()
+		}
+	}
+	return serveErr
+}
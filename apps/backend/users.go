@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/pjontop/placer/backend/config"
+	"github.com/pjontop/placer/backend/db"
+	"github.com/pjontop/placer/backend/models"
+)
+
+const usersUsage = "usage: backend users set-role <email> user|admin"
+
+// runUsers handles the users subcommand, which covers account changes there's no API for
+func runUsers(args []string) {
+	if len(args) != 3 || args[0] != "set-role" {
+		log.Fatal(usersUsage)
+	}
+	email, role := args[1], args[2]
+	if role != models.RoleUser && role != models.RoleAdmin {
+		log.Fatal(usersUsage)
+	}
+
+	databaseURL, err := config.LoadDatabaseURL()
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+
+	database, err := db.Connect(context.Background(), databaseURL, db.PoolConfig{})
+	if err != nil {
+		log.Fatalf("failed db connection with: %v", err)
+	}
+	defer database.Close()
+
+	// A one-off command run by hand, it can wait on the database as long as it takes
+	if err := models.NewUserRepository(database, db.Timeouts{}).SetRole(context.Background(), email, role); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Fatalf("no user with email %s", email)
+		}
+		log.Fatalf("failed to set role: %v", err)
+	}
+	// The role is carried in access tokens, so it applies from the user's next login or refresh
+	log.Printf("%s is now %s", email, role)
+}
@@ -0,0 +1,333 @@
+// Package webauthn runs passkey registration and assertion ceremonies on top of go-webauthn,
+// keeping credentials and ceremony state in Postgres.
+package webauthn
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	gowebauthn "github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/pjontop/placer/backend/models"
+)
+
+var (
+	ErrSessionNotFound    = errors.New("webauthn session not found or expired")
+	ErrNoCredentials      = errors.New("user has no passkeys")
+	ErrVerificationFailed = errors.New("webauthn verification failed")
+	ErrCloneDetected      = errors.New("passkey sign counter went backwards, possible clone")
+)
+
+// Ceremony kinds, stored with the session so one can't be finished as the other
+const (
+	purposeRegistration = "registration"
+	purposeLogin        = "login"
+)
+
+// Config holds the relying party settings
+type Config struct {
+	RPID          string
+	RPDisplayName string
+	RPOrigins     []string
+	// SessionTTL is how long a client has between begin and finish
+	SessionTTL time.Duration
+}
+
+// Service runs WebAuthn ceremonies for our users
+type Service struct {
+	wa         *gowebauthn.WebAuthn
+	userRepo   models.UserStore
+	repo       models.WebAuthnStore
+	sessionTTL time.Duration
+	logger     *slog.Logger
+}
+
+// NewService creates a WebAuthn service for the configured relying party
+func NewService(userRepo models.UserStore, repo models.WebAuthnStore, cfg Config, logger *slog.Logger) (*Service, error) {
+	wa, err := gowebauthn.New(&gowebauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: cfg.RPDisplayName,
+		RPOrigins:     cfg.RPOrigins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationPreferred,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Service{wa: wa, userRepo: userRepo, repo: repo, sessionTTL: cfg.SessionTTL, logger: logger}, nil
+}
+
+// user adapts a models.User and its passkeys to go-webauthn's User interface
+type user struct {
+	model *models.User
+	creds []*models.WebAuthnCredential
+}
+
+func (u *user) WebAuthnID() []byte          { return u.model.ID[:] }
+func (u *user) WebAuthnName() string        { return u.model.Email }
+func (u *user) WebAuthnDisplayName() string { return u.model.Name }
+
+// WebAuthnCredentials leaves out passkeys flagged as cloned so they can never be used again
+func (u *user) WebAuthnCredentials() []gowebauthn.Credential {
+	creds := make([]gowebauthn.Credential, 0, len(u.creds))
+	for _, c := range u.creds {
+		if c.CloneWarning {
+			continue
+		}
+		transports := make([]protocol.AuthenticatorTransport, len(c.Transports))
+		for i, t := range c.Transports {
+			transports[i] = protocol.AuthenticatorTransport(t)
+		}
+		creds = append(creds, gowebauthn.Credential{
+			ID:              c.ID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: gowebauthn.CredentialFlags{
+				UserPresent:    true,
+				UserVerified:   c.UserVerified,
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: gowebauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return creds
+}
+
+// loadUser builds the adapter for a user with their passkeys
+func (s *Service) loadUser(ctx context.Context, model *models.User) (*user, error) {
+	creds, err := s.repo.ListCredentials(ctx, model.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &user{model: model, creds: creds}, nil
+}
+
+// BeginRegistration starts registering a new passkey for a user
+func (s *Service) BeginRegistration(ctx context.Context, model *models.User) (*protocol.CredentialCreation, uuid.UUID, error) {
+	u, err := s.loadUser(ctx, model)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+
+	// Stop the same authenticator being registered twice
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(u.creds))
+	for _, c := range u.WebAuthnCredentials() {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+
+	creation, session, err := s.wa.BeginRegistration(u, gowebauthn.WithExclusions(exclusions))
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	sessionID, err := s.saveSession(ctx, &model.ID, purposeRegistration, session)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	return creation, sessionID, nil
+}
+
+// FinishRegistration verifies the authenticator's attestation response and stores the new passkey
+func (s *Service) FinishRegistration(ctx context.Context, model *models.User, sessionID uuid.UUID, name string, response []byte) (*models.WebAuthnCredential, error) {
+	session, err := s.takeSession(ctx, sessionID, purposeRegistration, &model.ID)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.loadUser(ctx, model)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+	credential, err := s.wa.CreateCredential(u, *session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i, t := range credential.Transport {
+		transports[i] = string(t)
+	}
+	if name == "" {
+		name = "Passkey"
+	}
+	cred := &models.WebAuthnCredential{
+		ID:              credential.ID,
+		UserID:          model.ID,
+		Name:            name,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		Transports:      transports,
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+	if err := s.repo.CreateCredential(ctx, cred); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+// BeginLogin starts an assertion limited to one user's passkeys, used as a second factor
+func (s *Service) BeginLogin(ctx context.Context, model *models.User) (*protocol.CredentialAssertion, uuid.UUID, error) {
+	u, err := s.loadUser(ctx, model)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	if len(u.WebAuthnCredentials()) == 0 {
+		return nil, uuid.Nil, ErrNoCredentials
+	}
+
+	assertion, session, err := s.wa.BeginLogin(u)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	sessionID, err := s.saveSession(ctx, &model.ID, purposeLogin, session)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	return assertion, sessionID, nil
+}
+
+// FinishLogin verifies an assertion from one of the user's passkeys
+func (s *Service) FinishLogin(ctx context.Context, model *models.User, sessionID uuid.UUID, response []byte) error {
+	session, err := s.takeSession(ctx, sessionID, purposeLogin, &model.ID)
+	if err != nil {
+		return err
+	}
+	u, err := s.loadUser(ctx, model)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+	credential, err := s.wa.ValidateLogin(u, *session, parsed)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+	return s.recordUse(ctx, model.ID, credential)
+}
+
+// BeginDiscoverableLogin starts a passwordless login where the authenticator picks the account.
+// User verification is required since the passkey stands in for the password as well.
+func (s *Service) BeginDiscoverableLogin(ctx context.Context) (*protocol.CredentialAssertion, uuid.UUID, error) {
+	assertion, session, err := s.wa.BeginDiscoverableLogin(gowebauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	sessionID, err := s.saveSession(ctx, nil, purposeLogin, session)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	return assertion, sessionID, nil
+}
+
+// FinishDiscoverableLogin verifies a passwordless assertion and returns the user it belongs to
+func (s *Service) FinishDiscoverableLogin(ctx context.Context, sessionID uuid.UUID, response []byte) (*models.User, error) {
+	session, err := s.takeSession(ctx, sessionID, purposeLogin, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+
+	var found *user
+	handler := func(rawID, userHandle []byte) (gowebauthn.User, error) {
+		userID, err := uuid.FromBytes(userHandle)
+		if err != nil {
+			return nil, err
+		}
+		model, err := s.userRepo.GetUserByID(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		found, err = s.loadUser(ctx, model)
+		if err != nil {
+			return nil, err
+		}
+		return found, nil
+	}
+	credential, err := s.wa.ValidateDiscoverableLogin(handler, *session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+	if err := s.recordUse(ctx, found.model.ID, credential); err != nil {
+		return nil, err
+	}
+	return found.model, nil
+}
+
+// ListCredentials returns a user's passkeys
+func (s *Service) ListCredentials(ctx context.Context, userID uuid.UUID) ([]*models.WebAuthnCredential, error) {
+	return s.repo.ListCredentials(ctx, userID)
+}
+
+// DeleteCredential removes one of a user's passkeys
+func (s *Service) DeleteCredential(ctx context.Context, userID uuid.UUID, credentialID []byte) error {
+	return s.repo.DeleteCredential(ctx, userID, credentialID)
+}
+
+// recordUse saves the new sign count after an assertion, or flags the passkey if its
+// counter didn't move forward, which means a copy of the key is in use somewhere
+func (s *Service) recordUse(ctx context.Context, userID uuid.UUID, credential *gowebauthn.Credential) error {
+	if credential.Authenticator.CloneWarning {
+		s.logger.Warn("passkey sign counter regressed, flagging credential as cloned", "user_id", userID)
+		if err := s.repo.FlagCredentialCloned(ctx, credential.ID); err != nil {
+			return err
+		}
+		return ErrCloneDetected
+	}
+	return s.repo.RecordCredentialUse(ctx, credential.ID, credential.Authenticator.SignCount, credential.Flags.UserVerified, credential.Flags.BackupState)
+}
+
+// saveSession stores ceremony state until the finish call
+func (s *Service) saveSession(ctx context.Context, userID *uuid.UUID, purpose string, session *gowebauthn.SessionData) (uuid.UUID, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return s.repo.CreateSession(ctx, userID, purpose, data, s.sessionTTL)
+}
+
+// takeSession loads and removes ceremony state, checking it was started for the same user
+func (s *Service) takeSession(ctx context.Context, sessionID uuid.UUID, purpose string, userID *uuid.UUID) (*gowebauthn.SessionData, error) {
+	stored, err := s.repo.TakeSession(ctx, sessionID, purpose)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	if (userID == nil) != (stored.UserID == nil) || (userID != nil && *userID != *stored.UserID) {
+		return nil, ErrSessionNotFound
+	}
+
+	var session gowebauthn.SessionData
+	if err := json.Unmarshal(stored.Data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
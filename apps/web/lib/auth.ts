@@ -29,6 +29,27 @@ export type AuthResult<T> =
   | { success: true; data: T }
   | { success: false; error: string }
 
+// Problem is the RFC 7807 body the backend sends with every error
+export type Problem = {
+  type: string
+  title: string
+  status: number
+  detail?: string
+  code: string
+  request_id?: string
+  errors?: { field: string; code: string; message: string }[]
+}
+
+async function errorMessage(res: Response, fallback: string) {
+  try {
+    const problem = (await res.json()) as Problem
+    if (problem.errors?.length) return problem.errors.map((e) => e.message).join(', ')
+    return problem.detail || problem.title || fallback
+  } catch (e) {
+    return fallback
+  }
+}
+
 let _accessToken: string | null = null
 
 export function getAccessToken() {
@@ -44,8 +65,7 @@ export async function signUp(email: string, name: string, password: string): Pro
     body: JSON.stringify({ email, name, password }),
   })
   if (!res.ok) {
-    const text = await res.text()
-    return { success: false, error: text || 'Registration failed' }
+    return { success: false, error: await errorMessage(res, 'Registration failed') }
   }
   const data = await res.json()
   return { success: true, data }
@@ -60,8 +80,7 @@ export async function signIn(email: string, password: string): Promise<AuthResul
     body: JSON.stringify({ email, password }),
   })
   if (!res.ok) {
-    const text = await res.text()
-    return { success: false, error: text || 'Login failed' }
+    return { success: false, error: await errorMessage(res, 'Login failed') }
   }
   const data = await res.json()
   const token = data.token as string